@@ -1,16 +1,36 @@
 package kvstore
 
 import (
+	"encoding/json"
 	"github.com/sosp23/replicated-store/go/config"
 	pb "github.com/sosp23/replicated-store/go/multipaxos/comm"
 	logger "github.com/sirupsen/logrus"
+	"strings"
 )
 
 const (
-	NotFound string = "key not found"
-	Empty           = ""
+	NotFound    string = "key not found"
+	ReservedKey        = "reserved key"
+	Empty              = ""
 )
 
+// MembershipKey is the reserved key under which the store keeps the current
+// peer set, so that it survives restarts and travels with snapshots.
+const MembershipKey = "\x00membership"
+
+// ShardsKey and DirectoryKey are the reserved keys under which the store of a
+// consensus group keeps the shard map it last applied and, in group 0, the
+// shard map that routes keys to groups.
+const (
+	ShardsKey    = "\x00shards"
+	DirectoryKey = "\x00directory"
+)
+
+// IsReserved reports whether key is one the store keeps for itself.
+func IsReserved(key string) bool {
+	return strings.HasPrefix(key, "\x00")
+}
+
 type KVResult struct {
 	Ok    bool
 	Value string
@@ -20,6 +40,14 @@ type KVStore interface {
 	Get(key string) *string
 	Put(key string, value string) bool
 	Del(key string) bool
+	Snapshot() ([]byte, error)
+	// Scan returns the keys from start up to, but not including, end and their
+	// values. An empty end stands for the end of the keyspace.
+	Scan(start string, end string) (map[string]string, error)
+	// View returns a function that serializes the store as it is now, which
+	// can be called later without holding up writes in the meantime.
+	View() func() ([]byte, error)
+	Restore(data []byte) error
 	Close()
 }
 
@@ -35,6 +63,25 @@ func CreateStore(config config.Config) KVStore {
 }
 
 func Execute(cmd *pb.Command, store KVStore) KVResult {
+	if cmd.Type == pb.CommandType_NOOP {
+		return KVResult{Ok: true, Value: Empty}
+	}
+
+	if cmd.Type == pb.CommandType_ADD_PEER ||
+		cmd.Type == pb.CommandType_REMOVE_PEER {
+		// the leader encodes the peer set that results from the change.
+		if store.Put(MembershipKey, cmd.Value) {
+			return KVResult{Ok: true, Value: Empty}
+		}
+		return KVResult{Ok: false, Value: NotFound}
+	}
+
+	// only the log writes the keys the store keeps for itself, so that a
+	// client cannot corrupt them.
+	if IsReserved(cmd.Key) {
+		return KVResult{Ok: false, Value: ReservedKey}
+	}
+
 	if cmd.Type == pb.CommandType_GET {
 		value := store.Get(cmd.Key)
 		if value != nil {
@@ -60,3 +107,26 @@ func Execute(cmd *pb.Command, store KVStore) KVResult {
 	}
 	return KVResult{Ok: false, Value: NotFound}
 }
+
+func EncodeMembership(members map[int64]string) string {
+	data, _ := json.Marshal(members)
+	return string(data)
+}
+
+func DecodeMembership(value string) (map[int64]string, error) {
+	members := make(map[int64]string)
+	if err := json.Unmarshal([]byte(value), &members); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// LoadMembership returns the peer set recorded in store, or nil if no
+// reconfiguration has been executed yet.
+func LoadMembership(store KVStore) (map[int64]string, error) {
+	value := store.Get(MembershipKey)
+	if value == nil || *value == "" {
+		return nil, nil
+	}
+	return DecodeMembership(*value)
+}
@@ -1,5 +1,6 @@
 package kvstore
 
+import "encoding/json"
 
 type MemKVStore struct {
 	store map[string]string
@@ -34,4 +35,38 @@ func (s *MemKVStore) Del(key string) bool {
 	}
 }
 
+func (s *MemKVStore) Snapshot() ([]byte, error) {
+	return json.Marshal(s.store)
+}
+
+func (s *MemKVStore) Scan(start string, end string) (map[string]string,
+	error) {
+	store := make(map[string]string)
+	for key, value := range s.store {
+		if key >= start && (end == "" || key < end) {
+			store[key] = value
+		}
+	}
+	return store, nil
+}
+
+func (s *MemKVStore) View() func() ([]byte, error) {
+	store := make(map[string]string, len(s.store))
+	for key, value := range s.store {
+		store[key] = value
+	}
+	return func() ([]byte, error) {
+		return json.Marshal(store)
+	}
+}
+
+func (s *MemKVStore) Restore(data []byte) error {
+	store := make(map[string]string)
+	if err := json.Unmarshal(data, &store); err != nil {
+		return err
+	}
+	s.store = store
+	return nil
+}
+
 func (s *MemKVStore) Close() {}
@@ -2,8 +2,10 @@ package log
 
 import (
 	"github.com/golang/protobuf/proto"
+	"github.com/sosp23/replicated-store/go/config"
 	"github.com/sosp23/replicated-store/go/kvstore"
 	pb "github.com/sosp23/replicated-store/go/multipaxos/comm"
+	"github.com/sosp23/replicated-store/go/shard"
 	logger "github.com/sirupsen/logrus"
 	"sync"
 )
@@ -21,13 +23,34 @@ func IsInProgress(instance *pb.Instance) bool {
 }
 
 func IsEqualCommand(cmd1, cmd2 *pb.Command) bool {
-	return cmd1.GetType() == cmd2.GetType() && cmd1.GetKey() == cmd2.GetKey() &&
-		cmd1.GetValue() == cmd2.GetValue()
+	if cmd1.GetType() != cmd2.GetType() || cmd1.GetKey() != cmd2.GetKey() ||
+		cmd1.GetValue() != cmd2.GetValue() ||
+		len(cmd1.GetCommands()) != len(cmd2.GetCommands()) ||
+		len(cmd1.GetClientIds()) != len(cmd2.GetClientIds()) {
+		return false
+	}
+	for i := range cmd1.GetCommands() {
+		if !IsEqualCommand(cmd1.GetCommands()[i], cmd2.GetCommands()[i]) {
+			return false
+		}
+	}
+	for i := range cmd1.GetClientIds() {
+		if cmd1.GetClientIds()[i] != cmd2.GetClientIds()[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func IsReconfiguration(cmd *pb.Command) bool {
+	return cmd.GetType() == pb.CommandType_ADD_PEER ||
+		cmd.GetType() == pb.CommandType_REMOVE_PEER
 }
 
 func IsEqualInstance(a, b *pb.Instance) bool {
-	return a.GetBallot() == b.GetBallot() && a.GetIndex() == b.GetIndex() &&
-		a.GetClientId() == b.GetClientId() && a.GetState() == b.GetState() &&
+	return a.GetBallot().Equal(b.GetBallot()) &&
+		a.GetIndex() == b.GetIndex() && a.GetClientId() == b.GetClientId() &&
+		a.GetState() == b.GetState() &&
 		IsEqualCommand(a.GetCommand(), b.GetCommand())
 }
 
@@ -45,12 +68,12 @@ func Insert(log map[int64]*pb.Instance, instance *pb.Instance) bool {
 		return false
 	}
 
-	if instance.GetBallot() > log[i].GetBallot() {
+	if log[i].GetBallot().Less(instance.GetBallot()) {
 		log[i] = instance
 		return false
 	}
 
-	if instance.GetBallot() == log[i].GetBallot() {
+	if instance.GetBallot().Equal(log[i].GetBallot()) {
 		if !IsEqualCommand(log[i].GetCommand(), instance.GetCommand()) {
 			logger.Panicf("case 3 violation\n")
 		}
@@ -58,6 +81,16 @@ func Insert(log map[int64]*pb.Instance, instance *pb.Instance) bool {
 	return false
 }
 
+type Snapshot struct {
+	LastIncludedIndex int64
+	Data              []byte
+}
+
+type batchResult struct {
+	clientId int64
+	result   *kvstore.KVResult
+}
+
 type Log struct {
 	running            bool
 	kvStore            kvstore.KVStore
@@ -67,13 +100,39 @@ type Log struct {
 	globalLastExecuted int64
 	mu                 sync.Mutex
 	cvExecutable       *sync.Cond
+	cvExecuted         *sync.Cond
 	cvCommittable      *sync.Cond
+	cvSnapshot         *sync.Cond
+	snapshotting       bool
+	wal                *WAL
+	lastIncludedIndex  int64
+	snapshot           *Snapshot
+	snapshotInterval   int64
+	batchResults       []batchResult
+	membershipHandler  func(map[int64]string)
+	witness            bool
+	group              int64
+	initialShards      *shard.Map
+	shards             *shard.Map
+	directory          *shard.Map
+}
+
+func CreateWAL(config config.Config) *WAL {
+	if config.WalPath == "" {
+		return nil
+	}
+	wal, err := OpenWAL(config.WalPath, config.WalSegmentSize)
+	if err != nil {
+		logger.Panic(err)
+	}
+	return wal
 }
 
-func NewLog(s kvstore.KVStore) *Log {
+func NewLog(s kvstore.KVStore, wal *WAL) *Log {
 	l := Log{
 		running:            true,
 		kvStore:            s,
+		wal:                wal,
 		log:                make(map[int64]*pb.Instance),
 		lastIndex:          0,
 		lastExecuted:       0,
@@ -81,10 +140,100 @@ func NewLog(s kvstore.KVStore) *Log {
 		mu:                 sync.Mutex{},
 	}
 	l.cvExecutable = sync.NewCond(&l.mu)
+	l.cvExecuted = sync.NewCond(&l.mu)
 	l.cvCommittable = sync.NewCond(&l.mu)
+	l.cvSnapshot = sync.NewCond(&l.mu)
+	if wal != nil {
+		l.recover()
+	}
 	return &l
 }
 
+func (l *Log) recover() {
+	index, data, ok, err := l.wal.LoadSnapshot()
+	if err != nil {
+		logger.Panic(err)
+	}
+	if ok {
+		if err := l.kvStore.Restore(data); err != nil {
+			logger.Panic(err)
+		}
+		l.lastIncludedIndex = index
+		l.snapshot = &Snapshot{LastIncludedIndex: index, Data: data}
+	}
+	err = l.wal.Replay(func(record *Record) {
+		switch record.Type {
+		case InstanceRecord:
+			instance := &pb.Instance{}
+			if err := proto.Unmarshal(record.Data, instance); err != nil {
+				logger.Panic(err)
+			}
+			if instance.GetIndex() > l.trimmedIndex() {
+				Insert(l.log, instance)
+			}
+		case CommitRecord:
+			instance, ok := l.log[record.Index]
+			if ok && IsInProgress(instance) {
+				instance.State = pb.InstanceState_COMMITTED
+			}
+		case TrimRecord:
+			for index := range l.log {
+				if index <= record.Index {
+					delete(l.log, index)
+				}
+			}
+			l.globalLastExecuted = record.Index
+		case SnapshotRecord:
+			for index := range l.log {
+				if index <= record.Index {
+					delete(l.log, index)
+				}
+			}
+			if record.Index > l.lastIncludedIndex {
+				l.lastIncludedIndex = record.Index
+			}
+		}
+	})
+	if err != nil {
+		logger.Panic(err)
+	}
+
+	// the store is only durable as of the snapshot, so the committed instances
+	// after it are executed again.
+	l.lastExecuted = l.trimmedIndex()
+	l.lastIndex = l.lastExecuted
+	for index, instance := range l.log {
+		if index <= l.lastExecuted {
+			instance.State = pb.InstanceState_EXECUTED
+		}
+		if index > l.lastIndex {
+			l.lastIndex = index
+		}
+	}
+}
+
+func (l *Log) persist(sync bool, records ...*Record) {
+	if l.wal == nil {
+		return
+	}
+	if err := l.wal.Write(records...); err != nil {
+		logger.Panic(err)
+	}
+	if sync {
+		if err := l.wal.Sync(); err != nil {
+			logger.Panic(err)
+		}
+	}
+}
+
+func newInstanceRecord(instance *pb.Instance) *Record {
+	data, err := proto.Marshal(instance)
+	if err != nil {
+		logger.Panic(err)
+	}
+	return &Record{Type: InstanceRecord, Index: instance.GetIndex(), Data: data}
+}
+
 func (l *Log) LastExecuted() int64 {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -99,6 +248,30 @@ func (l *Log) GlobalLastExecuted() int64 {
 	return l.globalLastExecuted
 }
 
+func (l *Log) LastIncludedIndex() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.lastIncludedIndex
+}
+
+func (l *Log) SetSnapshotInterval(interval int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.snapshotInterval = interval
+}
+
+// SetWitness makes the log mark instances executed without applying them to
+// the store. Only reconfigurations are recorded, so that the peer set stays
+// current.
+func (l *Log) SetWitness(witness bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.witness = witness
+}
+
 func (l *Log) AdvanceLastIndex() int64 {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -126,8 +299,15 @@ func (l *Log) Stop() {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	l.running = false
+	for l.snapshotting {
+		l.cvSnapshot.Wait()
+	}
 	l.kvStore.Close()
+	if l.wal != nil {
+		l.wal.Close()
+	}
 	l.cvExecutable.Signal()
+	l.cvExecuted.Broadcast()
 }
 
 func (l *Log) IsExecutable() bool {
@@ -143,11 +323,16 @@ func (l *Log) Append(instance *pb.Instance) {
 	defer l.mu.Unlock()
 
 	i := instance.GetIndex()
-	if i <= l.globalLastExecuted {
+	if i <= l.trimmedIndex() {
 		return
 	}
 
-	if Insert(l.log, instance) {
+	previous := l.log[i]
+	inserted := Insert(l.log, instance)
+	if l.log[i] != previous {
+		l.persist(true, newInstanceRecord(instance))
+	}
+	if inserted {
 		if i > l.lastIndex {
 			l.lastIndex = i
 		}
@@ -155,6 +340,43 @@ func (l *Log) Append(instance *pb.Instance) {
 	}
 }
 
+// AppendCommitted adds instances that the leader executed and marks them
+// committed. An instance here may still be in progress under another ballot,
+// but any ballot that accepted it after it was chosen carries the same
+// command, so Insert keeps the chosen one either way.
+func (l *Log) AppendCommitted(instances []*pb.Instance) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	records := make([]*Record, 0, 2*len(instances))
+	for _, instance := range instances {
+		i := instance.GetIndex()
+		if i <= l.lastExecuted {
+			continue
+		}
+		instance.State = pb.InstanceState_INPROGRESS
+		previous := l.log[i]
+		Insert(l.log, instance)
+		if l.log[i] != previous {
+			records = append(records, newInstanceRecord(instance))
+		}
+		if IsInProgress(l.log[i]) {
+			l.log[i].State = pb.InstanceState_COMMITTED
+			records = append(records, &Record{Type: CommitRecord, Index: i})
+		}
+		if i > l.lastIndex {
+			l.lastIndex = i
+		}
+	}
+	if len(records) > 0 {
+		l.persist(true, records...)
+	}
+	l.cvCommittable.Broadcast()
+	if l.IsExecutable() {
+		l.cvExecutable.Signal()
+	}
+}
+
 func (l *Log) Commit(index int64) {
 	if index <= 0 {
 		logger.Panicf("Index %v < 0\n", index)
@@ -171,6 +393,7 @@ func (l *Log) Commit(index int64) {
 
 	if IsInProgress(instance) {
 		instance.State = pb.InstanceState_COMMITTED
+		l.persist(true, &Record{Type: CommitRecord, Index: index})
 	}
 	if l.IsExecutable() {
 		l.cvExecutable.Signal()
@@ -181,6 +404,9 @@ func (l *Log) Execute() (int64, *kvstore.KVResult) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	if len(l.batchResults) > 0 {
+		return l.nextBatchResult()
+	}
 	for l.running && !l.IsExecutable() {
 		l.cvExecutable.Wait()
 	}
@@ -193,52 +419,299 @@ func (l *Log) Execute() (int64, *kvstore.KVResult) {
 	if !ok {
 		logger.Panicf("Instance at Index %v empty\n", l.lastExecuted+1)
 	}
-	result := kvstore.Execute(instance.GetCommand(), l.kvStore)
+	command := instance.GetCommand()
+	var result kvstore.KVResult
+	if l.witness {
+		if IsReconfiguration(command) {
+			l.kvStore.Put(kvstore.MembershipKey, command.GetValue())
+			l.applyMembership()
+		} else if command.GetType() == pb.CommandType_SET_SHARDS ||
+			command.GetType() == pb.CommandType_RESHARD {
+			result = l.execute(command)
+		}
+	} else if command.GetType() == pb.CommandType_BATCH {
+		// each command of a batch is answered separately, so queue the
+		// results and hand them out one per call.
+		for i, c := range command.GetCommands() {
+			r := l.execute(c)
+			l.batchResults = append(l.batchResults,
+				batchResult{command.GetClientIds()[i], &r})
+		}
+	} else {
+		result = l.execute(command)
+		if IsReconfiguration(command) {
+			l.applyMembership()
+		}
+	}
 	instance.State = pb.InstanceState_EXECUTED
+	clientId := instance.GetClientId()
 	l.lastExecuted += 1
-	return instance.ClientId, &result
+	l.cvExecuted.Broadcast()
+	// a witness has no store to send a peer that needs the instances it
+	// dropped, so it only trims what every peer executed.
+	if !l.witness && l.snapshotInterval > 0 &&
+		l.lastExecuted-l.lastIncludedIndex >= l.snapshotInterval {
+		l.takeSnapshot()
+	}
+	if len(l.batchResults) > 0 {
+		return l.nextBatchResult()
+	}
+	return clientId, &result
+}
+
+func (l *Log) nextBatchResult() (int64, *kvstore.KVResult) {
+	r := l.batchResults[0]
+	l.batchResults = l.batchResults[1:]
+	return r.clientId, r.result
+}
+
+// WaitExecuted blocks until every instance up to index has been executed and
+// returns false if the log is stopped first.
+func (l *Log) WaitExecuted(index int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.running && l.lastExecuted < index {
+		l.cvExecuted.Wait()
+	}
+	return l.running
+}
+
+// Read executes a command against the store without going through the log.
+func (l *Log) Read(command *pb.Command) kvstore.KVResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.execute(command)
+}
+
+// SetMembershipHandler registers handler to be called, with the log locked,
+// whenever executing a reconfiguration or installing a snapshot changes the
+// peer set recorded in the store.
+func (l *Log) SetMembershipHandler(handler func(map[int64]string)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.membershipHandler = handler
+}
+
+// Membership returns the peer set recorded in the store, or nil if the log has
+// not executed a reconfiguration yet.
+func (l *Log) Membership() map[int64]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.loadMembership()
 }
 
-func (l *Log) CommitUntil(leaderLastExecuted int64, ballot int64) {
+func (l *Log) applyMembership() {
+	if l.membershipHandler == nil {
+		return
+	}
+	if members := l.loadMembership(); members != nil {
+		l.membershipHandler(members)
+	}
+}
+
+// loadMembership returns the peer set recorded in the store. A peer set that
+// cannot be decoded is logged and ignored, so the peers in use are kept.
+func (l *Log) loadMembership() map[int64]string {
+	members, err := kvstore.LoadMembership(l.kvStore)
+	if err != nil {
+		logger.Errorf("bad peer set in store: %v", err)
+		return nil
+	}
+	return members
+}
+
+func (l *Log) CommitUntil(leaderLastExecuted int64, ballot *pb.Ballot) {
 	if leaderLastExecuted < 0 {
 		logger.Panic("invalid leader_last_executed in commit_until")
 	}
-	if ballot < 0 {
+	if ballot.GetRound() < 0 {
 		logger.Panic("invalid ballot in commit_until")
 	}
 
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	records := make([]*Record, 0)
 	for i := l.lastExecuted + 1; i <= leaderLastExecuted; i++ {
 		instance, ok := l.log[i]
 		if !ok {
 			break
 		}
-		if ballot < instance.GetBallot() {
+		if ballot.Less(instance.GetBallot()) {
 			panic("CommitUntil case 2")
 		}
-		if instance.GetBallot() == ballot {
+		if instance.GetBallot().Equal(ballot) && IsInProgress(instance) {
 			instance.State = pb.InstanceState_COMMITTED
+			records = append(records, &Record{Type: CommitRecord, Index: i})
 		}
 	}
+	if len(records) > 0 {
+		l.persist(true, records...)
+	}
 	if l.IsExecutable() {
 		l.cvExecutable.Signal()
 	}
 }
 
+// TrimUntil drops the instances every peer executed. A log that takes
+// snapshots keeps those after its latest one, since a peer that falls behind
+// it has to be sent the snapshot and then the instances after it. The WAL
+// keeps them until a snapshot covers them, since they are executed again
+// after a crash.
 func (l *Log) TrimUntil(leaderGlobalLastExecuted int64) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	if !l.witness && l.snapshotInterval > 0 &&
+		leaderGlobalLastExecuted > l.lastIncludedIndex {
+		leaderGlobalLastExecuted = l.lastIncludedIndex
+	}
+	if leaderGlobalLastExecuted > l.lastExecuted {
+		leaderGlobalLastExecuted = l.lastExecuted
+	}
+
+	if l.globalLastExecuted >= leaderGlobalLastExecuted {
+		return
+	}
 	for l.globalLastExecuted < leaderGlobalLastExecuted {
 		l.globalLastExecuted += 1
+		if l.globalLastExecuted <= l.lastIncludedIndex {
+			continue
+		}
 		instance, ok := l.log[l.globalLastExecuted]
 		if !ok || !IsExecuted(instance) {
 			logger.Panicln("TrimUntil case 1")
 		}
 		delete(l.log, l.globalLastExecuted)
 	}
+	// a witness takes no snapshots of its own, so it saves its store when it
+	// trims instead, to drop them from the WAL. Its store only holds the peer
+	// set and the shard maps, which the instances after are safe to set again.
+	if l.witness && l.wal != nil && l.snapshotInterval > 0 &&
+		l.globalLastExecuted-l.lastIncludedIndex >= l.snapshotInterval {
+		l.saveSnapshot(&Snapshot{LastIncludedIndex: l.globalLastExecuted})
+		l.truncate(l.globalLastExecuted)
+	}
+}
+
+// Snapshot returns the latest snapshot of the store, or nil if none was taken
+// or installed yet.
+func (l *Log) Snapshot() *Snapshot {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.snapshot
+}
+
+// takeSnapshot saves a snapshot of the store as of the last executed instance
+// and truncates the log up to it. Only the view of the store is taken with the
+// log locked; it is serialized and saved with the log unlocked.
+func (l *Log) takeSnapshot() {
+	index := l.lastExecuted
+	view := l.kvStore.View()
+	l.snapshotting = true
+	l.mu.Unlock()
+	data, err := view()
+	if err == nil && l.wal != nil {
+		err = l.wal.SaveSnapshot(index, data)
+	}
+	l.mu.Lock()
+	l.snapshotting = false
+	l.cvSnapshot.Broadcast()
+	if err != nil {
+		logger.Panic(err)
+	}
+	if index > l.lastIncludedIndex {
+		l.snapshot = &Snapshot{LastIncludedIndex: index, Data: data}
+		l.truncate(index)
+	}
+}
+
+// InstallSnapshot replaces the store with a snapshot received from the leader
+// and drops every instance the snapshot covers. Snapshots that are not ahead
+// of the executed prefix are ignored.
+func (l *Log) InstallSnapshot(snapshot *Snapshot) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if snapshot.LastIncludedIndex <= l.lastExecuted {
+		return false
+	}
+	if err := l.restore(snapshot.Data); err != nil {
+		logger.Panic(err)
+	}
+	l.lastExecuted = snapshot.LastIncludedIndex
+	if l.lastIndex < l.lastExecuted {
+		l.lastIndex = l.lastExecuted
+	}
+	if !l.witness {
+		l.snapshot = snapshot
+	}
+	l.saveSnapshot(snapshot)
+	l.truncate(snapshot.LastIncludedIndex)
+	l.applyMembership()
+	l.loadShards()
+	l.cvExecuted.Broadcast()
+	if l.IsExecutable() {
+		l.cvExecutable.Signal()
+	}
+	return true
+}
+
+// saveSnapshot makes an installed snapshot durable. A witness saves its own
+// store, which holds only what it kept of the snapshot.
+func (l *Log) saveSnapshot(snapshot *Snapshot) {
+	if l.wal == nil {
+		return
+	}
+	data := snapshot.Data
+	if l.witness {
+		var err error
+		if data, err = l.kvStore.Snapshot(); err != nil {
+			logger.Panic(err)
+		}
+	}
+	if err := l.wal.SaveSnapshot(snapshot.LastIncludedIndex, data); err != nil {
+		logger.Panic(err)
+	}
+}
+
+// restore replaces the store with a snapshot of another store. A witness keeps
+// only the peer set and the shard maps.
+func (l *Log) restore(data []byte) error {
+	if !l.witness {
+		return l.kvStore.Restore(data)
+	}
+	store := kvstore.NewMemKVStore()
+	if err := store.Restore(data); err != nil {
+		return err
+	}
+	for _, key := range []string{kvstore.MembershipKey, kvstore.ShardsKey,
+		kvstore.DirectoryKey} {
+		if value := store.Get(key); value != nil {
+			l.kvStore.Put(key, *value)
+		}
+	}
+	return nil
+}
+
+func (l *Log) truncate(index int64) {
+	for i := l.trimmedIndex() + 1; i <= index; i++ {
+		delete(l.log, i)
+	}
+	l.lastIncludedIndex = index
+	l.persist(true, &Record{Type: SnapshotRecord, Index: index})
+	if l.wal != nil {
+		if err := l.wal.Truncate(index); err != nil {
+			logger.Panic(err)
+		}
+	}
+}
+
+func (l *Log) trimmedIndex() int64 {
+	if l.lastIncludedIndex > l.globalLastExecuted {
+		return l.lastIncludedIndex
+	}
+	return l.globalLastExecuted
 }
 
 func (l *Log) Instances() []*pb.Instance {
@@ -246,7 +719,7 @@ func (l *Log) Instances() []*pb.Instance {
 	defer l.mu.Unlock()
 
 	instances := make([]*pb.Instance, 0, len(l.log))
-	for i := l.globalLastExecuted + 1; i <= l.lastIndex; i++ {
+	for i := l.trimmedIndex() + 1; i <= l.lastIndex; i++ {
 		instance := proto.Clone(l.log[i]).(*pb.Instance)
 		if instance != nil {
 			instances = append(instances, instance)
@@ -255,6 +728,26 @@ func (l *Log) Instances() []*pb.Instance {
 	return instances
 }
 
+// Executed returns copies of the executed instances from index from through
+// to, stopping at the first one that was trimmed.
+func (l *Log) Executed(from int64, to int64) []*pb.Instance {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if to > l.lastExecuted {
+		to = l.lastExecuted
+	}
+	instances := make([]*pb.Instance, 0)
+	for index := from; index <= to; index++ {
+		i, ok := l.log[index]
+		if !ok {
+			break
+		}
+		instances = append(instances, proto.Clone(i).(*pb.Instance))
+	}
+	return instances
+}
+
 func (l *Log) At(index int64) *pb.Instance {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -0,0 +1,72 @@
+package multipaxos
+
+import (
+	"encoding/binary"
+	"errors"
+	pb "github.com/sosp23/replicated-store/go/multipaxos/comm"
+	"os"
+	"path/filepath"
+)
+
+// BallotStore keeps the highest ballot promised by this peer on stable
+// storage. The file is replaced atomically, so a crash in the middle of Store
+// leaves either the old or the new ballot behind.
+type BallotStore struct {
+	path string
+}
+
+func NewBallotStore(path string) *BallotStore {
+	return &BallotStore{path: path}
+}
+
+func (s *BallotStore) Load() (*pb.Ballot, bool, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if len(data) != 16 {
+		return nil, false, errors.New("ballot store: corrupt ballot file")
+	}
+	return &pb.Ballot{
+		Round: int64(binary.LittleEndian.Uint64(data)),
+		Id:    int64(binary.LittleEndian.Uint64(data[8:])),
+	}, true, nil
+}
+
+func (s *BallotStore) Store(ballot *pb.Ballot) error {
+	data := make([]byte, 16)
+	binary.LittleEndian.PutUint64(data, uint64(ballot.GetRound()))
+	binary.LittleEndian.PutUint64(data[8:], uint64(ballot.GetId()))
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(s.path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,104 @@
+package multipaxos
+
+import (
+	"context"
+	logger "github.com/sirupsen/logrus"
+	pb "github.com/sosp23/replicated-store/go/multipaxos/comm"
+	"time"
+)
+
+// A follower only commits instances it has, so one that missed an accept stops
+// executing at the gap. The leader watches the last executed index in commit
+// and heartbeat responses, and when a follower that lags made no progress
+// since its previous response, sends it the instances the leader executed from
+// there on, or a snapshot if they were trimmed. Catch-up sends catchUpBatchSize instances at a
+// time and waits catchUpInterval between batches, as snapshots do between
+// chunks, so that it does not crowd out the phases in flight.
+
+// catchUpIfBehind starts bringing peer up to date if it reported executing
+// only as far as lastExecuted.
+func (p *Multipaxos) catchUpIfBehind(peer *RpcPeer, ballot *pb.Ballot,
+	lastExecuted int64) {
+	if lastExecuted < p.log.LastIncludedIndex() {
+		go p.sendSnapshot(peer, ballot)
+	} else if p.stalled(peer.Id, lastExecuted) {
+		go p.catchUp(peer, ballot, lastExecuted)
+	}
+}
+
+// stalled reports whether peer id lags behind this leader and executed nothing
+// since its previous response. A follower that is merely slower keeps moving,
+// so it is left alone.
+func (p *Multipaxos) stalled(id int64, lastExecuted int64) bool {
+	previous, ok := p.reportedExecuted.Load(id)
+	p.reportedExecuted.Store(id, lastExecuted)
+	return ok && previous.(int64) == lastExecuted &&
+		lastExecuted < p.log.LastExecuted()
+}
+
+func (p *Multipaxos) sleepForCatchUpInterval() {
+	time.Sleep(time.Duration(p.catchUpInterval) * time.Millisecond)
+}
+
+// catchUp sends peer the instances after lastExecuted up to what this leader
+// has executed now.
+func (p *Multipaxos) catchUp(peer *RpcPeer, ballot *pb.Ballot,
+	lastExecuted int64) {
+	if _, inFlight := p.catchUpInFlight.LoadOrStore(peer.Id,
+		struct{}{}); inFlight {
+		return
+	}
+	defer p.catchUpInFlight.Delete(peer.Id)
+
+	target := p.log.LastExecuted()
+	for next := lastExecuted + 1; next <= target && p.Ballot().Equal(ballot); {
+		instances := p.log.Executed(next, next+p.catchUpBatchSize-1)
+		if len(instances) == 0 {
+			// trimmed since, so only a snapshot brings peer up to date.
+			p.sendSnapshot(peer, ballot)
+			return
+		}
+		request := pb.CatchUpRequest{
+			Ballot:    ballot,
+			Instances: instances,
+			Sender:    p.id,
+		}
+		logger.Infof("%v sent catch up request for %v instances to %v", p.id,
+			len(instances), peer.Id)
+		var response *pb.CatchUpResponse
+		err := p.call(p.rpcRetries, p.rpcTimeout,
+			func(ctx context.Context) (err error) {
+				response, err = peer.Stub.CatchUp(ctx, &request)
+				return err
+			})
+		if err != nil {
+			return
+		}
+		if response.GetType() != pb.ResponseType_OK {
+			p.BecomeFollower(response.GetBallot())
+			return
+		}
+		next = instances[len(instances)-1].GetIndex() + 1
+		p.sleepForCatchUpInterval()
+	}
+}
+
+// CatchUp adds the instances a leader sent to bring this peer up to date.
+func (p *Multipaxos) CatchUp(ctx context.Context,
+	request *pb.CatchUpRequest) (*pb.CatchUpResponse, error) {
+	logger.Infof("%v <--catchup-- %v", p.id, request.GetSender())
+	response := &pb.CatchUpResponse{}
+	if request.GetBallot().Less(p.Ballot()) {
+		response.Type = pb.ResponseType_REJECT
+		response.Ballot = p.Ballot()
+		return response, nil
+	}
+	p.heardFromLeader()
+	if p.Ballot().Less(request.GetBallot()) {
+		p.BecomeFollower(request.GetBallot())
+	}
+	p.log.AppendCommitted(request.GetInstances())
+	response.Type = pb.ResponseType_OK
+	response.Ballot = p.Ballot()
+	return response, nil
+}
@@ -0,0 +1,52 @@
+package multipaxos
+
+import (
+	logger "github.com/sirupsen/logrus"
+	pb "github.com/sosp23/replicated-store/go/multipaxos/comm"
+	"sync/atomic"
+	"time"
+)
+
+// A leader cut off from its peers cannot commit anything, yet it keeps its
+// ballot and keeps taking requests until a higher ballot reaches it. So the
+// leader notes when each peer last acknowledged a commit or heartbeat, and
+// gives up leadership once fewer than an accept quorum, counting itself, did
+// so within the minimum election timeout. By then the others may have elected
+// a new leader, and clients retrying here are sent on.
+
+func (p *Multipaxos) heardFromPeer(id int64) {
+	p.peerContact.Store(id, time.Now().UnixNano())
+}
+
+// quorumActive reports whether an accept quorum acknowledged this leader within
+// the minimum election timeout. Every peer counts as having done so when the
+// leader took over.
+func (p *Multipaxos) quorumActive() bool {
+	timeout := time.Duration(p.electionTimeoutMin) * time.Millisecond
+	since := time.Now().Add(-timeout).UnixNano()
+	if atomic.LoadInt64(&p.leaderSince) > since {
+		return true
+	}
+	peers := p.currentPeers()
+	numActive := 0
+	for _, peer := range peers {
+		if peer.Id == p.id {
+			numActive += 1
+		} else if contact, ok := p.peerContact.Load(peer.Id); ok &&
+			contact.(int64) > since {
+			numActive += 1
+		}
+	}
+	return numActive >= p.acceptQuorumOf(len(peers))
+}
+
+// checkQuorum gives up leadership at ballot, reporting false, if the quorum
+// this leader needs has gone quiet.
+func (p *Multipaxos) checkQuorum(ballot *pb.Ballot) bool {
+	if p.quorumActive() {
+		return true
+	}
+	logger.Infof("%v lost contact with a quorum", p.id)
+	p.resign(ballot)
+	return false
+}
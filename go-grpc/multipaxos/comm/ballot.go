@@ -0,0 +1,28 @@
+package comm
+
+// A ballot orders proposals by round, then by the id of the peer that proposed
+// it. A ballot whose id is NoLeader stands for a round that no peer leads.
+
+const NoLeader int64 = -1
+
+// Less reports whether b orders before other. A nil ballot is round 0 with no
+// leader, not round 0 led by peer 0.
+func (b *Ballot) Less(other *Ballot) bool {
+	return b.round() < other.round() ||
+		b.round() == other.round() && b.id() < other.id()
+}
+
+func (b *Ballot) Equal(other *Ballot) bool {
+	return b.round() == other.round() && b.id() == other.id()
+}
+
+func (b *Ballot) round() int64 {
+	return b.GetRound()
+}
+
+func (b *Ballot) id() int64 {
+	if b == nil {
+		return NoLeader
+	}
+	return b.GetId()
+}
@@ -0,0 +1,92 @@
+package multipaxos
+
+import (
+	"context"
+	logger "github.com/sirupsen/logrus"
+	"github.com/sosp23/replicated-store/go/config"
+	"github.com/sosp23/replicated-store/go/kvstore"
+	pb "github.com/sosp23/replicated-store/go/multipaxos/comm"
+)
+
+// Learners get every accept and commit the leader sends, but never count
+// toward a quorum and never run for leader. Each executes the log into its own
+// store and answers gets from it, so a read from a learner may lag behind the
+// leader. Learners are listed in the config apart from the voting peers and
+// take the ids that follow theirs. They do not hold back trimming, so one that
+// joins late or falls behind catches up from a snapshot, which is why the
+// config needs a snapshot interval with learners.
+
+func (p *Multipaxos) makeLearners(config config.Config) []*RpcPeer {
+	learners := make([]*RpcPeer, 0, len(config.Learners))
+	for i, addr := range config.Learners {
+		id := int64(len(config.Peers) + i)
+		if id == p.id {
+			continue
+		}
+		learners = append(learners, p.mux.dial(p, id, addr))
+	}
+	return learners
+}
+
+func (p *Multipaxos) IsLearner() bool {
+	return p.learner
+}
+
+// LearnerRead serves a get from the local store of a learner.
+func (p *Multipaxos) LearnerRead(command *pb.Command) (kvstore.KVResult,
+	bool) {
+	if command.GetType() != pb.CommandType_GET || !p.learner {
+		return kvstore.KVResult{}, false
+	}
+	return p.log.Read(command), true
+}
+
+func (p *Multipaxos) sendAcceptToLearners(request *pb.AcceptRequest) {
+	for _, learner := range p.learners {
+		go func(learner *RpcPeer) {
+			logger.Infof("%v sent accept request to learner %v", p.id,
+				learner.Id)
+			p.call(0, p.rpcTimeout, func(ctx context.Context) error {
+				_, err := learner.Stub.Accept(ctx, request)
+				return err
+			})
+		}(learner)
+	}
+}
+
+// sendCommitToLearners sends a commit to every learner and catches up any that
+// fell behind. Learners do not hold back trimming.
+func (p *Multipaxos) sendCommitToLearners(request *pb.CommitRequest,
+	ballot *pb.Ballot) {
+	for _, learner := range p.learners {
+		go func(learner *RpcPeer) {
+			logger.Infof("%v sent commit request to learner %v", p.id,
+				learner.Id)
+			var response *pb.CommitResponse
+			err := p.call(0, p.rpcTimeout,
+				func(ctx context.Context) (err error) {
+					response, err = learner.Stub.Commit(ctx, request)
+					return err
+				})
+			if err != nil {
+				return
+			}
+			if response.GetType() != pb.ResponseType_OK {
+				p.BecomeFollower(response.GetBallot())
+				return
+			}
+			p.catchUpIfBehind(learner, ballot, response.GetLastExecuted())
+		}(learner)
+	}
+}
+
+// trimIndex returns how far to trim given the leader's global last executed.
+// That index only counts voting peers, so a learner may not have executed as
+// far yet.
+func (p *Multipaxos) trimIndex(globalLastExecuted int64) int64 {
+	if lastExecuted := p.log.LastExecuted(); p.learner &&
+		lastExecuted < globalLastExecuted {
+		return lastExecuted
+	}
+	return globalLastExecuted
+}
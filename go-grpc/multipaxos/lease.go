@@ -0,0 +1,85 @@
+package multipaxos
+
+import (
+	"github.com/sosp23/replicated-store/go/kvstore"
+	pb "github.com/sosp23/replicated-store/go/multipaxos/comm"
+	"sync/atomic"
+	"time"
+)
+
+// A leader holds a read lease for leaseDuration, less the clock drift bound,
+// from the moment it sent a commit or heartbeat that a quorum acknowledged.
+// Each follower that acknowledged it promises not to start or join an election
+// for another peer until leaseDuration has passed on its own clock.
+
+func (p *Multipaxos) extendLease(ballot *pb.Ballot, start time.Time) {
+	if p.leaseDuration <= 0 {
+		return
+	}
+	expiry := start.Add(time.Duration(p.leaseDuration-p.clockDrift) *
+		time.Millisecond)
+	p.leaseMu.Lock()
+	defer p.leaseMu.Unlock()
+	// a transfer marks itself before it drops the lease with leaseMu held, so
+	// checking here keeps a round already running from extending it again.
+	if atomic.LoadInt32(&p.transferring) == 1 {
+		return
+	}
+	if !ballot.Equal(p.leaseBallot) || expiry.After(p.leaseExpiry) {
+		p.leaseBallot = ballot
+		p.leaseExpiry = expiry
+	}
+}
+
+func (p *Multipaxos) grantLease(ballot *pb.Ballot) {
+	if p.leaseDuration <= 0 {
+		return
+	}
+	p.leaseMu.Lock()
+	defer p.leaseMu.Unlock()
+	if !ballot.Less(p.grantBallot) {
+		p.grantBallot = ballot
+		p.grantExpiry = time.Now().Add(time.Duration(p.leaseDuration) *
+			time.Millisecond)
+	}
+}
+
+// leaseGranted reports whether this peer granted a lease that is still live
+// to a leader other than id.
+func (p *Multipaxos) leaseGranted(id int64) bool {
+	if p.leaseDuration <= 0 {
+		return false
+	}
+	p.leaseMu.Lock()
+	defer p.leaseMu.Unlock()
+	return ExtractLeaderId(p.grantBallot) != id &&
+		time.Now().Before(p.grantExpiry)
+}
+
+// HasLease reports whether this peer is the leader, holds a live lease and has
+// executed everything committed before it became leader.
+func (p *Multipaxos) HasLease() bool {
+	if p.leaseDuration <= 0 {
+		return false
+	}
+	ballot := p.Ballot()
+	if !IsLeader(ballot, p.id) {
+		return false
+	}
+	p.leaseMu.Lock()
+	defer p.leaseMu.Unlock()
+	if atomic.LoadInt32(&p.transferring) == 1 {
+		return false
+	}
+	return p.leaseBallot.Equal(ballot) && time.Now().Before(p.leaseExpiry) &&
+		p.log.LastExecuted() >= p.termStartIndex
+}
+
+// LeaseRead serves a get from the local store if this peer holds a lease; ok
+// is false if the command has to go through the log instead.
+func (p *Multipaxos) LeaseRead(command *pb.Command) (kvstore.KVResult, bool) {
+	if command.GetType() != pb.CommandType_GET || !p.HasLease() {
+		return kvstore.KVResult{}, false
+	}
+	return p.log.Read(command), true
+}
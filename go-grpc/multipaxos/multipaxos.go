@@ -2,72 +2,220 @@ package multipaxos
 
 import (
 	"context"
+	logger "github.com/sirupsen/logrus"
 	"github.com/sosp23/replicated-store/go/config"
 	Log "github.com/sosp23/replicated-store/go/log"
 	pb "github.com/sosp23/replicated-store/go/multipaxos/comm"
-	logger "github.com/sirupsen/logrus"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"io"
 	"math/rand"
-	"net"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type Multipaxos struct {
-	ballot         int64
-	log            *Log.Log
-	id             int64
-	commitReceived int32
-	commitInterval int64
-	port           string
-	rpcPeers       []*RpcPeer
-	mu             sync.Mutex
+	ballot             atomic.Value
+	ballotStore        *BallotStore
+	log                *Log.Log
+	id                 int64
+	heartbeatReceived  int32
+	lastContact        int64
+	leaderSince        int64
+	peerContact        sync.Map
+	commitInterval     int64
+	heartbeatInterval  int64
+	electionTimeoutMin int64
+	electionTimeoutMax int64
+	replayWindow       int64
+	batchSize          int64
+	batchDelay         int64
+	port               string
+	rpcPeers           []*RpcPeer
+	learners           []*RpcPeer
+	learner            bool
+	witness            bool
+	witnesses          []int64
+	priorities         []int64
+	behindSnapshot     int64
+	members            map[int64]string
+	peersMu            sync.RWMutex
+	reconfigMu         sync.Mutex
+	reconfigIndex      int64
+	group              int64
+	mux                *Mux
+	mu                 sync.Mutex
+
+	batchMu  sync.Mutex
+	batch    []*batchEntry
+	batchSeq int64
+
+	windowMu        sync.Mutex
+	windowCv        *sync.Cond
+	windowSize      int64
+	windowCommitted int64
+	windowDone      map[int64]bool
+
+	leaseDuration  int64
+	clockDrift     int64
+	readMode       string
+	leaseMu        sync.Mutex
+	leaseBallot    *pb.Ballot
+	leaseExpiry    time.Time
+	termStartIndex int64
+	grantBallot    *pb.Ballot
+	grantExpiry    time.Time
+
+	snapshotInFlight sync.Map
+
+	catchUpBatchSize int64
+	catchUpInterval  int64
+	catchUpInFlight  sync.Map
+	reportedExecuted sync.Map
 
 	cvLeader   *sync.Cond
 	cvFollower *sync.Cond
 
-	rpcServer          *grpc.Server
 	rpcServerRunning   bool
 	rpcServerRunningCv *sync.Cond
 
-	prepareThreadRunning int32
-	commitThreadRunning  int32
+	rpcTimeout int64
+	rpcRetries int64
+	rpcBackoff int64
+
+	prepareQuorum int64
+	acceptQuorum  int64
+
+	transferring int32
+	electNow     chan *pb.Ballot
+
+	prepareThreadRunning   int32
+	commitThreadRunning    int32
+	heartbeatThreadRunning int32
 
 	pb.UnimplementedMultiPaxosRPCServer
 }
 
 func NewMultipaxos(log *Log.Log, config config.Config) *Multipaxos {
+	return NewGroupMultipaxos(log, config, 0, NewMux())
+}
+
+// NewGroupMultipaxos returns consensus group group of this peer, which talks
+// to the other peers through mux.
+func NewGroupMultipaxos(log *Log.Log, config config.Config, group int64,
+	mux *Mux) *Multipaxos {
 	multipaxos := Multipaxos{
-		ballot:               MaxNumPeers,
 		log:                  log,
 		id:                   config.Id,
-		commitReceived:       0,
+		group:                group,
+		mux:                  mux,
+		heartbeatReceived:    0,
 		commitInterval:       config.CommitInterval,
-		port:                 config.Peers[config.Id],
-		rpcPeers:             make([]*RpcPeer, len(config.Peers)),
+		heartbeatInterval:    config.HeartbeatInterval,
+		electionTimeoutMin:   config.ElectionTimeoutMin,
+		electionTimeoutMax:   config.ElectionTimeoutMax,
+		replayWindow:         config.ReplayWindow,
+		batchSize:            config.BatchSize,
+		batchDelay:           config.BatchDelay,
+		windowSize:           config.AcceptWindow,
+		windowDone:           make(map[int64]bool),
+		leaseDuration:        config.LeaseDuration,
+		clockDrift:           config.ClockDrift,
+		readMode:             config.ReadMode,
+		rpcTimeout:           config.RpcTimeout,
+		rpcRetries:           config.RpcRetries,
+		rpcBackoff:           config.RpcBackoff,
+		prepareQuorum:        config.PrepareQuorum,
+		acceptQuorum:         config.AcceptQuorum,
+		catchUpBatchSize:     config.CatchUpBatchSize,
+		catchUpInterval:      config.CatchUpInterval,
+		port:                 config.Addr(config.Id),
+		learner:              config.IsLearner(),
+		witness:              config.IsWitness(config.Id),
+		witnesses:            config.Witnesses,
+		priorities:           config.Priorities,
 		rpcServerRunning:     false,
+		electNow:             make(chan *pb.Ballot, 1),
 		prepareThreadRunning: 0,
 		commitThreadRunning:  0,
-		rpcServer:            nil,
 	}
 	multipaxos.rpcServerRunningCv = sync.NewCond(&multipaxos.mu)
 	multipaxos.cvFollower = sync.NewCond(&multipaxos.mu)
 	multipaxos.cvLeader = sync.NewCond(&multipaxos.mu)
 	rand.Seed(multipaxos.id)
+	multipaxos.windowCv = sync.NewCond(&multipaxos.windowMu)
+	if multipaxos.replayWindow <= 0 {
+		multipaxos.replayWindow = DefaultReplayWindow
+	}
+	if multipaxos.windowSize <= 0 {
+		multipaxos.windowSize = DefaultAcceptWindow
+	}
+	if multipaxos.heartbeatInterval <= 0 {
+		multipaxos.heartbeatInterval = DefaultHeartbeatInterval
+	}
+	if multipaxos.electionTimeoutMin <= 0 {
+		multipaxos.electionTimeoutMin = DefaultElectionTimeoutMin
+	}
+	if multipaxos.electionTimeoutMax <= 0 {
+		multipaxos.electionTimeoutMax = 2 * multipaxos.electionTimeoutMin
+	}
+	if multipaxos.electionTimeoutMin <= multipaxos.heartbeatInterval ||
+		multipaxos.electionTimeoutMax < multipaxos.electionTimeoutMin {
+		logger.Panic("election timeouts have to exceed the heartbeat interval")
+	}
+	if multipaxos.rpcTimeout <= 0 {
+		multipaxos.rpcTimeout = DefaultRpcTimeout
+	}
+	if multipaxos.rpcBackoff <= 0 {
+		multipaxos.rpcBackoff = DefaultRpcBackoff
+	}
+	if multipaxos.catchUpBatchSize <= 0 {
+		multipaxos.catchUpBatchSize = DefaultCatchUpBatchSize
+	}
+	if multipaxos.catchUpInterval <= 0 {
+		multipaxos.catchUpInterval = DefaultCatchUpInterval
+	}
+	if multipaxos.readMode != "" && multipaxos.readMode != ReadModeLog &&
+		multipaxos.readMode != ReadModeLease &&
+		multipaxos.readMode != ReadModeReadIndex {
+		logger.Panic("no match read mode")
+	}
 
-	var opts []grpc.DialOption
-	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	for id, addr := range config.Peers {
-		conn, err := grpc.Dial(addr, opts...)
+	multipaxos.ballot.Store(&pb.Ballot{Id: pb.NoLeader})
+	if config.BallotPath != "" {
+		multipaxos.ballotStore = NewBallotStore(config.BallotPath)
+		ballot, ok, err := multipaxos.ballotStore.Load()
 		if err != nil {
-			panic("dial error")
+			logger.Panic(err)
+		}
+		if ok {
+			if IsLeader(ballot, multipaxos.id) {
+				// a restarted peer has to win a prepare phase again before it
+				// can lead, so give up the leadership without going below
+				// the ballot it promised.
+				ballot = &pb.Ballot{Round: ballot.GetRound() + 1,
+					Id: pb.NoLeader}
+			}
+			multipaxos.ballot.Store(ballot)
 		}
-		client := pb.NewMultiPaxosRPCClient(conn)
-		multipaxos.rpcPeers[id] = NewRpcPeer(int64(id), client)
 	}
 
+	members := log.Membership()
+	if members == nil {
+		members = membersFromConfig(config.Peers)
+	}
+	if len(config.Peers)+len(config.Learners) > int(MaxNumPeers) {
+		logger.Panic("too many peers and learners")
+	}
+	multipaxos.learners = multipaxos.makeLearners(config)
+	if !multipaxos.validQuorums(len(members), len(members)) {
+		logger.Panic("prepare and accept quorums have to add up to more than " +
+			"the number of peers")
+	}
+	multipaxos.applyMembership(members)
+	log.SetMembershipHandler(multipaxos.applyMembership)
+	mux.add(&multipaxos)
+
 	return &multipaxos
 }
 
@@ -75,86 +223,124 @@ func (p *Multipaxos) Id() int64 {
 	return p.id
 }
 
-func (p *Multipaxos) Ballot() int64 {
-	return atomic.LoadInt64(&p.ballot)
+func (p *Multipaxos) Group() int64 {
+	return p.group
+}
+
+func (p *Multipaxos) Ballot() *pb.Ballot {
+	return p.ballot.Load().(*pb.Ballot)
 }
 
-func (p *Multipaxos) NextBallot() int64 {
-	nextBallot := p.Ballot()
-	nextBallot += RoundIncrement
-	nextBallot = (nextBallot & ^IdBits) | p.id
-	return nextBallot
+func (p *Multipaxos) NextBallot() *pb.Ballot {
+	return &pb.Ballot{Round: p.Ballot().GetRound() + 1, Id: p.id}
 }
 
-func (p *Multipaxos) BecomeLeader(newBallot int64, newLastIndex int64) {
+func (p *Multipaxos) BecomeLeader(newBallot *pb.Ballot, newLastIndex int64) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	logger.Infof("%v became a leader: ballot: %v -> %v\n", p.id, p.Ballot(),
 		newBallot)
 	p.log.SetLastIndex(newLastIndex)
-	atomic.StoreInt64(&p.ballot, newBallot)
-	p.cvLeader.Signal()
+	p.resetWindow(newLastIndex)
+	p.leaseMu.Lock()
+	p.termStartIndex = newLastIndex
+	p.leaseMu.Unlock()
+	atomic.StoreInt64(&p.leaderSince, time.Now().UnixNano())
+	p.setBallot(newBallot)
+	p.cvLeader.Broadcast()
 }
 
-func (p *Multipaxos) BecomeFollower(newBallot int64) {
+func (p *Multipaxos) BecomeFollower(newBallot *pb.Ballot) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	if newBallot <= p.Ballot() {
+	if !p.Ballot().Less(newBallot) {
 		return
 	}
 
 	oldLeaderId := ExtractLeaderId(p.Ballot())
 	newLeaderId := ExtractLeaderId(newBallot)
-	if newLeaderId != p.id && (oldLeaderId == p.id || oldLeaderId == MaxNumPeers) {
+	if newLeaderId != p.id && (oldLeaderId == p.id || oldLeaderId == pb.NoLeader) {
 		logger.Infof("%v became a follower: ballot: %v -> %v\n", p.id,
 			p.Ballot(), newBallot)
 		p.cvFollower.Signal()
 	}
-	atomic.StoreInt64(&p.ballot, newBallot)
+	p.setBallot(newBallot)
+	// wake proposers waiting on the accept window so they see the new ballot.
+	p.resetWindow(p.log.LastIndex())
+}
+
+func (p *Multipaxos) setBallot(ballot *pb.Ballot) {
+	if p.ballotStore != nil {
+		if err := p.ballotStore.Store(ballot); err != nil {
+			logger.Panic(err)
+		}
+	}
+	p.ballot.Store(ballot)
 }
 
 func (p *Multipaxos) sleepForCommitInterval() {
 	time.Sleep(time.Duration(p.commitInterval) * time.Millisecond)
 }
 
-func (p *Multipaxos) sleepForRandomInterval() {
-	sleepTime := p.commitInterval + p.commitInterval/2 +
-		rand.Int63n(p.commitInterval/2)
-	time.Sleep(time.Duration(sleepTime) * time.Millisecond)
+// sleepForRandomInterval returns early, reporting true, if the leader asked
+// this peer to take over. The sleep grows by the width of the election timeout
+// range for every replica that outranks this peer, so those run first.
+func (p *Multipaxos) sleepForRandomInterval() bool {
+	spread := p.electionTimeoutMax - p.electionTimeoutMin + 1
+	sleepTime := p.electionTimeoutMin + rand.Int63n(spread) +
+		p.outranked()*spread
+	timer := time.NewTimer(time.Duration(sleepTime) * time.Millisecond)
+	defer timer.Stop()
+	for {
+		select {
+		case ballot := <-p.electNow:
+			// a request from a transfer that the ballot moved past since is
+			// stale, and an election for it would ignore a live leader's lease.
+			if ballot.Equal(p.Ballot()) {
+				return true
+			}
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+func (p *Multipaxos) receivedHeartbeat() bool {
+	return atomic.CompareAndSwapInt32(&p.heartbeatReceived, 1, 0)
 }
 
-func (p *Multipaxos) receivedCommit() bool {
-	return atomic.CompareAndSwapInt32(&p.commitReceived, 1, 0)
+func (p *Multipaxos) heardFromLeader() {
+	atomic.StoreInt32(&p.heartbeatReceived, 1)
+	atomic.StoreInt64(&p.lastContact, time.Now().UnixNano())
 }
 
 func (p *Multipaxos) Start() {
-	p.StartPrepareThread()
+	if !p.learner {
+		p.StartPrepareThread()
+	}
 	p.StartCommitThread()
+	p.StartHeartbeatThread()
 	p.StartRPCServer()
 }
 
 func (p *Multipaxos) Stop() {
 	p.StopRPCServer()
-	p.StopPrepareThread()
+	if !p.learner {
+		p.StopPrepareThread()
+	}
 	p.StopCommitThread()
+	p.StopHeartbeatThread()
 }
 
 func (p *Multipaxos) StartRPCServer() {
 	logger.Infof("%v starting rpc server at %v", p.id, p.port)
-	listener, err := net.Listen("tcp", p.port)
-	if err != nil {
-		panic(err)
-	}
-	p.rpcServer = grpc.NewServer()
-	pb.RegisterMultiPaxosRPCServer(p.rpcServer, p)
+	p.mux.serve(p.group, p.port)
 
 	p.mu.Lock()
 	p.rpcServerRunning = true
 	p.rpcServerRunningCv.Signal()
 	p.mu.Unlock()
-
-	go p.rpcServer.Serve(listener)
 }
 
 func (p *Multipaxos) StopRPCServer() {
@@ -164,7 +350,7 @@ func (p *Multipaxos) StopRPCServer() {
 	}
 	logger.Infof("%v stopping rpc server at %v", p.id, p.port)
 	p.mu.Unlock()
-	p.rpcServer.GracefulStop()
+	p.mux.stopServing(p.group)
 }
 
 func (p *Multipaxos) StartPrepareThread() {
@@ -204,19 +390,167 @@ func (p *Multipaxos) StopCommitThread() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	atomic.StoreInt32(&p.commitThreadRunning, 0)
-	p.cvLeader.Signal()
+	p.cvLeader.Broadcast()
+}
+
+func (p *Multipaxos) StartHeartbeatThread() {
+	logger.Infof("%v starting heartbeat thread", p.id)
+	if p.heartbeatThreadRunning == 1 {
+		panic("heartbeatThreadRunning is true")
+	}
+	atomic.StoreInt32(&p.heartbeatThreadRunning, 1)
+	go p.HeartbeatThread()
+}
+
+func (p *Multipaxos) StopHeartbeatThread() {
+	logger.Infof("%v stopping heartbeat thread", p.id)
+	if p.heartbeatThreadRunning == 0 {
+		panic("heartbeatThreadRunning is false")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	atomic.StoreInt32(&p.heartbeatThreadRunning, 0)
+	p.cvLeader.Broadcast()
 }
 
 func (p *Multipaxos) Replicate(command *pb.Command, clientId int64) Result {
+	return <-p.ReplicateAsync(command, clientId)
+}
+
+// ReplicateAsync reserves a log index for command, blocking while the accept
+// window is full, and runs the accept phase in the background. The returned
+// channel yields the result once the phase finishes.
+func (p *Multipaxos) ReplicateAsync(command *pb.Command,
+	clientId int64) <-chan Result {
+	result := make(chan Result, 1)
 	ballot := p.Ballot()
 	if IsLeader(ballot, p.id) {
-		return p.RunAcceptPhase(ballot, p.log.AdvanceLastIndex(), command,
-			clientId)
+		if atomic.LoadInt32(&p.transferring) == 1 || p.witness {
+			// leadership is being handed off, or is about to be by a witness,
+			// so clients retry elsewhere.
+			result <- Result{Type: Retry, Leader: -1}
+			return result
+		}
+		if p.batchSize > 1 {
+			return p.replicateBatched(command, clientId)
+		}
+		p.propose(ballot, command, clientId, func(r Result) {
+			result <- r
+		})
+	} else if IsSomeoneElseLeader(ballot, p.id) {
+		result <- Result{Type: SomeElseLeader, Leader: ExtractLeaderId(ballot)}
+	} else {
+		result <- Result{Type: Retry, Leader: -1}
 	}
-	if IsSomeoneElseLeader(ballot, p.id) {
-		return Result{Type: SomeElseLeader, Leader: ExtractLeaderId(ballot)}
+	return result
+}
+
+func (p *Multipaxos) propose(ballot *pb.Ballot, command *pb.Command,
+	clientId int64, done func(Result)) {
+	index := p.log.AdvanceLastIndex()
+	p.acquireWindow(ballot, index)
+	go func() {
+		r := p.runAcceptPhaseUntilChosen(ballot, index, command, clientId)
+		p.releaseWindow(index)
+		done(r)
+	}()
+}
+
+// acquireWindow blocks until index is within windowSize of the highest index
+// below which every accept phase has finished, or until ballot is stale.
+func (p *Multipaxos) acquireWindow(ballot *pb.Ballot, index int64) {
+	p.windowMu.Lock()
+	defer p.windowMu.Unlock()
+	for index-p.windowCommitted > p.windowSize && p.Ballot().Equal(ballot) {
+		p.windowCv.Wait()
+	}
+}
+
+func (p *Multipaxos) releaseWindow(index int64) {
+	p.windowMu.Lock()
+	defer p.windowMu.Unlock()
+	if index <= p.windowCommitted {
+		return
+	}
+	p.windowDone[index] = true
+	for p.windowDone[p.windowCommitted+1] {
+		delete(p.windowDone, p.windowCommitted+1)
+		p.windowCommitted += 1
+	}
+	p.windowCv.Broadcast()
+}
+
+func (p *Multipaxos) resetWindow(lastIndex int64) {
+	p.windowMu.Lock()
+	defer p.windowMu.Unlock()
+	p.windowCommitted = lastIndex
+	p.windowDone = make(map[int64]bool)
+	p.windowCv.Broadcast()
+}
+
+func (p *Multipaxos) replicateBatched(command *pb.Command,
+	clientId int64) <-chan Result {
+	entry := &batchEntry{
+		command:  command,
+		clientId: clientId,
+		result:   make(chan Result, 1),
+	}
+
+	p.batchMu.Lock()
+	p.batch = append(p.batch, entry)
+	if int64(len(p.batch)) >= p.batchSize {
+		batch := p.batch
+		p.batch = nil
+		p.batchSeq += 1
+		p.batchMu.Unlock()
+		p.proposeBatch(batch)
+	} else {
+		if len(p.batch) == 1 {
+			seq := p.batchSeq
+			time.AfterFunc(time.Duration(p.batchDelay)*time.Millisecond,
+				func() { p.flushBatch(seq) })
+		}
+		p.batchMu.Unlock()
+	}
+	return entry.result
+}
+
+func (p *Multipaxos) flushBatch(seq int64) {
+	p.batchMu.Lock()
+	if seq != p.batchSeq || len(p.batch) == 0 {
+		p.batchMu.Unlock()
+		return
+	}
+	batch := p.batch
+	p.batch = nil
+	p.batchSeq += 1
+	p.batchMu.Unlock()
+	p.proposeBatch(batch)
+}
+
+func (p *Multipaxos) proposeBatch(batch []*batchEntry) {
+	command := batch[0].command
+	clientId := batch[0].clientId
+	if len(batch) > 1 {
+		command = &pb.Command{Type: pb.CommandType_BATCH}
+		clientId = NoopClientId
+		for _, entry := range batch {
+			command.Commands = append(command.Commands, entry.command)
+			command.ClientIds = append(command.ClientIds, entry.clientId)
+		}
+	}
+
+	done := func(r Result) {
+		for _, entry := range batch {
+			entry.result <- r
+		}
+	}
+	ballot := p.Ballot()
+	if IsLeader(ballot, p.id) {
+		p.propose(ballot, command, clientId, done)
+	} else {
+		done(Result{Type: Retry, Leader: -1})
 	}
-	return Result{Type: Retry, Leader: -1}
 }
 
 func (p *Multipaxos) PrepareThread() {
@@ -228,15 +562,22 @@ func (p *Multipaxos) PrepareThread() {
 		p.mu.Unlock()
 
 		for atomic.LoadInt32(&p.prepareThreadRunning) == 1 {
-			p.sleepForRandomInterval()
-			if p.receivedCommit() {
+			transfer := p.sleepForRandomInterval()
+			if (p.receivedHeartbeat() || p.leaseGranted(p.id)) && !transfer ||
+				!p.isMember(p.id) {
 				continue
 			}
 			nextBallot := p.NextBallot()
-			maxLastIndex, log := p.RunPreparePhase(nextBallot)
+			if !transfer && !p.runPreVotePhase(nextBallot) {
+				continue
+			}
+			maxLastIndex, log := p.runPreparePhase(nextBallot, transfer)
 			if log != nil {
 				p.BecomeLeader(nextBallot, maxLastIndex)
-				p.Replay(nextBallot, log)
+				p.Replay(nextBallot, maxLastIndex, log)
+				if p.witness {
+					go p.handOffFromWitness(nextBallot)
+				}
 				break
 			}
 		}
@@ -263,16 +604,53 @@ func (p *Multipaxos) CommitThread() {
 	}
 }
 
-func (p *Multipaxos) RunPreparePhase(ballot int64) (int64,
+// HeartbeatThread keeps followers from starting an election, and the lease
+// alive, with a heartbeat every heartbeatInterval while this peer leads.
+func (p *Multipaxos) HeartbeatThread() {
+	for atomic.LoadInt32(&p.heartbeatThreadRunning) == 1 {
+		p.mu.Lock()
+		for atomic.LoadInt32(&p.heartbeatThreadRunning) == 1 &&
+			!IsLeader(p.Ballot(), p.id) {
+			p.cvLeader.Wait()
+		}
+		p.mu.Unlock()
+
+		for atomic.LoadInt32(&p.heartbeatThreadRunning) == 1 {
+			ballot := p.Ballot()
+			if !IsLeader(ballot, p.id) {
+				break
+			}
+			interval := time.Duration(p.heartbeatInterval) * time.Millisecond
+			start := time.Now()
+			p.runHeartbeatPhase(ballot, 0, p.heartbeatInterval)
+			if !p.checkQuorum(ballot) {
+				break
+			}
+			time.Sleep(interval - time.Since(start))
+		}
+	}
+}
+
+func (p *Multipaxos) RunPreparePhase(ballot *pb.Ballot) (int64,
 	map[int64]*pb.Instance) {
+	return p.runPreparePhase(ballot, false)
+}
+
+// runPreparePhase asks peers to set aside the lease they granted if transfer
+// is set, since the leader holding it handed leadership to this peer.
+func (p *Multipaxos) runPreparePhase(ballot *pb.Ballot, transfer bool) (int64,
+	map[int64]*pb.Instance) {
+	peers := p.currentPeers()
+	quorum := p.prepareQuorumOf(len(peers))
 	state := NewPrepareState()
 
 	request := pb.PrepareRequest{
-		Sender: p.id,
-		Ballot: ballot,
+		Sender:   p.id,
+		Ballot:   ballot,
+		Transfer: transfer,
 	}
 
-	if ballot > p.Ballot() {
+	if p.Ballot().Less(ballot) {
 		state.NumRpcs++
 		state.NumOks++
 		state.Log = p.log.GetLog()
@@ -281,13 +659,17 @@ func (p *Multipaxos) RunPreparePhase(ballot int64) (int64,
 		return -1, nil
 	}
 
-	for _, peer := range p.rpcPeers {
+	for _, peer := range peers {
 		if peer.Id == p.id {
 			continue
 		}
 		go func(peer *RpcPeer) {
-			ctx := context.Background()
-			response, err := peer.Stub.Prepare(ctx, &request)
+			var response *pb.PrepareResponse
+			err := p.call(p.rpcRetries, p.rpcTimeout,
+				func(ctx context.Context) (err error) {
+					response, err = peer.Stub.Prepare(ctx, &request)
+					return err
+				})
 			logger.Infof("%v sent prepare request to %v", p.id, peer.Id)
 
 			state.Mu.Lock()
@@ -297,6 +679,10 @@ func (p *Multipaxos) RunPreparePhase(ballot int64) (int64,
 			if err == nil {
 				if response.GetType() == pb.ResponseType_OK {
 					state.NumOks += 1
+					lastIncludedIndex := response.GetLastIncludedIndex()
+					if lastIncludedIndex > state.MaxLastIncludedIndex {
+						state.MaxLastIncludedIndex = lastIncludedIndex
+					}
 					for i := 0; i < len(response.GetLogs()); i++ {
 						instance := response.GetLogs()[i]
 						if instance.Index > state.MaxLastIndex {
@@ -314,18 +700,28 @@ func (p *Multipaxos) RunPreparePhase(ballot int64) (int64,
 
 	state.Mu.Lock()
 	defer state.Mu.Unlock()
-	for state.NumOks <= len(p.rpcPeers)/2 && state.NumRpcs != len(p.rpcPeers) {
+	for state.NumOks < quorum && state.NumRpcs != len(peers) {
 		state.Cv.Wait()
 	}
 
-	if state.NumOks > len(p.rpcPeers)/2 {
+	if state.NumOks >= quorum {
+		if state.MaxLastIncludedIndex > p.log.LastExecuted() {
+			// a peer has trimmed instances we have not executed, so we cannot
+			// tell what was chosen there and must not lead.
+			atomic.StoreInt64(&p.behindSnapshot, state.MaxLastIncludedIndex)
+			logger.Infof("%v is behind snapshot %v, giving up leadership",
+				p.id, state.MaxLastIncludedIndex)
+			return -1, nil
+		}
 		return state.MaxLastIndex, state.Log
 	}
 	return -1, nil
 }
 
-func (p *Multipaxos) RunAcceptPhase(ballot int64, index int64,
+func (p *Multipaxos) RunAcceptPhase(ballot *pb.Ballot, index int64,
 	command *pb.Command, clientId int64) Result {
+	peers := p.currentPeers()
+	quorum := p.acceptQuorumOf(len(peers))
 	state := NewAcceptState()
 
 	instance := pb.Instance{
@@ -336,7 +732,7 @@ func (p *Multipaxos) RunAcceptPhase(ballot int64, index int64,
 		Command:  command,
 	}
 
-	if ballot == p.Ballot() {
+	if ballot.Equal(p.Ballot()) {
 		instance := pb.Instance{
 			Ballot:   ballot,
 			Index:    index,
@@ -356,13 +752,17 @@ func (p *Multipaxos) RunAcceptPhase(ballot int64, index int64,
 		Instance: &instance,
 	}
 
-	for _, peer := range p.rpcPeers {
+	for _, peer := range peers {
 		if peer.Id == p.id {
 			continue
 		}
 		go func(peer *RpcPeer) {
-			ctx := context.Background()
-			response, err := peer.Stub.Accept(ctx, &request)
+			var response *pb.AcceptResponse
+			err := p.call(p.rpcRetries, p.rpcTimeout,
+				func(ctx context.Context) (err error) {
+					response, err = peer.Stub.Accept(ctx, &request)
+					return err
+				})
 			logger.Infof("%v sent accept request to %v", p.id, peer.Id)
 
 			state.Mu.Lock()
@@ -379,15 +779,16 @@ func (p *Multipaxos) RunAcceptPhase(ballot int64, index int64,
 			state.Cv.Signal()
 		}(peer)
 	}
+	p.sendAcceptToLearners(&request)
 
 	state.Mu.Lock()
 	defer state.Mu.Unlock()
-	for IsLeader(p.Ballot(), p.id) && state.NumOks <= len(p.rpcPeers)/2 &&
-		state.NumRpcs != len(p.rpcPeers) {
+	for IsLeader(p.Ballot(), p.id) && state.NumOks < quorum &&
+		state.NumRpcs != len(peers) {
 		state.Cv.Wait()
 	}
 
-	if state.NumOks > len(p.rpcPeers)/2 {
+	if state.NumOks >= quorum {
 		p.log.Commit(index)
 		return Result{Type: Ok, Leader: -1}
 	}
@@ -397,7 +798,23 @@ func (p *Multipaxos) RunAcceptPhase(ballot int64, index int64,
 	return Result{Type: Retry, Leader: -1}
 }
 
-func (p *Multipaxos) RunCommitPhase(ballot int64, globalLastExecuted int64) int64 {
+// runAcceptPhaseUntilChosen runs the accept phase for index until it reaches
+// a quorum or ballot is no longer current. The index is taken from the log
+// already and nothing else proposes it while this peer leads, so giving up
+// after a phase that timed out would stall execution there. A new leader fills
+// it in its Replay.
+func (p *Multipaxos) runAcceptPhaseUntilChosen(ballot *pb.Ballot, index int64,
+	command *pb.Command, clientId int64) Result {
+	r := p.RunAcceptPhase(ballot, index, command, clientId)
+	for r.Type == Retry && ballot.Equal(p.Ballot()) {
+		r = p.RunAcceptPhase(ballot, index, command, clientId)
+	}
+	return r
+}
+
+func (p *Multipaxos) RunCommitPhase(ballot *pb.Ballot, globalLastExecuted int64) int64 {
+	peers := p.currentPeers()
+	quorum := p.acceptQuorumOf(len(peers))
 	state := NewCommitState(p.log.LastExecuted())
 
 	request := pb.CommitRequest{
@@ -411,15 +828,20 @@ func (p *Multipaxos) RunCommitPhase(ballot int64, globalLastExecuted int64) int6
 	state.NumOks++
 	state.MinLastExecuted = p.log.LastExecuted()
 	p.log.TrimUntil(globalLastExecuted)
+	start := time.Now()
+	p.sendCommitToLearners(&request, ballot)
 
-	for _, peer := range p.rpcPeers {
+	for _, peer := range peers {
 		if peer.Id == p.id {
 			continue
 		}
 		go func(peer *RpcPeer) {
-			ctx := context.Background()
-
-			response, err := peer.Stub.Commit(ctx, &request)
+			var response *pb.CommitResponse
+			err := p.call(0, p.rpcTimeout,
+				func(ctx context.Context) (err error) {
+					response, err = peer.Stub.Commit(ctx, &request)
+					return err
+				})
 			logger.Infof("%v sent commit request to %v", p.id, peer.Id)
 
 			state.Mu.Lock()
@@ -428,10 +850,13 @@ func (p *Multipaxos) RunCommitPhase(ballot int64, globalLastExecuted int64) int6
 			state.NumRpcs += 1
 			if err == nil {
 				if response.GetType() == pb.ResponseType_OK {
+					p.heardFromPeer(peer.Id)
 					state.NumOks += 1
 					if response.GetLastExecuted() < state.MinLastExecuted {
 						state.MinLastExecuted = response.GetLastExecuted()
 					}
+					p.catchUpIfBehind(peer, ballot, response.GetLastExecuted())
+					p.preferLeader(peer, response.GetLastExecuted())
 				} else {
 					p.BecomeFollower(response.GetBallot())
 				}
@@ -442,39 +867,193 @@ func (p *Multipaxos) RunCommitPhase(ballot int64, globalLastExecuted int64) int6
 
 	state.Mu.Lock()
 	defer state.Mu.Unlock()
-	for IsLeader(p.Ballot(), p.id) && state.NumRpcs != len(p.rpcPeers) {
+	for IsLeader(p.Ballot(), p.id) && state.NumRpcs != len(peers) {
 		state.Cv.Wait()
 	}
-	if state.NumOks == len(p.rpcPeers) {
+	if state.NumOks >= quorum {
+		p.extendLease(ballot, start)
+	}
+	if state.NumOks == len(peers) {
 		return state.MinLastExecuted
 	}
 	return globalLastExecuted
 }
 
-func (p *Multipaxos) Replay(ballot int64, log map[int64]*pb.Instance) {
-	for index, instance := range log {
-		r := p.RunAcceptPhase(ballot, index, instance.GetCommand(),
-			instance.GetClientId())
-		for r.Type == Retry {
-			r = p.RunAcceptPhase(ballot, index, instance.GetCommand(),
-				instance.GetClientId())
+// confirmLeadership sends a heartbeat round and reports whether a quorum
+// still accepts ballot.
+func (p *Multipaxos) confirmLeadership(ballot *pb.Ballot) bool {
+	return p.runHeartbeatPhase(ballot, p.rpcRetries, p.rpcTimeout)
+}
+
+// runHeartbeatPhase reports whether a quorum accepted a heartbeat for ballot,
+// and extends the lease if so. A heartbeat carries the last executed index as a
+// commit does, so followers execute and report progress between commit rounds.
+func (p *Multipaxos) runHeartbeatPhase(ballot *pb.Ballot, retries int64,
+	timeout int64) bool {
+	peers := p.currentPeers()
+	quorum := p.acceptQuorumOf(len(peers))
+	state := NewCommitState(p.log.LastExecuted())
+	request := pb.HeartbeatRequest{
+		Ballot:       ballot,
+		Sender:       p.id,
+		LastExecuted: p.log.LastExecuted(),
+	}
+	state.NumRpcs++
+	state.NumOks++
+	start := time.Now()
+
+	for _, peer := range peers {
+		if peer.Id == p.id {
+			continue
+		}
+		go func(peer *RpcPeer) {
+			var response *pb.HeartbeatResponse
+			err := p.call(retries, timeout,
+				func(ctx context.Context) (err error) {
+					response, err = peer.Stub.Heartbeat(ctx, &request)
+					return err
+				})
+
+			state.Mu.Lock()
+			defer state.Mu.Unlock()
+
+			state.NumRpcs += 1
+			if err == nil {
+				if response.GetType() == pb.ResponseType_OK {
+					p.heardFromPeer(peer.Id)
+					state.NumOks += 1
+					p.catchUpIfBehind(peer, ballot, response.GetLastExecuted())
+					p.preferLeader(peer, response.GetLastExecuted())
+				} else {
+					p.BecomeFollower(response.GetBallot())
+				}
+			}
+			state.Cv.Signal()
+		}(peer)
+	}
+
+	state.Mu.Lock()
+	defer state.Mu.Unlock()
+	for IsLeader(p.Ballot(), p.id) && state.NumOks < quorum &&
+		state.NumRpcs != len(peers) {
+		state.Cv.Wait()
+	}
+	if state.NumOks < quorum {
+		return false
+	}
+	p.extendLease(ballot, start)
+	return p.Ballot().Equal(ballot)
+}
+
+func (p *Multipaxos) sendSnapshot(peer *RpcPeer, ballot *pb.Ballot) {
+	// a witness has no store to send, so it makes way for a full replica.
+	if p.witness {
+		logger.Infof("%v cannot send %v a snapshot", p.id, peer.Id)
+		p.resign(ballot)
+		return
+	}
+	if _, inFlight := p.snapshotInFlight.LoadOrStore(peer.Id,
+		struct{}{}); inFlight {
+		return
+	}
+	defer p.snapshotInFlight.Delete(peer.Id)
+
+	snapshot := p.log.Snapshot()
+	if snapshot == nil {
+		return
+	}
+	// the stream gets rpcTimeout and the pause for every chunk and one more
+	// for the reply.
+	numChunks := len(snapshot.Data)/SnapshotChunkSize + 1
+	ctx, cancel := context.WithTimeout(withGroup(context.Background(),
+		p.group), time.Duration((p.rpcTimeout+p.catchUpInterval)*
+		int64(numChunks+1))*time.Millisecond)
+	defer cancel()
+	stream, err := peer.Stub.InstallSnapshot(ctx)
+	if err != nil {
+		return
+	}
+	for offset := 0; ; offset += SnapshotChunkSize {
+		end := offset + SnapshotChunkSize
+		if end > len(snapshot.Data) {
+			end = len(snapshot.Data)
+		}
+		err := stream.Send(&pb.InstallSnapshotRequest{
+			Ballot:            ballot,
+			LastIncludedIndex: snapshot.LastIncludedIndex,
+			Data:              snapshot.Data[offset:end],
+			Sender:            p.id,
+		})
+		if err != nil || end == len(snapshot.Data) {
+			break
+		}
+		p.sleepForCatchUpInterval()
+	}
+	logger.Infof("%v sent install snapshot request to %v", p.id, peer.Id)
+
+	response, err := stream.CloseAndRecv()
+	if err == nil && response.GetType() != pb.ResponseType_OK {
+		p.BecomeFollower(response.GetBallot())
+	}
+}
+
+func (p *Multipaxos) Replay(ballot *pb.Ballot, lastIndex int64,
+	log map[int64]*pb.Instance) {
+	// no peer in the prepare quorum accepted anything at a missing index, so
+	// it is safe to fill it with a no-op; otherwise execution stalls there.
+	for i := p.log.LastExecuted() + 1; i <= lastIndex; i++ {
+		if _, ok := log[i]; !ok {
+			log[i] = &pb.Instance{
+				Index:    i,
+				ClientId: NoopClientId,
+				Command:  &pb.Command{Type: pb.CommandType_NOOP},
+			}
 		}
-		if r.Type == SomeElseLeader {
-			return
+	}
+	indexes := make([]int64, 0, len(log))
+	for index := range log {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		return indexes[i] < indexes[j]
+	})
+
+	var wg sync.WaitGroup
+	var stopped int32
+	window := make(chan struct{}, p.replayWindow)
+	for _, index := range indexes {
+		window <- struct{}{}
+		if atomic.LoadInt32(&stopped) == 1 {
+			break
 		}
+		wg.Add(1)
+		go func(instance *pb.Instance) {
+			defer func() {
+				<-window
+				wg.Done()
+			}()
+			r := p.runAcceptPhaseUntilChosen(ballot, instance.GetIndex(),
+				instance.GetCommand(), instance.GetClientId())
+			if r.Type == SomeElseLeader {
+				atomic.StoreInt32(&stopped, 1)
+			}
+		}(log[index])
 	}
+	wg.Wait()
 }
 
 func (p *Multipaxos) Prepare(ctx context.Context,
 	request *pb.PrepareRequest) (*pb.PrepareResponse, error) {
 	logger.Infof("%v <--prepare-- %v", p.id, request.GetSender())
 	response := &pb.PrepareResponse{}
-	if request.GetBallot() > p.Ballot() {
+	if p.Ballot().Less(request.GetBallot()) && p.isMember(request.GetSender()) &&
+		(request.GetTransfer() || !p.leaseGranted(request.GetSender())) {
 		p.BecomeFollower(request.GetBallot())
 		response.Logs = make([]*pb.Instance, 0, len(p.log.Instances()))
 		for _, i := range p.log.Instances() {
 			response.Logs = append(response.Logs, i)
 		}
+		response.LastIncludedIndex = p.log.LastIncludedIndex()
 		response.Type = pb.ResponseType_OK
 	} else {
 		response.Ballot = p.Ballot()
@@ -487,31 +1066,53 @@ func (p *Multipaxos) Accept(ctx context.Context,
 	request *pb.AcceptRequest) (*pb.AcceptResponse, error) {
 	logger.Infof("%v <--accept-- %v", p.id, request.GetSender())
 	response := &pb.AcceptResponse{}
-	if request.GetInstance().GetBallot() >= p.Ballot() {
-		p.log.Append(request.GetInstance())
-		response.Type = pb.ResponseType_OK
-		if request.GetInstance().GetBallot() > p.Ballot() {
+	if !request.GetInstance().GetBallot().Less(p.Ballot()) {
+		// the promise is saved before the instance, so that a crash never
+		// leaves an accepted ballot above the saved one.
+		if p.Ballot().Less(request.GetInstance().GetBallot()) {
 			p.BecomeFollower(request.GetInstance().GetBallot())
 		}
+		p.log.Append(request.GetInstance())
+		response.Type = pb.ResponseType_OK
 	}
-	if request.GetInstance().GetBallot() < p.Ballot() {
+	if request.GetInstance().GetBallot().Less(p.Ballot()) {
 		response.Ballot = p.Ballot()
 		response.Type = pb.ResponseType_REJECT
 	}
 	return response, nil
 }
 
+func (p *Multipaxos) Heartbeat(ctx context.Context,
+	request *pb.HeartbeatRequest) (*pb.HeartbeatResponse, error) {
+	response := &pb.HeartbeatResponse{}
+	if !request.GetBallot().Less(p.Ballot()) {
+		p.heardFromLeader()
+		p.grantLease(request.GetBallot())
+		p.log.CommitUntil(request.GetLastExecuted(), request.GetBallot())
+		if p.Ballot().Less(request.GetBallot()) {
+			p.BecomeFollower(request.GetBallot())
+		}
+		response.Type = pb.ResponseType_OK
+		response.LastExecuted = p.log.LastExecuted()
+	} else {
+		response.Type = pb.ResponseType_REJECT
+	}
+	response.Ballot = p.Ballot()
+	return response, nil
+}
+
 func (p *Multipaxos) Commit(ctx context.Context,
 	request *pb.CommitRequest) (*pb.CommitResponse, error) {
 	logger.Infof("%v <--commit-- %v", p.id, request.GetSender())
 	response := &pb.CommitResponse{}
-	if request.GetBallot() >= p.Ballot() {
-		atomic.StoreInt32(&p.commitReceived, 1)
+	if !request.GetBallot().Less(p.Ballot()) {
+		p.heardFromLeader()
+		p.grantLease(request.GetBallot())
 		p.log.CommitUntil(request.GetLastExecuted(), request.GetBallot())
-		p.log.TrimUntil(request.GetGlobalLastExecuted())
+		p.log.TrimUntil(p.trimIndex(request.GetGlobalLastExecuted()))
 		response.LastExecuted = p.log.LastExecuted()
 		response.Type = pb.ResponseType_OK
-		if request.GetBallot() > p.Ballot() {
+		if p.Ballot().Less(request.GetBallot()) {
 			p.BecomeFollower(request.GetBallot())
 		}
 	} else {
@@ -520,3 +1121,37 @@ func (p *Multipaxos) Commit(ctx context.Context,
 	}
 	return response, nil
 }
+
+func (p *Multipaxos) InstallSnapshot(
+	stream pb.MultiPaxosRPC_InstallSnapshotServer) error {
+	var request *pb.InstallSnapshotRequest
+	snapshot := &Log.Snapshot{}
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		request = chunk
+		snapshot.LastIncludedIndex = chunk.GetLastIncludedIndex()
+		snapshot.Data = append(snapshot.Data, chunk.GetData()...)
+	}
+	logger.Infof("%v <--installsnapshot-- %v", p.id, request.GetSender())
+
+	response := &pb.InstallSnapshotResponse{}
+	if !request.GetBallot().Less(p.Ballot()) {
+		p.heardFromLeader()
+		if p.Ballot().Less(request.GetBallot()) {
+			p.BecomeFollower(request.GetBallot())
+		}
+		p.log.InstallSnapshot(snapshot)
+		response.LastExecuted = p.log.LastExecuted()
+		response.Type = pb.ResponseType_OK
+	} else {
+		response.Ballot = p.Ballot()
+		response.Type = pb.ResponseType_REJECT
+	}
+	return stream.SendAndClose(response)
+}
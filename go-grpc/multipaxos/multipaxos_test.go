@@ -10,6 +10,10 @@ import (
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -24,10 +28,10 @@ var (
 )
 
 func initPeers() {
-	for i:= int64(0); i < NumPeers; i++ {
+	for i := int64(0); i < NumPeers; i++ {
 		configs[i] = config.DefaultConfig(i, NumPeers)
 		stores[i] = kvstore.NewMemKVStore()
-		logs[i] = log.NewLog(stores[i])
+		logs[i] = log.NewLog(stores[i], nil)
 		peers[i] = NewMultipaxos(logs[i], configs[i])
 	}
 }
@@ -35,7 +39,7 @@ func initPeers() {
 func setupOnePeer(id int64) {
 	configs[id] = config.DefaultConfig(id, NumPeers)
 	stores[id] = kvstore.NewMemKVStore()
-	logs[id] = log.NewLog(stores[id])
+	logs[id] = log.NewLog(stores[id], nil)
 	peers[id] = NewMultipaxos(logs[id], configs[id])
 }
 
@@ -60,10 +64,10 @@ func IsLeaderByPeer(peer *Multipaxos) bool {
 }
 
 func IsSomeoneElseLeaderByPeer(peer *Multipaxos) bool {
-	return !IsLeaderByPeer(peer) && LeaderByPeer(peer) < MaxNumPeers
+	return !IsLeaderByPeer(peer) && LeaderByPeer(peer) != pb.NoLeader
 }
 
-func sendCommit(stub pb.MultiPaxosRPCClient, ballot int64,
+func sendCommit(stub pb.MultiPaxosRPCClient, ballot *pb.Ballot,
 	lastExecuted int64, globalLastExecuted int64) *pb.CommitResponse {
 	ctx := context.Background()
 	request := pb.CommitRequest{
@@ -78,7 +82,8 @@ func sendCommit(stub pb.MultiPaxosRPCClient, ballot int64,
 	return response
 }
 
-func sendPrepare(stub pb.MultiPaxosRPCClient, ballot int64) *pb.PrepareResponse {
+func sendPrepare(stub pb.MultiPaxosRPCClient,
+	ballot *pb.Ballot) *pb.PrepareResponse {
 	ctx := context.Background()
 	request := pb.PrepareRequest{Ballot: ballot}
 	response, err := stub.Prepare(ctx, &request)
@@ -117,7 +122,7 @@ func Connect(multipaxos *Multipaxos, addrs []string) {
 func TestNewMultipaxos(t *testing.T) {
 	setupOnePeer(0)
 
-	assert.Equal(t, MaxNumPeers, LeaderByPeer(peers[0]))
+	assert.Equal(t, pb.NoLeader, LeaderByPeer(peers[0]))
 	assert.False(t, IsLeaderByPeer(peers[0]))
 	assert.False(t, IsSomeoneElseLeaderByPeer(peers[0]))
 }
@@ -125,9 +130,8 @@ func TestNewMultipaxos(t *testing.T) {
 func TestNextBallot(t *testing.T) {
 	initPeers()
 	for id := 0; id < NumPeers; id++ {
-		ballot := id
-		ballot += RoundIncrement
-		assert.EqualValues(t, ballot, peers[id].NextBallot())
+		assert.EqualValues(t, 1, peers[id].NextBallot().GetRound())
+		assert.EqualValues(t, id, peers[id].NextBallot().GetId())
 	}
 }
 
@@ -198,17 +202,41 @@ func TestNextBallotAfterCommit(t *testing.T) {
 	peers[0].StartRPCServer()
 	stub := makeStub(configs[0].Peers[0])
 
-	ballot := peers[0].Id()
 	sendCommit(stub, peers[1].NextBallot(), 0, 0)
 	assert.EqualValues(t, 1, LeaderByPeer(peers[0]))
 
-	ballot += RoundIncrement
-	ballot += RoundIncrement
-	assert.EqualValues(t, ballot, peers[0].NextBallot())
+	assert.EqualValues(t, 2, peers[0].NextBallot().GetRound())
+	assert.EqualValues(t, peers[0].Id(), peers[0].NextBallot().GetId())
 
 	peers[0].StopRPCServer()
 }
 
+func TestBallotRestoredAfterRestart(t *testing.T) {
+	setupOnePeer(0)
+
+	cfg := configs[0]
+	cfg.BallotPath = filepath.Join(t.TempDir(), "ballot")
+	peer := NewMultipaxos(logs[0], cfg)
+
+	ballot := &pb.Ballot{Round: 1, Id: 1}
+	r, _ := peer.Prepare(context.Background(),
+		&pb.PrepareRequest{Ballot: ballot, Sender: 1})
+	assert.EqualValues(t, pb.ResponseType_OK, r.GetType())
+
+	peer = NewMultipaxos(logs[0], cfg)
+	assert.True(t, ballot.Equal(peer.Ballot()))
+	assert.EqualValues(t, 1, LeaderByPeer(peer))
+
+	leaderBallot := peer.NextBallot()
+	peer.BecomeLeader(leaderBallot, logs[0].LastIndex())
+	assert.True(t, IsLeaderByPeer(peer))
+
+	peer = NewMultipaxos(logs[0], cfg)
+	assert.False(t, IsLeaderByPeer(peer))
+	assert.False(t, IsSomeoneElseLeaderByPeer(peer))
+	assert.True(t, leaderBallot.Less(peer.NextBallot()))
+}
+
 func TestCommitCommitsAndTrims(t *testing.T) {
 	setupOnePeer(0)
 	peers[0].StartRPCServer()
@@ -472,8 +500,7 @@ func TestRunPreparePhase(t *testing.T) {
 	assert.EqualValues(t, 5, lastIndex)
 	for index, instance := range logMap {
 		if index == 3 || index == 4 {
-			assert.True(t, log.IsEqualCommand(expectedLog[index].GetCommand(
-				), instance.GetCommand()))
+			assert.True(t, log.IsEqualCommand(expectedLog[index].GetCommand(), instance.GetCommand()))
 		} else {
 			assert.True(t, log.IsEqualInstance(expectedLog[index], instance),
 				"index: %v", index)
@@ -551,6 +578,144 @@ func TestRunCommitPhase(t *testing.T) {
 	assert.EqualValues(t, numInstances, gle)
 }
 
+func TestRunCommitPhaseCatchesUp(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+	peers[0].StartRPCServer()
+	peers[1].StartRPCServer()
+	peers[2].StartRPCServer()
+	go func() {
+		for {
+			if _, result := logs[2].Execute(); result == nil {
+				return
+			}
+		}
+	}()
+	defer logs[2].Stop()
+
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+	peers[0].catchUpBatchSize = 2
+
+	// peer 2 missed every accept.
+	const numInstances int64 = 5
+	for index := int64(1); index <= numInstances; index++ {
+		for _, log := range logs[:2] {
+			instance := util.MakeInstanceWithAll(ballot, index,
+				pb.InstanceState_COMMITTED, pb.CommandType_PUT)
+			instance.Command.Key = "foo"
+			log.Append(instance)
+			log.Execute()
+		}
+	}
+
+	peers[0].RunCommitPhase(ballot, 0)
+	assert.EqualValues(t, 0, logs[2].LastExecuted())
+
+	// peer 2 made no progress since the last commit, so the leader sends it
+	// the instances it missed.
+	peers[0].RunCommitPhase(ballot, 0)
+	assert.Eventually(t, func() bool {
+		return logs[2].LastExecuted() == numInstances
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NotNil(t, stores[2].Get("foo"))
+	assert.EqualValues(t, numInstances,
+		peers[0].RunCommitPhase(ballot, 0))
+}
+
+func TestHeartbeatCatchesUp(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+	peers[0].StartRPCServer()
+	peers[1].StartRPCServer()
+	peers[2].StartRPCServer()
+	go func() {
+		for {
+			if _, result := logs[2].Execute(); result == nil {
+				return
+			}
+		}
+	}()
+	defer logs[2].Stop()
+
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+
+	// peer 2 missed every accept, and no commit round runs.
+	const numInstances int64 = 5
+	for index := int64(1); index <= numInstances; index++ {
+		for _, log := range logs[:2] {
+			instance := util.MakeInstanceWithAll(ballot, index,
+				pb.InstanceState_COMMITTED, pb.CommandType_PUT)
+			instance.Command.Key = "foo"
+			log.Append(instance)
+			log.Execute()
+		}
+	}
+
+	// heartbeats alone show that peer 2 makes no progress.
+	assert.Eventually(t, func() bool {
+		peers[0].runHeartbeatPhase(ballot, 0, peers[0].rpcTimeout)
+		return logs[2].LastExecuted() == numInstances
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NotNil(t, stores[2].Get("foo"))
+}
+
+func TestRunPreparePhaseBehindSnapshot(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+	peers[0].StartRPCServer()
+	peers[1].StartRPCServer()
+	peers[2].StartRPCServer()
+
+	const index int64 = 1
+	for i := 1; i < NumPeers; i++ {
+		logs[i].SetSnapshotInterval(1)
+		logs[i].Append(util.MakeInstanceWithState(&pb.Ballot{}, index,
+			pb.InstanceState_COMMITTED))
+		logs[i].Execute()
+		assert.Equal(t, index, logs[i].LastIncludedIndex())
+	}
+
+	_, logMap := peers[0].RunPreparePhase(peers[0].NextBallot())
+	assert.Nil(t, logMap)
+}
+
+func TestRunCommitPhaseInstallsSnapshot(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+	peers[0].StartRPCServer()
+	peers[1].StartRPCServer()
+	peers[2].StartRPCServer()
+
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+
+	const (
+		index1 int64 = iota + 1
+		index2
+	)
+	logs[0].SetSnapshotInterval(index2)
+	for _, index := range []int64{index1, index2} {
+		instance := util.MakeInstanceWithAll(ballot, index,
+			pb.InstanceState_COMMITTED, pb.CommandType_PUT)
+		instance.Command.Key = "foo"
+		logs[0].Append(instance)
+		logs[0].Execute()
+	}
+	assert.Equal(t, index2, logs[0].LastIncludedIndex())
+	assert.Nil(t, logs[0].At(index1))
+
+	peers[0].RunCommitPhase(ballot, 0)
+	for i := 1; i < NumPeers; i++ {
+		assert.Eventually(t, func() bool {
+			return logs[i].LastExecuted() == index2
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.NotNil(t, stores[i].Get("foo"))
+		assert.Equal(t, index2, logs[i].LastIncludedIndex())
+	}
+}
+
 func TestReplay(t *testing.T) {
 	initPeers()
 	peers[0].StartRPCServer()
@@ -586,7 +751,7 @@ func TestReplay(t *testing.T) {
 
 	newBallot := peers[0].NextBallot()
 	peers[0].BecomeLeader(newBallot, logs[0].LastIndex())
-	peers[0].Replay(newBallot, replayLog)
+	peers[0].Replay(newBallot, index3, replayLog)
 
 	assert.True(t, log.IsEqualInstance(util.MakeInstanceWithAll(newBallot,
 		index1, pb.InstanceState_COMMITTED, pb.CommandType_PUT),
@@ -609,6 +774,798 @@ func TestReplay(t *testing.T) {
 		logs[1].At(index3)))
 }
 
+func TestReplayFillsHoles(t *testing.T) {
+	initPeers()
+	peers[0].StartRPCServer()
+	peers[1].StartRPCServer()
+	defer peers[0].StopRPCServer()
+	defer peers[1].StopRPCServer()
+	Connect(peers[0], configs[0].Peers)
+
+	const (
+		index1 int64 = iota + 1
+		index2
+		index3
+	)
+	ballot := peers[0].NextBallot()
+	replayLog := map[int64]*pb.Instance{
+		index1: util.MakeInstanceWithAll(ballot, index1,
+			pb.InstanceState_INPROGRESS, pb.CommandType_PUT),
+		index3: util.MakeInstanceWithAll(ballot, index3,
+			pb.InstanceState_INPROGRESS, pb.CommandType_DEL),
+	}
+
+	peers[0].BecomeLeader(ballot, index3)
+	peers[0].Replay(ballot, index3, replayLog)
+
+	noop := util.MakeInstanceWithAll(ballot, index2,
+		pb.InstanceState_COMMITTED, pb.CommandType_NOOP)
+	noop.ClientId = NoopClientId
+	assert.True(t, log.IsEqualInstance(noop, logs[0].At(index2)))
+	noop.State = pb.InstanceState_INPROGRESS
+	assert.True(t, log.IsEqualInstance(noop, logs[1].At(index2)))
+
+	result := kvstore.Execute(noop.Command, stores[0])
+	assert.True(t, result.Ok)
+	assert.Equal(t, kvstore.Empty, result.Value)
+}
+
+func TestReplayLatency(t *testing.T) {
+	initPeers()
+	peers[0].StartRPCServer()
+	peers[1].StartRPCServer()
+	defer peers[0].StopRPCServer()
+	defer peers[1].StopRPCServer()
+	Connect(peers[0], configs[0].Peers)
+
+	const numInstances int64 = 4000
+	ballot := peers[0].NextBallot()
+	replayLog := make(map[int64]*pb.Instance, numInstances)
+	for i := int64(1); i <= numInstances; i++ {
+		replayLog[i] = util.MakeInstanceWithAll(ballot, i,
+			pb.InstanceState_INPROGRESS, pb.CommandType_PUT)
+	}
+
+	peers[0].BecomeLeader(ballot, numInstances)
+	start := time.Now()
+	peers[0].Replay(ballot, numInstances, replayLog)
+	t.Logf("replayed %v instances in %v", numInstances, time.Since(start))
+
+	for i := int64(1); i <= numInstances; i++ {
+		assert.Equal(t, pb.InstanceState_COMMITTED, logs[0].At(i).GetState())
+		assert.NotNil(t, logs[1].At(i))
+	}
+}
+
+func TestReplicateBatch(t *testing.T) {
+	initPeers()
+	peers[0].StartRPCServer()
+	peers[1].StartRPCServer()
+	defer peers[0].StopRPCServer()
+	defer peers[1].StopRPCServer()
+	Connect(peers[0], configs[0].Peers)
+
+	peers[0].batchSize = 3
+	peers[0].batchDelay = 10
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+
+	var wg sync.WaitGroup
+	results := make([]Result, 3)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = peers[0].Replicate(&pb.Command{}, int64(i))
+		}(i)
+	}
+	wg.Wait()
+	for _, r := range results {
+		assert.Equal(t, Ok, r.Type)
+	}
+	assert.EqualValues(t, 1, logs[0].LastIndex())
+	batch := logs[0].At(1).GetCommand()
+	assert.Equal(t, pb.CommandType_BATCH, batch.GetType())
+	assert.Len(t, batch.GetCommands(), 3)
+	assert.ElementsMatch(t, []int64{0, 1, 2}, batch.GetClientIds())
+
+	r := peers[0].Replicate(&pb.Command{}, 0)
+	assert.Equal(t, Ok, r.Type)
+	assert.EqualValues(t, 2, logs[0].LastIndex())
+	assert.True(t, log.IsEqualCommand(&pb.Command{}, logs[0].At(2).GetCommand()))
+}
+
+func TestAcceptWindow(t *testing.T) {
+	initPeers()
+	peers[0].windowSize = 2
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, 0)
+
+	peers[0].acquireWindow(ballot, 1)
+	peers[0].acquireWindow(ballot, 2)
+	acquired := make(chan struct{})
+	go func() {
+		peers[0].acquireWindow(ballot, 3)
+		close(acquired)
+	}()
+
+	peers[0].releaseWindow(2)
+	select {
+	case <-acquired:
+		t.Fatal("acquired a slot past an unfinished index")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	peers[0].releaseWindow(1)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("slot not released in index order")
+	}
+	assert.EqualValues(t, 2, peers[0].windowCommitted)
+
+	peers[0].acquireWindow(ballot, 4)
+	blocked := make(chan struct{})
+	go func() {
+		peers[0].acquireWindow(ballot, 5)
+		close(blocked)
+	}()
+	peers[0].BecomeFollower(peers[1].NextBallot())
+	select {
+	case <-blocked:
+	case <-time.After(time.Second):
+		t.Fatal("stale proposer still waiting on the window")
+	}
+}
+
+func TestLeaseRead(t *testing.T) {
+	initPeers()
+	for _, peer := range peers {
+		peer.StartRPCServer()
+		defer peer.StopRPCServer()
+		peer.leaseDuration = 1000
+	}
+	Connect(peers[0], configs[0].Peers)
+
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+	get := &pb.Command{Type: pb.CommandType_GET, Key: "foo"}
+	_, ok := peers[0].LeaseRead(get)
+	assert.False(t, ok)
+
+	peers[0].RunCommitPhase(ballot, 0)
+	stores[0].Put("foo", "bar")
+	result, ok := peers[0].LeaseRead(get)
+	assert.True(t, ok)
+	assert.Equal(t, "bar", result.Value)
+	_, ok = peers[1].LeaseRead(get)
+	assert.False(t, ok)
+
+	// a round that finishes while leadership is being transferred does not
+	// extend the lease.
+	atomic.StoreInt32(&peers[0].transferring, 1)
+	_, ok = peers[0].LeaseRead(get)
+	assert.False(t, ok)
+	peers[0].leaseMu.Lock()
+	peers[0].leaseExpiry = time.Time{}
+	peers[0].leaseMu.Unlock()
+	peers[0].RunCommitPhase(ballot, 0)
+	atomic.StoreInt32(&peers[0].transferring, 0)
+	_, ok = peers[0].LeaseRead(get)
+	assert.False(t, ok)
+
+	prepare := &pb.PrepareRequest{Ballot: peers[2].NextBallot(), Sender: 2}
+	response, _ := peers[1].Prepare(context.Background(), prepare)
+	assert.Equal(t, pb.ResponseType_REJECT, response.GetType())
+
+	time.Sleep(1100 * time.Millisecond)
+	_, ok = peers[0].LeaseRead(get)
+	assert.False(t, ok)
+	response, _ = peers[1].Prepare(context.Background(), prepare)
+	assert.Equal(t, pb.ResponseType_OK, response.GetType())
+}
+
+func TestReadIndexRead(t *testing.T) {
+	initPeers()
+	for _, peer := range peers {
+		peer.StartRPCServer()
+		defer peer.StopRPCServer()
+	}
+	Connect(peers[0], configs[0].Peers)
+	ballot := peers[0].NextBallot()
+	logs[0].Append(util.MakeInstanceWithType(ballot, 1, pb.CommandType_PUT))
+	peers[0].BecomeLeader(ballot, 1)
+	peers[0].readMode = ReadModeReadIndex
+	stores[0].Put("foo", "bar")
+	get := &pb.Command{Type: pb.CommandType_GET, Key: "foo"}
+
+	done := make(chan kvstore.KVResult, 1)
+	go func() {
+		result, ok := peers[0].Read(get)
+		assert.True(t, ok)
+		done <- result
+	}()
+	select {
+	case <-done:
+		t.Fatal("read answered before the log caught up")
+	case <-time.After(100 * time.Millisecond):
+	}
+	logs[0].Commit(1)
+	logs[0].Execute()
+	select {
+	case result := <-done:
+		assert.Equal(t, "bar", result.Value)
+	case <-time.After(time.Second):
+		t.Fatal("read not answered after the log caught up")
+	}
+
+	_, ok := peers[1].ReadIndexRead(get)
+	assert.False(t, ok)
+
+	newBallot := peers[2].NextBallot()
+	peers[1].BecomeFollower(newBallot)
+	peers[2].BecomeFollower(newBallot)
+	_, ok = peers[0].ReadIndexRead(get)
+	assert.False(t, ok)
+	assert.False(t, IsLeaderByPeer(peers[0]))
+}
+
+func TestReconfigure(t *testing.T) {
+	initPeers()
+	for _, peer := range peers {
+		peer.StartRPCServer()
+		defer peer.StopRPCServer()
+	}
+	for i := range logs {
+		go func(l *log.Log) {
+			for {
+				if _, result := l.Execute(); result == nil {
+					return
+				}
+			}
+		}(logs[i])
+		defer logs[i].Stop()
+	}
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+
+	r := peers[0].RemovePeer(2, NoopClientId)
+	assert.EqualValues(t, Ok, r.Type)
+	assert.Len(t, peers[0].Members(), 2)
+	assert.Len(t, peers[0].currentPeers(), 2)
+	// the accept phase returns at a quorum, so the accept may reach peer 1
+	// after a commit does.
+	assert.Eventually(t, func() bool {
+		peers[0].RunCommitPhase(ballot, 0)
+		return logs[1].LastExecuted() == logs[0].LastIndex()
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Len(t, peers[1].Members(), 2)
+
+	r = peers[0].AddPeer(2, configs[2].Peers[2], NoopClientId)
+	assert.EqualValues(t, Ok, r.Type)
+	assert.Equal(t, configs[2].Peers[2], peers[0].Members()[2])
+	assert.Len(t, peers[0].currentPeers(), 3)
+	peers[1].StopRPCServer()
+	assert.True(t, peers[0].confirmLeadership(ballot))
+
+	r = peers[0].RemovePeer(1, NoopClientId)
+	assert.EqualValues(t, Ok, r.Type)
+	assert.Len(t, peers[0].currentPeers(), 2)
+	// with two peers left, the leader cannot form a quorum on its own.
+	peers[2].StopRPCServer()
+	assert.False(t, peers[0].confirmLeadership(ballot))
+}
+
+func TestPreVote(t *testing.T) {
+	initPeers()
+	for _, peer := range peers {
+		peer.StartRPCServer()
+		defer peer.StopRPCServer()
+	}
+
+	// no peer has heard from a leader yet, so all of them take part.
+	assert.True(t, peers[1].runPreVotePhase(peers[1].NextBallot()))
+
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+	assert.True(t, peers[0].confirmLeadership(ballot))
+
+	// peer 2 still hears from the leader, so peer 1 cannot start an election
+	// and nobody raises their ballot.
+	assert.False(t, peers[1].runPreVotePhase(peers[1].NextBallot()))
+	for _, peer := range peers {
+		assert.True(t, ballot.Equal(peer.Ballot()))
+	}
+
+	time.Sleep(time.Duration(peers[2].electionTimeoutMin) * time.Millisecond)
+	assert.True(t, peers[1].runPreVotePhase(peers[1].NextBallot()))
+}
+
+func TestCheckQuorum(t *testing.T) {
+	initPeers()
+	peers[0].StartRPCServer()
+	defer peers[0].StopRPCServer()
+	peers[1].StartRPCServer()
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+	peers[0].StartHeartbeatThread()
+	defer peers[0].StopHeartbeatThread()
+	electionTimeout := time.Duration(peers[0].electionTimeoutMin) *
+		time.Millisecond
+
+	// peer 2 is down, but peer 1 still acknowledges the heartbeats, so the
+	// leader keeps a quorum.
+	time.Sleep(2 * electionTimeout)
+	assert.True(t, ballot.Equal(peers[0].Ballot()))
+
+	peers[1].StopRPCServer()
+	assert.Eventually(t, func() bool {
+		return !IsLeaderByPeer(peers[0])
+	}, 2*electionTimeout, 10*time.Millisecond)
+	assert.True(t, ballot.Less(peers[0].Ballot()))
+	r := peers[0].Replicate(&pb.Command{}, 0)
+	assert.Equal(t, Retry, r.Type)
+}
+
+func TestTransferLeadership(t *testing.T) {
+	initPeers()
+	defer tearDown()
+	peers[0].BecomeLeader(peers[0].NextBallot(), logs[0].LastIndex())
+	for _, peer := range peers {
+		peer.Start()
+	}
+	// the links to peers dialed before their servers came up may still be
+	// backing off.
+	assert.Eventually(t, func() bool {
+		return peers[0].Replicate(&pb.Command{}, 0).Type == Ok
+	}, time.Second, 10*time.Millisecond)
+
+	r := peers[1].TransferLeadership(2)
+	assert.EqualValues(t, SomeElseLeader, r.Type)
+	assert.EqualValues(t, 0, r.Leader)
+
+	r = peers[0].TransferLeadership(2)
+	assert.Equal(t, Ok, r.Type)
+	assert.EqualValues(t, 2, r.Leader)
+	// peer 0 learns of the new ballot from peer 2's prepare request, before
+	// peer 2 becomes the leader.
+	assert.Eventually(t, func() bool {
+		return IsLeaderByPeer(peers[2])
+	}, time.Second, 10*time.Millisecond)
+	assert.False(t, IsLeaderByPeer(peers[0]))
+
+	r = peers[0].Replicate(&pb.Command{}, 0)
+	assert.EqualValues(t, SomeElseLeader, r.Type)
+	assert.EqualValues(t, 2, r.Leader)
+	r = peers[2].Replicate(&pb.Command{}, 0)
+	assert.Equal(t, Ok, r.Type)
+}
+
+func TestTimeoutNowDroppedAfterBallotChange(t *testing.T) {
+	initPeers()
+	ctx := context.Background()
+
+	r, _ := peers[1].TimeoutNow(ctx, &pb.TimeoutNowRequest{
+		Ballot: peers[0].NextBallot(),
+		Sender: 0,
+	})
+	assert.Equal(t, pb.ResponseType_OK, r.GetType())
+	// the transfer failed and another leader took over since, so the request
+	// no longer starts an election.
+	peers[1].BecomeFollower(peers[2].NextBallot())
+	assert.False(t, peers[1].sleepForRandomInterval())
+
+	r, _ = peers[1].TimeoutNow(ctx, &pb.TimeoutNowRequest{
+		Ballot: peers[1].Ballot(),
+		Sender: 2,
+	})
+	assert.Equal(t, pb.ResponseType_OK, r.GetType())
+	assert.True(t, peers[1].sleepForRandomInterval())
+}
+
+func TestPriority(t *testing.T) {
+	initPeers()
+	defer tearDown()
+	for _, peer := range peers {
+		peer.priorities = []int64{0, 2, 1}
+		peer.commitInterval = 10
+		peer.StartRPCServer()
+	}
+	assert.EqualValues(t, 2, peers[0].outranked())
+	assert.EqualValues(t, 0, peers[1].outranked())
+	assert.EqualValues(t, 1, peers[2].outranked())
+
+	// both other peers outrank peer 0 and would run first, so peer 0 gets no
+	// prevote quorum.
+	assert.False(t, peers[0].runPreVotePhase(peers[0].NextBallot()))
+	assert.True(t, peers[1].runPreVotePhase(peers[1].NextBallot()))
+
+	// peer 0 hands leadership on until it lands on peer 1.
+	peers[0].BecomeLeader(peers[0].NextBallot(), logs[0].LastIndex())
+	for _, peer := range peers {
+		peer.StartPrepareThread()
+		peer.StartCommitThread()
+		peer.StartHeartbeatThread()
+	}
+	assert.Eventually(t, func() bool {
+		return IsLeaderByPeer(peers[1])
+	}, 5*time.Second, 10*time.Millisecond)
+	r := peers[1].Replicate(&pb.Command{}, 0)
+	assert.Equal(t, Ok, r.Type)
+	assert.True(t, IsLeaderByPeer(peers[1]))
+}
+
+func TestHeartbeatPrefersLeader(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+	for _, peer := range peers {
+		peer.priorities = []int64{0, 2, 0}
+		peer.StartRPCServer()
+	}
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+
+	// no commit round runs, so only heartbeat responses show that peer 1 is
+	// caught up. Peer 1 runs no election of its own, so the request to take
+	// over can only come from peer 0.
+	assert.Eventually(t, func() bool {
+		peers[0].runHeartbeatPhase(ballot, 0, peers[0].rpcTimeout)
+		return len(peers[1].electNow) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestPriorityBehindSnapshot(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+	peers[0].StartRPCServer()
+	peers[1].StartRPCServer()
+	for _, peer := range peers {
+		peer.priorities = []int64{0, 2, 0}
+	}
+	// peer 0 trimmed an instance that peer 1 never executed.
+	logs[0].SetSnapshotInterval(1)
+	logs[0].Append(util.MakeInstanceWithState(&pb.Ballot{}, 1,
+		pb.InstanceState_COMMITTED))
+	logs[0].Execute()
+
+	// peer 1 cannot lead and peer 2 is down, so peer 1 takes part in an
+	// election of peer 0 although it outranks it.
+	_, log := peers[1].RunPreparePhase(peers[1].NextBallot())
+	assert.Nil(t, log)
+	assert.True(t, peers[0].runPreVotePhase(peers[0].NextBallot()))
+}
+
+func TestPhasesWithDeadPeers(t *testing.T) {
+	initPeers()
+	peers[0].StartRPCServer()
+	defer peers[0].StopRPCServer()
+	peers[1].StartRPCServer()
+	// peer 2 takes connections but never answers on them.
+	listener, err := net.Listen("tcp", configs[2].Peers[2])
+	assert.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				break
+			}
+			conns = append(conns, conn)
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	peers[0].rpcTimeout = 200
+	peers[0].rpcRetries = 1
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+
+	r := peers[0].RunAcceptPhase(ballot, logs[0].AdvanceLastIndex(),
+		&pb.Command{}, 0)
+	assert.Equal(t, Ok, r.Type)
+
+	start := time.Now()
+	assert.EqualValues(t, 0, peers[0].RunCommitPhase(ballot, 0))
+	assert.Less(t, time.Since(start), time.Second)
+
+	// peer 1 hangs on the prepare request and is then killed, so the prepare
+	// phase gives up after the retries.
+	peers[1].mu.Lock()
+	defer peers[1].mu.Unlock()
+	time.AfterFunc(100*time.Millisecond, peers[1].mux.server.Stop)
+	_, log := peers[0].RunPreparePhase(peers[0].NextBallot())
+	assert.Nil(t, log)
+	assert.True(t, IsLeaderByPeer(peers[0]))
+
+	r = peers[0].RunAcceptPhase(ballot, logs[0].AdvanceLastIndex(),
+		&pb.Command{}, 0)
+	assert.Equal(t, Retry, r.Type)
+	assert.False(t, peers[0].confirmLeadership(ballot))
+}
+
+func TestAcceptRetriedAfterTimeout(t *testing.T) {
+	initPeers()
+	peers[0].StartRPCServer()
+	defer peers[0].StopRPCServer()
+	Connect(peers[0], configs[0].Peers)
+	peers[0].rpcTimeout = 100
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+
+	// no follower answers the accept in time, so it is run again until one
+	// does instead of leaving its index unchosen.
+	put := &pb.Command{Type: pb.CommandType_PUT, Key: "foo", Value: "bar"}
+	result := peers[0].ReplicateAsync(put, 0)
+	select {
+	case <-result:
+		t.Fatal("accept finished without a quorum")
+	case <-time.After(300 * time.Millisecond):
+	}
+	peers[1].StartRPCServer()
+	defer peers[1].StopRPCServer()
+	assert.Equal(t, Ok, (<-result).Type)
+
+	// and a later write executes after it.
+	put = &pb.Command{Type: pb.CommandType_PUT, Key: "foo", Value: "baz"}
+	assert.Equal(t, Ok, peers[0].Replicate(put, 0).Type)
+	logs[0].Execute()
+	logs[0].Execute()
+	assert.Equal(t, "baz", *stores[0].Get("foo"))
+}
+
+func TestFailover(t *testing.T) {
+	initPeers()
+	for _, peer := range peers {
+		peer.Start()
+	}
+	assert.Eventually(t, func() bool {
+		leader := oneLeader()
+		return leader != -1 && leader != pb.NoLeader
+	}, 2*time.Second, 10*time.Millisecond)
+	leader := oneLeader()
+	defer func() {
+		for i, peer := range peers {
+			if int64(i) != leader {
+				peer.Stop()
+			}
+		}
+	}()
+
+	// no commit is due for seconds, but heartbeats keep the followers from
+	// electing another leader.
+	ballot := peers[leader].Ballot()
+	time.Sleep(time.Second)
+	for _, peer := range peers {
+		assert.True(t, ballot.Equal(peer.Ballot()))
+	}
+
+	peers[leader].Stop()
+	follower := (leader + 1) % NumPeers
+	assert.Eventually(t, func() bool {
+		newLeader := LeaderByPeer(peers[follower])
+		return newLeader != leader && newLeader != pb.NoLeader
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestQuorums(t *testing.T) {
+	q1, q2 := quorums(0, 0, 5)
+	assert.Equal(t, 3, q1)
+	assert.Equal(t, 3, q2)
+	q1, q2 = quorums(0, 2, 5)
+	assert.Equal(t, 4, q1)
+	assert.Equal(t, 2, q2)
+	q1, q2 = quorums(4, 0, 5)
+	assert.Equal(t, 4, q1)
+	assert.Equal(t, 2, q2)
+
+	p := Multipaxos{prepareQuorum: 2, acceptQuorum: 2}
+	assert.True(t, p.validQuorums(3, 3))
+	assert.False(t, p.validQuorums(4, 4))
+	assert.False(t, p.validQuorums(3, 4))
+	p = Multipaxos{prepareQuorum: 3, acceptQuorum: 2}
+	assert.True(t, p.validQuorums(4, 4))
+	assert.False(t, p.validQuorums(3, 2))
+	p = Multipaxos{acceptQuorum: 1}
+	assert.True(t, p.validQuorums(3, 3))
+	// a value only the leader accepted is lost if either change leaves it out.
+	assert.False(t, p.validQuorums(3, 4))
+	assert.False(t, p.validQuorums(4, 3))
+}
+
+func TestFlexibleQuorums(t *testing.T) {
+	initPeers()
+	peers[0].prepareQuorum = 3
+	peers[0].acceptQuorum = 1
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+
+	// the leader makes an accept quorum on its own.
+	index := logs[0].AdvanceLastIndex()
+	r := peers[0].RunAcceptPhase(ballot, index, &pb.Command{}, 0)
+	assert.Equal(t, Ok, r.Type)
+	assert.True(t, log.IsCommitted(logs[0].At(index)))
+
+	// but a prepare phase needs every peer.
+	peers[1].StartRPCServer()
+	defer peers[1].StopRPCServer()
+	peers[2].StartRPCServer()
+	nextBallot := peers[0].NextBallot()
+	_, instances := peers[0].RunPreparePhase(nextBallot)
+	assert.NotNil(t, instances)
+	peers[2].StopRPCServer()
+	_, instances = peers[0].RunPreparePhase(&pb.Ballot{
+		Round: nextBallot.GetRound() + 1, Id: nextBallot.GetId()})
+	assert.Nil(t, instances)
+}
+
+func TestLearner(t *testing.T) {
+	for i := int64(0); i < NumPeers; i++ {
+		configs[i] = config.DefaultConfig(i, NumPeers)
+		configs[i].Learners = configs[i].Peers[NumPeers-1:]
+		configs[i].Peers = configs[i].Peers[:NumPeers-1]
+		stores[i] = kvstore.NewMemKVStore()
+		logs[i] = log.NewLog(stores[i], nil)
+		peers[i] = NewMultipaxos(logs[i], configs[i])
+	}
+	assert.False(t, peers[0].IsLearner())
+	assert.True(t, peers[2].IsLearner())
+	peers[1].StartRPCServer()
+	peers[2].StartRPCServer()
+	defer peers[2].StopRPCServer()
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+
+	index1 := logs[0].AdvanceLastIndex()
+	command := &pb.Command{Type: pb.CommandType_PUT, Key: "foo", Value: "bar"}
+	r := peers[0].RunAcceptPhase(ballot, index1, command, 0)
+	assert.Equal(t, Ok, r.Type)
+
+	// the learner accepts but does not count toward the quorum.
+	peers[1].StopRPCServer()
+	index2 := logs[0].AdvanceLastIndex()
+	r = peers[0].RunAcceptPhase(ballot, index2, &pb.Command{}, 0)
+	assert.Equal(t, Retry, r.Type)
+	assert.Eventually(t, func() bool { return logs[2].At(index2) != nil },
+		time.Second, 10*time.Millisecond)
+
+	// and executes what is committed into its own store.
+	logs[0].Execute()
+	peers[0].RunCommitPhase(ballot, 0)
+	assert.Eventually(t, func() bool {
+		return log.IsCommitted(logs[2].At(index1))
+	}, time.Second, 10*time.Millisecond)
+	assert.EqualValues(t, 0, peers[2].trimIndex(index1))
+	logs[2].Execute()
+	assert.Equal(t, "bar", *stores[2].Get("foo"))
+	assert.EqualValues(t, index1, peers[2].trimIndex(index1))
+}
+
+func TestLearnerJoinsLate(t *testing.T) {
+	for i := int64(0); i < NumPeers; i++ {
+		configs[i] = config.DefaultConfig(i, NumPeers)
+		configs[i].Learners = configs[i].Peers[NumPeers-1:]
+		configs[i].Peers = configs[i].Peers[:NumPeers-1]
+		stores[i] = kvstore.NewMemKVStore()
+		logs[i] = log.NewLog(stores[i], nil)
+		peers[i] = NewMultipaxos(logs[i], configs[i])
+	}
+	peers[1].StartRPCServer()
+	defer peers[1].StopRPCServer()
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+
+	// the leader trims what the learner never saw.
+	const (
+		index1 int64 = iota + 1
+		index2
+	)
+	logs[0].SetSnapshotInterval(index2)
+	for _, index := range []int64{index1, index2} {
+		instance := util.MakeInstanceWithAll(ballot, index,
+			pb.InstanceState_COMMITTED, pb.CommandType_PUT)
+		instance.Command.Key = "foo"
+		logs[0].Append(instance)
+		logs[0].Execute()
+	}
+	assert.Nil(t, logs[0].At(index1))
+
+	// so the learner that comes up later gets the snapshot.
+	peers[2].StartRPCServer()
+	defer peers[2].StopRPCServer()
+	assert.Eventually(t, func() bool {
+		peers[0].RunCommitPhase(ballot, 0)
+		return logs[2].LastExecuted() == index2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NotNil(t, stores[2].Get("foo"))
+}
+
+func TestWitness(t *testing.T) {
+	for i := int64(0); i < NumPeers; i++ {
+		configs[i] = config.DefaultConfig(i, NumPeers)
+		configs[i].Witnesses = []int64{0, 1}
+		stores[i] = kvstore.NewMemKVStore()
+		logs[i] = log.NewLog(stores[i], nil)
+		peers[i] = NewMultipaxos(logs[i], configs[i])
+	}
+	defer tearDown()
+	assert.True(t, peers[0].IsWitness())
+	assert.False(t, peers[2].IsWitness())
+	peers[0].BecomeLeader(peers[0].NextBallot(), logs[0].LastIndex())
+	for _, peer := range peers {
+		peer.Start()
+	}
+
+	// a witness leader does not serve clients.
+	r := peers[0].Replicate(&pb.Command{}, 0)
+	assert.Equal(t, Retry, r.Type)
+	_, ok := peers[0].Read(&pb.Command{Type: pb.CommandType_GET})
+	assert.False(t, ok)
+
+	// and hands leadership to a full replica, never to another witness.
+	r = peers[0].TransferLeadership(1)
+	assert.Equal(t, Retry, r.Type)
+	assert.True(t, peers[0].handOff())
+	assert.Eventually(t, func() bool {
+		return IsLeaderByPeer(peers[2])
+	}, time.Second, 10*time.Millisecond)
+	r = peers[2].Replicate(&pb.Command{}, 0)
+	assert.Equal(t, Ok, r.Type)
+}
+
+func TestGroups(t *testing.T) {
+	initPeers()
+	defer tearDown()
+	groupLogs := make([]*log.Log, NumPeers)
+	groups := make([]*Multipaxos, NumPeers)
+	for i := int64(0); i < NumPeers; i++ {
+		groupLogs[i] = log.NewLog(kvstore.NewMemKVStore(), nil)
+		groups[i] = NewGroupMultipaxos(groupLogs[i], configs[i], 1,
+			peers[i].mux)
+	}
+	defer func() {
+		for _, group := range groups {
+			group.Stop()
+		}
+	}()
+	// both groups on a peer share its connections and its rpc server.
+	assert.Equal(t, 2, peers[0].mux.conns[configs[0].Peers[1]].refs)
+	for i := range peers {
+		peers[i].StartRPCServer()
+		groups[i].StartRPCServer()
+	}
+
+	// each group elects its own leader.
+	peers[0].BecomeLeader(peers[0].NextBallot(), logs[0].LastIndex())
+	groups[1].BecomeLeader(groups[1].NextBallot(), groupLogs[1].LastIndex())
+	for _, peer := range append(peers, groups...) {
+		peer.StartPrepareThread()
+		peer.StartCommitThread()
+		peer.StartHeartbeatThread()
+	}
+	assert.Eventually(t, func() bool {
+		return LeaderByPeer(peers[2]) == 0 && LeaderByPeer(groups[2]) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// and keeps its own log.
+	put := func(value string) *pb.Command {
+		return &pb.Command{Type: pb.CommandType_PUT, Key: "foo", Value: value}
+	}
+	accepted := func(l *log.Log, index int64, value string) func() bool {
+		return func() bool {
+			return l.At(index).GetCommand().GetValue() == value
+		}
+	}
+	assert.Equal(t, Ok, peers[0].Replicate(put("bar"), 0).Type)
+	assert.Equal(t, Ok, groups[1].Replicate(put("baz"), 0).Type)
+	assert.Eventually(t, accepted(logs[2], logs[0].LastIndex(), "bar"),
+		time.Second, 10*time.Millisecond)
+	assert.Eventually(t, accepted(groupLogs[2], groupLogs[1].LastIndex(),
+		"baz"), time.Second, 10*time.Millisecond)
+	assert.Equal(t, SomeElseLeader, groups[0].Replicate(put("qux"), 0).Type)
+}
+
 func TestReplicate(t *testing.T) {
 	initPeers()
 	defer tearDown()
@@ -0,0 +1,218 @@
+package multipaxos
+
+import (
+	"context"
+	logger "github.com/sirupsen/logrus"
+	pb "github.com/sosp23/replicated-store/go/multipaxos/comm"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// A peer may host several consensus groups, each with its own log, ballot and
+// leader. The groups on a peer share a Mux, which keeps one connection to
+// every other peer and one rpc server for all of them. Every rpc carries the
+// group it is for in its metadata, and the server hands it to the same group
+// on the receiving peer. An rpc without one is for group 0.
+
+const groupKey = "group"
+
+type Mux struct {
+	mu      sync.RWMutex
+	conns   map[string]*muxConn
+	groups  map[int64]*Multipaxos
+	server  *grpc.Server
+	serving map[int64]bool
+
+	pb.UnimplementedMultiPaxosRPCServer
+}
+
+type muxConn struct {
+	peer *RpcPeer
+	refs int
+}
+
+func NewMux() *Mux {
+	return &Mux{
+		conns:   make(map[string]*muxConn),
+		groups:  make(map[int64]*Multipaxos),
+		serving: make(map[int64]bool),
+	}
+}
+
+// Group returns consensus group id on this peer.
+func (m *Mux) Group(id int64) (*Multipaxos, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	p, ok := m.groups[id]
+	return p, ok
+}
+
+func (m *Mux) add(p *Multipaxos) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.groups[p.group]; ok {
+		logger.Panicf("group %v already exists", p.group)
+	}
+	m.groups[p.group] = p
+}
+
+// dial returns a stub for peer id at addr, connecting to addr with the
+// timeouts of group p if no group uses it yet.
+func (m *Mux) dial(p *Multipaxos, id int64, addr string) *RpcPeer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.conns[addr]
+	if !ok {
+		c = &muxConn{peer: DialRpcPeer(id, addr, p.rpcTimeout, p.rpcBackoff,
+			p.heartbeatInterval)}
+		m.conns[addr] = c
+	}
+	c.refs += 1
+	peer := NewRpcPeer(id, c.peer.Stub)
+	peer.Addr = addr
+	return peer
+}
+
+// hangUp closes the connection to peer once no group uses it anymore.
+func (m *Mux) hangUp(peer *RpcPeer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.conns[peer.Addr]
+	if !ok {
+		return
+	}
+	c.refs -= 1
+	if c.refs == 0 {
+		c.peer.Close()
+		delete(m.conns, peer.Addr)
+	}
+}
+
+// serve starts the rpc server at port for group unless another group started
+// it.
+func (m *Mux) serve(group int64, port string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.serving[group] = true
+	if len(m.serving) > 1 || m.server != nil {
+		return
+	}
+	listener, err := net.Listen("tcp", port)
+	if err != nil {
+		panic(err)
+	}
+	m.server = grpc.NewServer()
+	pb.RegisterMultiPaxosRPCServer(m.server, m)
+	go m.server.Serve(listener)
+}
+
+// stopServing stops the rpc server once no group serves on it anymore.
+func (m *Mux) stopServing(group int64) {
+	m.mu.Lock()
+	delete(m.serving, group)
+	server := m.server
+	if len(m.serving) > 0 || server == nil {
+		m.mu.Unlock()
+		return
+	}
+	m.server = nil
+	m.mu.Unlock()
+	server.GracefulStop()
+}
+
+// withGroup tags the rpcs made with ctx as being for group.
+func withGroup(ctx context.Context, group int64) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, groupKey,
+		strconv.FormatInt(group, 10))
+}
+
+// route returns the group an incoming rpc with ctx is for.
+func (m *Mux) route(ctx context.Context) (*Multipaxos, error) {
+	var group int64
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(groupKey); len(values) > 0 {
+			group, _ = strconv.ParseInt(values[0], 10, 64)
+		}
+	}
+	if p, ok := m.Group(group); ok {
+		return p, nil
+	}
+	return nil, status.Errorf(codes.NotFound, "no group %v", group)
+}
+
+func (m *Mux) Accept(ctx context.Context,
+	request *pb.AcceptRequest) (*pb.AcceptResponse, error) {
+	p, err := m.route(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.Accept(ctx, request)
+}
+
+func (m *Mux) Prepare(ctx context.Context,
+	request *pb.PrepareRequest) (*pb.PrepareResponse, error) {
+	p, err := m.route(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.Prepare(ctx, request)
+}
+
+func (m *Mux) Commit(ctx context.Context,
+	request *pb.CommitRequest) (*pb.CommitResponse, error) {
+	p, err := m.route(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.Commit(ctx, request)
+}
+
+func (m *Mux) InstallSnapshot(
+	stream pb.MultiPaxosRPC_InstallSnapshotServer) error {
+	p, err := m.route(stream.Context())
+	if err != nil {
+		return err
+	}
+	return p.InstallSnapshot(stream)
+}
+
+func (m *Mux) TimeoutNow(ctx context.Context,
+	request *pb.TimeoutNowRequest) (*pb.TimeoutNowResponse, error) {
+	p, err := m.route(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.TimeoutNow(ctx, request)
+}
+
+func (m *Mux) Heartbeat(ctx context.Context,
+	request *pb.HeartbeatRequest) (*pb.HeartbeatResponse, error) {
+	p, err := m.route(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.Heartbeat(ctx, request)
+}
+
+func (m *Mux) PreVote(ctx context.Context,
+	request *pb.PreVoteRequest) (*pb.PreVoteResponse, error) {
+	p, err := m.route(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.PreVote(ctx, request)
+}
+
+func (m *Mux) CatchUp(ctx context.Context,
+	request *pb.CatchUpRequest) (*pb.CatchUpResponse, error) {
+	p, err := m.route(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.CatchUp(ctx, request)
+}
@@ -0,0 +1,101 @@
+package multipaxos
+
+import (
+	"context"
+	logger "github.com/sirupsen/logrus"
+	pb "github.com/sosp23/replicated-store/go/multipaxos/comm"
+	"sync/atomic"
+	"time"
+)
+
+// A peer whose election timer fires first asks the others whether they would
+// take part in an election, and only runs a prepare phase if a quorum agrees.
+// A peer agrees only if it has not heard from a leader within the minimum
+// election timeout itself. The probe changes no state on either side, so a
+// peer that was cut off from a healthy leader cannot force the leader out by
+// raising its ballot when it comes back.
+
+// leaderAlive reports whether this peer leads or heard from a leader within
+// the minimum election timeout.
+func (p *Multipaxos) leaderAlive() bool {
+	if IsLeader(p.Ballot(), p.id) {
+		return true
+	}
+	lastContact := atomic.LoadInt64(&p.lastContact)
+	timeout := time.Duration(p.electionTimeoutMin) * time.Millisecond
+	return lastContact != 0 && time.Since(time.Unix(0, lastContact)) < timeout
+}
+
+// runPreVotePhase reports whether a quorum would take part in a prepare phase
+// for ballot.
+func (p *Multipaxos) runPreVotePhase(ballot *pb.Ballot) bool {
+	peers := p.currentPeers()
+	quorum := p.prepareQuorumOf(len(peers))
+	state := NewAcceptState()
+	request := pb.PreVoteRequest{
+		Ballot: ballot,
+		Sender: p.id,
+	}
+	state.NumRpcs++
+	state.NumOks++
+
+	for _, peer := range peers {
+		if peer.Id == p.id {
+			continue
+		}
+		go func(peer *RpcPeer) {
+			logger.Infof("%v sent prevote request to %v", p.id, peer.Id)
+			var response *pb.PreVoteResponse
+			err := p.call(p.rpcRetries, p.rpcTimeout,
+				func(ctx context.Context) (err error) {
+					response, err = peer.Stub.PreVote(ctx, &request)
+					return err
+				})
+
+			state.Mu.Lock()
+			defer state.Mu.Unlock()
+
+			state.NumRpcs += 1
+			if err == nil {
+				// a peer that still hears from the leader says no, but the
+				// others may agree, so a rejection does not end the phase.
+				if response.GetType() == pb.ResponseType_OK {
+					state.NumOks += 1
+				} else {
+					// catch up with a higher ballot, or the next probe fails
+					// too.
+					p.BecomeFollower(response.GetBallot())
+				}
+			}
+			state.Cv.Signal()
+		}(peer)
+	}
+
+	state.Mu.Lock()
+	defer state.Mu.Unlock()
+	for state.NumOks < quorum && state.NumRpcs != len(peers) {
+		state.Cv.Wait()
+	}
+	if state.NumOks < quorum {
+		logger.Infof("%v lost the prevote for %v", p.id, ballot)
+		return false
+	}
+	return true
+}
+
+// PreVote tells a peer whose election timer fired whether this peer would
+// take part in a prepare phase for the ballot in the request.
+func (p *Multipaxos) PreVote(ctx context.Context,
+	request *pb.PreVoteRequest) (*pb.PreVoteResponse, error) {
+	logger.Infof("%v <--prevote-- %v", p.id, request.GetSender())
+	response := &pb.PreVoteResponse{}
+	if p.Ballot().Less(request.GetBallot()) &&
+		p.isMember(request.GetSender()) && !p.leaderAlive() &&
+		!p.outranks(request.GetSender()) {
+		response.Type = pb.ResponseType_OK
+	} else {
+		response.Type = pb.ResponseType_REJECT
+	}
+	response.Ballot = p.Ballot()
+	return response, nil
+}
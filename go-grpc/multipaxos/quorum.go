@@ -0,0 +1,47 @@
+package multipaxos
+
+// A prepare phase needs prepareQuorum acknowledgements and an accept phase
+// acceptQuorum, this peer's own included. Every prepare quorum intersects every
+// accept quorum as long as the two sizes add up to more than the number of
+// peers, so writes can wait on a small accept quorum at the cost of a large
+// prepare quorum, which is only needed on a leader change. A size left unset is
+// the smallest that intersects the other; with neither set, both are
+// majorities. Leases and read index rounds also wait on an accept quorum, since
+// it intersects every prepare quorum that could elect another leader.
+
+func quorums(prepareQuorum int64, acceptQuorum int64, n int) (int, int) {
+	q1, q2 := int(prepareQuorum), int(acceptQuorum)
+	switch {
+	case q1 <= 0 && q2 <= 0:
+		q1, q2 = n/2+1, n/2+1
+	case q1 <= 0:
+		q1 = n - q2 + 1
+	case q2 <= 0:
+		q2 = n - q1 + 1
+	}
+	return q1, q2
+}
+
+func (p *Multipaxos) prepareQuorumOf(n int) int {
+	q1, _ := quorums(p.prepareQuorum, p.acceptQuorum, n)
+	return q1
+}
+
+func (p *Multipaxos) acceptQuorumOf(n int) int {
+	_, q2 := quorums(p.prepareQuorum, p.acceptQuorum, n)
+	return q2
+}
+
+// validQuorums reports whether the quorums stay reachable and every prepare
+// quorum intersects every accept quorum while the peer set changes from oldN
+// to newN peers, with quorums of either set drawn from all of them.
+func (p *Multipaxos) validQuorums(oldN int, newN int) bool {
+	oldQ1, oldQ2 := quorums(p.prepareQuorum, p.acceptQuorum, oldN)
+	newQ1, newQ2 := quorums(p.prepareQuorum, p.acceptQuorum, newN)
+	n := oldN
+	if newN > n {
+		n = newN
+	}
+	return newQ1 >= 1 && newQ1 <= newN && newQ2 >= 1 && newQ2 <= newN &&
+		newQ1+newQ2 > newN && oldQ1+newQ2 > n && newQ1+oldQ2 > n
+}
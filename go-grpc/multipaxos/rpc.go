@@ -0,0 +1,37 @@
+package multipaxos
+
+import (
+	"context"
+	logger "github.com/sirupsen/logrus"
+	"time"
+)
+
+// Every rpc to a peer has a deadline of rpcTimeout and is issued again up to
+// rpcRetries times, rpcBackoff after the first failure and twice as long after
+// each one after it. A phase counts a peer whose rpc failed as a failure and
+// returns Retry once a quorum cannot be reached, instead of waiting on that
+// peer. An accept phase is then run again, since its index is already in the
+// log.
+
+// call runs rpc with a deadline of timeout milliseconds per attempt and
+// returns the error of the last attempt.
+func (p *Multipaxos) call(retries int64, timeout int64,
+	rpc func(ctx context.Context) error) error {
+	backoff := time.Duration(p.rpcBackoff) * time.Millisecond
+	for attempt := int64(0); ; attempt++ {
+		ctx, cancel := context.WithTimeout(withGroup(context.Background(),
+			p.group), time.Duration(timeout)*time.Millisecond)
+		err := rpc(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if attempt == retries {
+			logger.Infof("%v rpc failed after %v attempts: %v", p.id,
+				attempt+1, err)
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -2,18 +2,38 @@ package multipaxos
 
 import (
 	pb "github.com/sosp23/replicated-store/go/multipaxos/comm"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/credentials/insecure"
 	"sync"
+	"time"
 )
 
 const (
-	IdBits               = 0xff
-	RoundIncrement       = IdBits + 1
-	MaxNumPeers    int64 = 0xf
+	MaxNumPeers               int64 = 1 << 16
+	SnapshotChunkSize               = 1 << 20
+	NoopClientId              int64 = -1
+	DefaultReplayWindow             = 64
+	DefaultAcceptWindow             = 256
+	DefaultRpcTimeout               = 1000
+	DefaultRpcBackoff               = 50
+	DefaultHeartbeatInterval        = 100
+	DefaultElectionTimeoutMin       = 300
+	DefaultCatchUpBatchSize         = 64
+	DefaultCatchUpInterval          = 10
+)
+
+const (
+	ReadModeLog       = "log"
+	ReadModeLease     = "lease"
+	ReadModeReadIndex = "read_index"
 )
 
 type RpcPeer struct {
 	Id   int64
+	Addr string
 	Stub pb.MultiPaxosRPCClient
+	conn *grpc.ClientConn
 }
 
 func NewRpcPeer(id int64, stub pb.MultiPaxosRPCClient) *RpcPeer {
@@ -24,6 +44,41 @@ func NewRpcPeer(id int64, stub pb.MultiPaxosRPCClient) *RpcPeer {
 	return peer
 }
 
+// DialRpcPeer connects to peer id at addr. The timeout, backoff and heartbeat
+// interval are the group's, in milliseconds.
+func DialRpcPeer(id int64, addr string, rpcTimeout int64, rpcBackoff int64,
+	heartbeatInterval int64) *RpcPeer {
+	var opts []grpc.DialOption
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	// a leader gives up after an election timeout without a quorum, so a link
+	// to a peer that was down must not wait out the default backoff of up to
+	// two minutes once the peer is back. The heartbeat interval is below the
+	// election timeout.
+	opts = append(opts, grpc.WithConnectParams(grpc.ConnectParams{
+		Backoff: backoff.Config{
+			BaseDelay:  time.Duration(rpcBackoff) * time.Millisecond,
+			Multiplier: backoff.DefaultConfig.Multiplier,
+			Jitter:     backoff.DefaultConfig.Jitter,
+			MaxDelay:   time.Duration(heartbeatInterval) * time.Millisecond,
+		},
+		MinConnectTimeout: time.Duration(rpcTimeout) * time.Millisecond,
+	}))
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		panic("dial error")
+	}
+	peer := NewRpcPeer(id, pb.NewMultiPaxosRPCClient(conn))
+	peer.Addr = addr
+	peer.conn = conn
+	return peer
+}
+
+func (peer *RpcPeer) Close() {
+	if peer.conn != nil {
+		peer.conn.Close()
+	}
+}
+
 type ResultType int
 
 const (
@@ -37,25 +92,32 @@ type Result struct {
 	Leader int64
 }
 
-func ExtractLeaderId(ballot int64) int64 {
-	return ballot & IdBits
+type batchEntry struct {
+	command  *pb.Command
+	clientId int64
+	result   chan Result
+}
+
+func ExtractLeaderId(ballot *pb.Ballot) int64 {
+	return ballot.GetId()
 }
 
-func IsLeader(ballot int64, id int64) bool {
+func IsLeader(ballot *pb.Ballot, id int64) bool {
 	return ExtractLeaderId(ballot) == id
 }
 
-func IsSomeoneElseLeader(ballot int64, id int64) bool {
-	return !IsLeader(ballot, id) && ExtractLeaderId(ballot) < MaxNumPeers
+func IsSomeoneElseLeader(ballot *pb.Ballot, id int64) bool {
+	return !IsLeader(ballot, id) && ExtractLeaderId(ballot) != pb.NoLeader
 }
 
 type PrepareState struct {
-	NumRpcs      int
-	NumOks       int
-	MaxLastIndex int64
-	Log          map[int64]*pb.Instance
-	Mu           sync.Mutex
-	Cv           *sync.Cond
+	NumRpcs              int
+	NumOks               int
+	MaxLastIndex         int64
+	MaxLastIncludedIndex int64
+	Log                  map[int64]*pb.Instance
+	Mu                   sync.Mutex
+	Cv                   *sync.Cond
 }
 
 func NewPrepareState() *PrepareState {
@@ -2,10 +2,13 @@ package replicant
 
 import (
 	"bufio"
+	"github.com/sosp23/replicated-store/go/kvstore"
 	"github.com/sosp23/replicated-store/go/multipaxos"
 	pb "github.com/sosp23/replicated-store/go/multipaxos/comm"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 type Client struct {
@@ -13,19 +16,30 @@ type Client struct {
 	reader     *bufio.Reader
 	writer     *bufio.Writer
 	socket     net.Conn
-	multipaxos *multipaxos.Multipaxos
+	groups     *Groups
 	manager    *ClientManager
+	writerLock sync.Mutex
+	pending    chan *pendingRequest
+	done       chan struct{}
+
+	upstreamMu      sync.Mutex
+	upstream        net.Conn
+	upstreamReader  *bufio.Reader
+	upstreamLeader  int64
+	upstreamStopped bool
 }
 
-func NewClient(id int64, conn net.Conn, mp *multipaxos.Multipaxos,
+func NewClient(id int64, conn net.Conn, groups *Groups,
 	manger *ClientManager) *Client {
 	client := &Client{
-		id:         id,
-		reader:     bufio.NewReader(conn),
-		writer:     bufio.NewWriter(conn),
-		socket:     conn,
-		multipaxos: mp,
-		manager:    manger,
+		id:      id,
+		reader:  bufio.NewReader(conn),
+		writer:  bufio.NewWriter(conn),
+		socket:  conn,
+		groups:  groups,
+		manager: manger,
+		pending: make(chan *pendingRequest, maxPendingRequests),
+		done:    make(chan struct{}),
 	}
 	return client
 }
@@ -37,6 +51,10 @@ func (c *Client) Parse(request string) *pb.Command {
 	}
 	commandType := substrings[0]
 	key := substrings[1]
+	if kvstore.IsReserved(key) {
+		// clients cannot name the keys the store keeps for itself.
+		return nil
+	}
 
 	command := &pb.Command{Key: key}
 
@@ -50,6 +68,34 @@ func (c *Client) Parse(request string) *pb.Command {
 		}
 		command.Type = pb.CommandType_PUT
 		command.Value = substrings[2]
+	} else if commandType == "addpeer" {
+		if len(substrings) != 3 || !isPeerId(key) {
+			return nil
+		}
+		command.Type = pb.CommandType_ADD_PEER
+		command.Value = substrings[2]
+	} else if commandType == "removepeer" {
+		if len(substrings) != 2 || !isPeerId(key) {
+			return nil
+		}
+		command.Type = pb.CommandType_REMOVE_PEER
+	} else if commandType == "setshards" {
+		if len(substrings) != 2 {
+			return nil
+		}
+		command.Type = pb.CommandType_SET_SHARDS
+		command.Key = ""
+		command.Value = key
+	} else if commandType == "reshard" {
+		command.Type = pb.CommandType_RESHARD
+		command.Key = ""
+		command.Value = key
+		if len(substrings) == 3 {
+			command.Commands = parseKeys(substrings[2])
+			if command.Commands == nil {
+				return nil
+			}
+		}
 	} else {
 		return nil
 	}
@@ -57,11 +103,17 @@ func (c *Client) Parse(request string) *pb.Command {
 }
 
 func (c *Client) Start() {
+	go c.replyTask()
 	go c.Read()
 }
 
 func (c *Client) Stop() {
 	c.socket.Close()
+	close(c.done)
+	c.upstreamMu.Lock()
+	c.upstreamStopped = true
+	c.closeUpstream()
+	c.upstreamMu.Unlock()
 }
 
 func (c *Client) Read() {
@@ -72,27 +124,129 @@ func (c *Client) Read() {
 			return
 		}
 
-		command := c.Parse(request)
+		forwarded := strings.HasPrefix(request, forwardPrefix)
+		request = strings.TrimPrefix(request, forwardPrefix)
+		group, line, ok := parseGroup(request)
+		mp, found := c.groups.Get(group)
+		if !ok || !found {
+			c.respond("bad command")
+			continue
+		}
+		if id, ok := parseTransfer(line); ok {
+			r := c.newRequest(mp, request, forwarded)
+			c.await(r, c.transfer(mp, id, r.id))
+			continue
+		}
+		if strings.TrimSpace(line) == "shards" {
+			// the directory is read through group 0 like any other get.
+			mp, _ = c.groups.Get(0)
+			command := &pb.Command{Type: pb.CommandType_GET,
+				Key: kvstore.DirectoryKey}
+			if result, ok := mp.Read(command); ok {
+				c.respond(result.Value)
+				continue
+			}
+			r := c.newRequest(mp, request, forwarded)
+			c.await(r, mp.ReplicateAsync(command, r.id))
+			continue
+		}
+		if change, ok := parseReshard(line); ok {
+			r := c.newRequest(mp, request, forwarded)
+			c.await(r, c.reshard(change, r.id))
+			continue
+		}
+		command := c.Parse(line)
 		if command != nil {
-			result := c.multipaxos.Replicate(command, c.id)
-			if result.Type == multipaxos.Ok {
+			if command.Type == pb.CommandType_ADD_PEER ||
+				command.Type == pb.CommandType_REMOVE_PEER {
+				r := c.newRequest(mp, request, forwarded)
+				c.await(r, c.reconfigure(mp, command, r.id))
+				continue
+			}
+			if command.Type == pb.CommandType_SET_SHARDS ||
+				command.Type == pb.CommandType_RESHARD {
+				r := c.newRequest(mp, request, forwarded)
+				c.await(r, mp.ReplicateAsync(command, r.id))
 				continue
 			}
-			if result.Type == multipaxos.Retry {
-				c.Write("retry")
-			} else {
-				if result.Type != multipaxos.SomeElseLeader {
-					panic("Result is not someone_else_leader")
-				}
-				c.Write("leader is ...")
+			if line != request {
+				// the key picks the group of a get, put or delete.
+				c.respond("bad command")
+				continue
 			}
+			mp = c.groups.ForKey(command.Key)
+			if result, ok := mp.Read(command); ok {
+				c.respond(result.Value)
+				continue
+			}
+			// blocks while the accept window is full, which stops reading
+			// from this client until earlier commands finish.
+			r := c.newRequest(mp, request, forwarded)
+			c.await(r, mp.ReplicateAsync(command, r.id))
 		} else {
-			c.Write("bad command")
+			c.respond("bad command")
 		}
 	}
 }
 
+// reconfigure runs an addpeer or removepeer command, which is replicated
+// through the log but waits for the change to take effect.
+func (c *Client) reconfigure(mp *multipaxos.Multipaxos, command *pb.Command,
+	requestId int64) <-chan multipaxos.Result {
+	result := make(chan multipaxos.Result, 1)
+	id, _ := strconv.ParseInt(command.Key, 10, 64)
+	go func() {
+		if command.Type == pb.CommandType_ADD_PEER {
+			result <- mp.AddPeer(id, command.Value, requestId)
+		} else {
+			result <- mp.RemovePeer(id, requestId)
+		}
+	}()
+	return result
+}
+
+// transfer runs a transfer command, which moves leadership to peer id. It does
+// not go through the log, so it is answered here rather than by the executor.
+func (c *Client) transfer(mp *multipaxos.Multipaxos, id int64,
+	requestId int64) <-chan multipaxos.Result {
+	result := make(chan multipaxos.Result, 1)
+	go func() {
+		r := mp.TransferLeadership(id)
+		if r.Type == multipaxos.Ok {
+			c.manager.Respond(requestId, "")
+		}
+		result <- r
+	}()
+	return result
+}
+
+func parseTransfer(request string) (int64, bool) {
+	substrings := strings.Fields(request)
+	if len(substrings) != 2 || substrings[0] != "transfer" ||
+		!isPeerId(substrings[1]) {
+		return 0, false
+	}
+	id, _ := strconv.ParseInt(substrings[1], 10, 64)
+	return id, true
+}
+
+func (c *Client) leaderClientAddr(mp *multipaxos.Multipaxos,
+	leader int64) (string, bool) {
+	addr, ok := mp.Members()[leader]
+	if !ok {
+		return "", false
+	}
+	return clientAddr(addr), true
+}
+
+func isPeerId(key string) bool {
+	id, err := strconv.ParseInt(key, 10, 64)
+	return err == nil && id >= 0 && id < multipaxos.MaxNumPeers
+}
+
 func (c *Client) Write(response string) {
+	c.writerLock.Lock()
+	defer c.writerLock.Unlock()
 	_, err := c.writer.WriteString(response + "\n")
 	if err == nil {
 		c.writer.Flush()
@@ -1,28 +1,29 @@
 package replicant
 
 import (
-	"github.com/sosp23/replicated-store/go/multipaxos"
 	logger "github.com/sirupsen/logrus"
 	"net"
 	"sync"
 )
 
 type ClientManager struct {
-	nextId     int64
-	numPeers   int64
-	multipaxos *multipaxos.Multipaxos
-	mu         sync.Mutex
-	clients    map[int64]*Client
+	nextId   int64
+	numPeers int64
+	groups   *Groups
+	mu       sync.Mutex
+	clients  map[int64]*Client
+	requests map[int64]chan string
 }
 
 func NewClientManager(id int64,
-				      numPeers int64,
-	                  mp *multipaxos.Multipaxos) *ClientManager {
+	numPeers int64,
+	groups *Groups) *ClientManager {
 	cm := &ClientManager{
-		nextId:     id,
-		numPeers:   numPeers,
-		multipaxos: mp,
-		clients:    make(map[int64]*Client),
+		nextId:   id,
+		numPeers: numPeers,
+		groups:   groups,
+		clients:  make(map[int64]*Client),
+		requests: make(map[int64]chan string),
 	}
 	return cm
 }
@@ -34,10 +35,9 @@ func (cm *ClientManager) NextClientId() int64 {
 }
 
 func (cm *ClientManager) Start(socket net.Conn) {
-	id := cm.NextClientId()
-	client := NewClient(id, socket, cm.multipaxos, cm)
-
 	cm.mu.Lock()
+	id := cm.NextClientId()
+	client := NewClient(id, socket, cm.groups, cm)
 	cm.clients[id] = client
 	cm.mu.Unlock()
 	logger.Infof("client_manager started client %v\n", id)
@@ -54,6 +54,36 @@ func (cm *ClientManager) Get(id int64) *Client {
 	return client
 }
 
+// NewRequest returns an id for a request whose result is sent to reply. Like
+// client ids, request ids are unique across peers, since every peer executes
+// the request but only the one that has it registered answers it.
+func (cm *ClientManager) NewRequest(reply chan string) int64 {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	id := cm.NextClientId()
+	cm.requests[id] = reply
+	return id
+}
+
+// Respond sends response to the request with id unless it was answered
+// already, so that a request is answered by whatever finishes it first.
+func (cm *ClientManager) Respond(id int64, response string) {
+	cm.mu.Lock()
+	reply, ok := cm.requests[id]
+	delete(cm.requests, id)
+	cm.mu.Unlock()
+	if ok {
+		reply <- response
+	}
+}
+
+// Forget drops the request with id, which is not answered anymore.
+func (cm *ClientManager) Forget(id int64) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	delete(cm.requests, id)
+}
+
 func (cm *ClientManager) Stop(id int64) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
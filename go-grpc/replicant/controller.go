@@ -0,0 +1,167 @@
+package replicant
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/sosp23/replicated-store/go/multipaxos"
+	pb "github.com/sosp23/replicated-store/go/multipaxos/comm"
+	"github.com/sosp23/replicated-store/go/shard"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// "split <key> <group>" starts a new key range at key and hands it to group,
+// and "merge <key>" joins the range that starts at key to the one before it.
+// The words are separated by white space, so a split key cannot contain any.
+// The peer that gets either command acts as the controller. It commits the new
+// shard map to the directory in group 0 first, so that the moved keys are
+// routed to their new group from then on, and then moves them: every group
+// that gives keys up applies the map, which fences them off and returns them,
+// and every group that takes keys over applies it along with them. Meanwhile
+// the new group answers requests for the keys with "moved <version>", and
+// clients retry, looking the map up with "shards" if they route keys
+// themselves. Every step can be run again, so the controller first finishes
+// the move that made the current map, in case the one that started it failed,
+// and two controllers cannot both commit a map, since group 0 only takes the
+// version after its own.
+//
+// The controller sends each step as a request to the client port of its own
+// peer, which forwards it to the leader of the group.
+
+type controller struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func parseReshard(request string) (func(*shard.Map) (*shard.Map, bool),
+	bool) {
+	substrings := strings.Fields(request)
+	if len(substrings) == 3 && substrings[0] == "split" {
+		group, err := strconv.ParseInt(substrings[2], 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		return func(m *shard.Map) (*shard.Map, bool) {
+			return m.Split(substrings[1], group)
+		}, true
+	}
+	if len(substrings) == 2 && substrings[0] == "merge" {
+		return func(m *shard.Map) (*shard.Map, bool) {
+			return m.Merge(substrings[1])
+		}, true
+	}
+	return nil, false
+}
+
+// parseKeys turns the keys and values a group handed over into puts.
+func parseKeys(data string) []*pb.Command {
+	var keys map[string]string
+	if err := json.Unmarshal([]byte(data), &keys); err != nil {
+		return nil
+	}
+	commands := make([]*pb.Command, 0, len(keys))
+	for key, value := range keys {
+		commands = append(commands,
+			&pb.Command{Type: pb.CommandType_PUT, Key: key, Value: value})
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].Key < commands[j].Key
+	})
+	return commands
+}
+
+// reshard runs a split or merge, which change makes to the directory. Like a
+// transfer, it does not go through the log of this client's group, so it is
+// answered here.
+func (c *Client) reshard(change func(*shard.Map) (*shard.Map, bool),
+	requestId int64) <-chan multipaxos.Result {
+	result := make(chan multipaxos.Result, 1)
+	go func() {
+		c.groups.reshardMu.Lock()
+		defer c.groups.reshardMu.Unlock()
+		ctl, err := dialController(c.groups.addr)
+		if err != nil {
+			result <- multipaxos.Result{Type: multipaxos.Retry}
+			return
+		}
+		defer ctl.conn.Close()
+
+		current, ok := ctl.directory()
+		if !ok || !ctl.move(current) {
+			result <- multipaxos.Result{Type: multipaxos.Retry}
+			return
+		}
+		next, ok := change(current)
+		if !ok {
+			c.manager.Respond(requestId, "bad command")
+			result <- multipaxos.Result{Type: multipaxos.Ok}
+			return
+		}
+		if _, ok := ctl.send(0, "setshards "+next.Encode()); !ok ||
+			!ctl.move(next) {
+			result <- multipaxos.Result{Type: multipaxos.Retry}
+			return
+		}
+		c.manager.Respond(requestId, "")
+		result <- multipaxos.Result{Type: multipaxos.Ok}
+	}()
+	return result
+}
+
+func dialController(addr string) (*controller, error) {
+	conn, err := net.DialTimeout("tcp", addr, forwardTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &controller{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// send has group run request and returns its reply, or false if it failed.
+func (ctl *controller) send(group int64, request string) (string, bool) {
+	ctl.conn.SetDeadline(time.Now().Add(forwardTimeout))
+	_, err := ctl.conn.Write([]byte(groupPrefix +
+		strconv.FormatInt(group, 10) + " " + request + "\n"))
+	if err != nil {
+		return "", false
+	}
+	response, err := ctl.reader.ReadString('\n')
+	if err != nil {
+		return "", false
+	}
+	response = strings.TrimRight(response, "\n")
+	// a reshard returns the keys handed over, shards the directory and a
+	// setshards nothing.
+	return response, response == "" || strings.HasPrefix(response, "{")
+}
+
+// directory reads the shard map that routes keys to groups from group 0.
+func (ctl *controller) directory() (*shard.Map, bool) {
+	response, ok := ctl.send(0, "shards")
+	if !ok {
+		return nil, false
+	}
+	m, err := shard.Decode(response)
+	return m, err == nil
+}
+
+// move hands the keys that m moves over to the groups that take them.
+func (ctl *controller) move(m *shard.Map) bool {
+	keys := make(map[string]string)
+	for _, move := range m.Moves {
+		response, ok := ctl.send(move.From, "reshard "+m.Encode())
+		if !ok || json.Unmarshal([]byte(response), &keys) != nil {
+			return false
+		}
+	}
+	data, _ := json.Marshal(keys)
+	for _, move := range m.Moves {
+		_, ok := ctl.send(move.To, "reshard "+m.Encode()+" "+string(data))
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,33 @@
+package replicant
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestForwardToLeader(t *testing.T) {
+	c := testConfig()
+	leader, err := net.Listen("tcp", clientAddr(c.Peers[1]))
+	assert.Nil(t, err)
+	defer leader.Close()
+	forwarded := make(chan string, 1)
+	go func() {
+		conn, err := leader.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, _ := bufio.NewReader(conn).ReadString('\n')
+		forwarded <- request
+		conn.Write([]byte("bar\n"))
+	}()
+
+	_, reader, conn := newTestClient(newTestGroups(c))
+	defer conn.Close()
+
+	conn.Write([]byte("get foo\n"))
+	assert.Equal(t, "bar\n", readReply(t, reader, conn))
+	assert.Equal(t, forwardPrefix+"get foo\n", <-forwarded)
+}
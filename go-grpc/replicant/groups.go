@@ -0,0 +1,59 @@
+package replicant
+
+import (
+	consensusLog "github.com/sosp23/replicated-store/go/log"
+	"github.com/sosp23/replicated-store/go/multipaxos"
+	"github.com/sosp23/replicated-store/go/shard"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// groupPrefix picks the consensus group that runs an admin command, such as
+// "group 2 transfer 1". Commands without it go to group 0. Gets, puts and
+// deletes always go to the group that owns their key.
+const groupPrefix = "group "
+
+// Groups holds the consensus groups this peer hosts, which split the keyspace
+// among them as the directory in group 0 says.
+type Groups struct {
+	shards     *shard.Map
+	multipaxos []*multipaxos.Multipaxos
+	logs       []*consensusLog.Log
+	addr       string
+	reshardMu  sync.Mutex
+}
+
+func (g *Groups) Get(group int64) (*multipaxos.Multipaxos, bool) {
+	if group < 0 || group >= int64(len(g.multipaxos)) {
+		return nil, false
+	}
+	return g.multipaxos[group], true
+}
+
+// ForKey returns the group that owns key.
+func (g *Groups) ForKey(key string) *multipaxos.Multipaxos {
+	return g.multipaxos[g.Directory().Group(key)]
+}
+
+// Directory returns the shard map that routes keys to groups.
+func (g *Groups) Directory() *shard.Map {
+	return g.logs[0].Directory()
+}
+
+// parseGroup strips a group prefix off request and returns the group it
+// names, or group 0 if it has none.
+func parseGroup(request string) (int64, string, bool) {
+	if !strings.HasPrefix(request, groupPrefix) {
+		return 0, request, true
+	}
+	substrings := strings.SplitN(request, " ", 3)
+	if len(substrings) != 3 {
+		return 0, request, false
+	}
+	group, err := strconv.ParseInt(substrings[1], 10, 64)
+	if err != nil {
+		return 0, request, false
+	}
+	return group, substrings[2], true
+}
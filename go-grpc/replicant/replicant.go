@@ -5,6 +5,7 @@ import (
 	"github.com/sosp23/replicated-store/go/kvstore"
 	consensusLog "github.com/sosp23/replicated-store/go/log"
 	"github.com/sosp23/replicated-store/go/multipaxos"
+	"github.com/sosp23/replicated-store/go/shard"
 	logger "github.com/sirupsen/logrus"
 	"net"
 	"strconv"
@@ -13,8 +14,7 @@ import (
 
 type Replicant struct {
 	id            int64
-	log           *consensusLog.Log
-	multipaxos    *multipaxos.Multipaxos
+	groups        *Groups
 	ipPort        string
 	acceptor      net.Listener
 	clientManager *ClientManager
@@ -23,37 +23,53 @@ type Replicant struct {
 func NewReplicant(config config.Config) *Replicant {
 	r := &Replicant{
 		id:       config.Id,
-		ipPort:   config.Peers[config.Id],
+		ipPort:   config.Addr(config.Id),
 	}
-	r.log = consensusLog.NewLog(kvstore.CreateStore(config))
-	r.multipaxos = multipaxos.NewMultipaxos(r.log, config)
-	r.clientManager = NewClientManager(r.id, int64(len(config.Peers)), r.multipaxos)
+	r.groups = &Groups{
+		shards: shard.NewMap(config),
+		addr:   clientAddr(r.ipPort),
+	}
+	mux := multipaxos.NewMux()
+	for group := int64(0); group < r.groups.shards.NumGroups(); group++ {
+		groupConfig := config.ForGroup(group)
+		log := consensusLog.NewLog(kvstore.CreateStore(groupConfig),
+			consensusLog.CreateWAL(groupConfig))
+		log.SetSnapshotInterval(config.SnapshotInterval)
+		log.SetWitness(config.IsWitness(config.Id))
+		log.SetShards(group, r.groups.shards)
+		r.groups.logs = append(r.groups.logs, log)
+		r.groups.multipaxos = append(r.groups.multipaxos,
+			multipaxos.NewGroupMultipaxos(log, groupConfig, group, mux))
+	}
+	// peers may join later, so stride client ids by the largest possible
+	// number of peers to keep them unique across the cluster.
+	r.clientManager = NewClientManager(r.id, multipaxos.MaxNumPeers,
+		r.groups)
 	return r
 }
 
 func (r *Replicant) Start() {
-	r.multipaxos.Start()
+	for _, mp := range r.groups.multipaxos {
+		mp.Start()
+	}
 	r.StartExecutorThread()
 	r.StartServer()
 }
 
 func (r *Replicant) Stop() {
+	// hand leadership off while this peer can still serve and replicate.
+	for _, mp := range r.groups.multipaxos {
+		mp.StepDown()
+	}
 	r.StopServer()
 	r.StopExecutorThread()
-	r.multipaxos.Stop()
+	for _, mp := range r.groups.multipaxos {
+		mp.Stop()
+	}
 }
 
 func (r *Replicant) StartServer() {
-	pos := strings.Index(r.ipPort, ":")
-	if pos == -1 {
-		panic("no separator : in the acceptor port")
-	}
-	pos += 1
-	port, err := strconv.Atoi(r.ipPort[pos:])
-	if err != nil {
-		panic("parsing acceptor port failed")
-	}
-	port += 1
+	port := clientPort(r.ipPort)
 
 	acceptor, err := net.Listen("tcp", ":" + strconv.Itoa(port))
 	if err != nil {
@@ -71,24 +87,25 @@ func (r *Replicant) StopServer() {
 
 func (r *Replicant) StartExecutorThread() {
 	logger.Infof("%v starting executor thread\n", r.id)
-	go r.executorThread()
+	for _, log := range r.groups.logs {
+		go r.executorThread(log)
+	}
 }
 
 func (r *Replicant) StopExecutorThread() {
 	logger.Infof("%v stopping executor thread\n", r.id)
-	r.log.Stop()
+	for _, log := range r.groups.logs {
+		log.Stop()
+	}
 }
 
-func (r *Replicant) executorThread() {
+func (r *Replicant) executorThread(log *consensusLog.Log) {
 	for {
-		id, result := r.log.Execute()
+		id, result := log.Execute()
 		if result == nil {
 			break
 		}
-		client := r.clientManager.Get(id)
-		if client != nil {
-			client.Write(result.Value)
-		}
+		r.clientManager.Respond(id, result.Value)
 	}
 }
 
@@ -102,3 +119,23 @@ func (r *Replicant) AcceptClient() {
 		r.clientManager.Start(conn)
 	}
 }
+
+// clientPort returns the port on which the peer listening at ipPort serves
+// clients, which is the peer port plus one.
+func clientPort(ipPort string) int {
+	pos := strings.Index(ipPort, ":")
+	if pos == -1 {
+		panic("no separator : in the acceptor port")
+	}
+	pos += 1
+	port, err := strconv.Atoi(ipPort[pos:])
+	if err != nil {
+		panic("parsing acceptor port failed")
+	}
+	return port + 1
+}
+
+func clientAddr(ipPort string) string {
+	return ipPort[:strings.Index(ipPort, ":")+1] +
+		strconv.Itoa(clientPort(ipPort))
+}
@@ -2,16 +2,50 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"os"
 	"strconv"
 )
 
+var ErrNoSnapshotInterval = errors.New(
+	"config: wal_path requires snapshot_interval > 0")
+
+var ErrLearnersNeedSnapshots = errors.New(
+	"config: learners require snapshot_interval > 0")
+
 type Config struct {
-	Id             int64
-	Peers          []string `json:"peers"`
-	CommitInterval int64    `json:"commit_interval"`
-	Store          string   `json:"store"`
-	DbPath         string   `json:"db_path"`
+	Id                 int64
+	Peers              []string `json:"peers"`
+	Learners           []string `json:"learners"`
+	Witnesses          []int64  `json:"witnesses"`
+	Priorities         []int64  `json:"priorities"`
+	CommitInterval     int64    `json:"commit_interval"`
+	HeartbeatInterval  int64    `json:"heartbeat_interval"`
+	ElectionTimeoutMin int64    `json:"election_timeout_min"`
+	ElectionTimeoutMax int64    `json:"election_timeout_max"`
+	Store              string   `json:"store"`
+	DbPath             string   `json:"db_path"`
+	WalPath            string   `json:"wal_path"`
+	WalSegmentSize     int64    `json:"wal_segment_size"`
+	BallotPath         string   `json:"ballot_path"`
+	SnapshotInterval   int64    `json:"snapshot_interval"`
+	ReplayWindow       int64    `json:"replay_window"`
+	BatchSize          int64    `json:"batch_size"`
+	BatchDelay         int64    `json:"batch_delay"`
+	AcceptWindow       int64    `json:"accept_window"`
+	LeaseDuration      int64    `json:"lease_duration"`
+	ClockDrift         int64    `json:"clock_drift"`
+	ReadMode           string   `json:"read_mode"`
+	RpcTimeout         int64    `json:"rpc_timeout"`
+	RpcRetries         int64    `json:"rpc_retries"`
+	RpcBackoff         int64    `json:"rpc_backoff"`
+	PrepareQuorum      int64    `json:"prepare_quorum"`
+	AcceptQuorum       int64    `json:"accept_quorum"`
+	CatchUpBatchSize   int64    `json:"catch_up_batch_size"`
+	CatchUpInterval    int64    `json:"catch_up_interval"`
+	Groups             int64    `json:"groups"`
+	Sharding           string   `json:"sharding"`
+	SplitKeys          []string `json:"split_keys"`
 }
 
 func DefaultConfig(id int64, n int) Config {
@@ -29,6 +63,67 @@ func DefaultConfig(id int64, n int) Config {
 	return config
 }
 
+// Addr returns the address of node id. Learners take the ids after the voting
+// peers, in the order they are listed.
+func (c Config) Addr(id int64) string {
+	if id < int64(len(c.Peers)) {
+		return c.Peers[id]
+	}
+	return c.Learners[id-int64(len(c.Peers))]
+}
+
+// IsLearner reports whether this node is a learner rather than a voting peer.
+func (c Config) IsLearner() bool {
+	return c.Id >= int64(len(c.Peers))
+}
+
+// IsWitness reports whether peer id is a witness, which votes but keeps no
+// store.
+func (c Config) IsWitness(id int64) bool {
+	for _, witness := range c.Witnesses {
+		if witness == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Priority returns the election priority of peer id. Peers without one rank
+// lowest.
+func (c Config) Priority(id int64) int64 {
+	if id < int64(len(c.Priorities)) {
+		return c.Priorities[id]
+	}
+	return 0
+}
+
+// NumGroups returns how many consensus groups share the keyspace.
+func (c Config) NumGroups() int64 {
+	if c.Groups <= 0 {
+		return 1
+	}
+	return c.Groups
+}
+
+// ForGroup returns the config of consensus group group. Every group keeps its
+// store, log and ballot apart, so all but group 0 get their own paths.
+func (c Config) ForGroup(group int64) Config {
+	if group == 0 {
+		return c
+	}
+	suffix := "-" + strconv.FormatInt(group, 10)
+	if c.DbPath != "" {
+		c.DbPath += suffix
+	}
+	if c.WalPath != "" {
+		c.WalPath += suffix
+	}
+	if c.BallotPath != "" {
+		c.BallotPath += suffix
+	}
+	return c
+}
+
 func LoadConfig(id int64, configPath string) (Config, error) {
 	var config Config
 	file, err := os.Open(configPath)
@@ -41,5 +136,15 @@ func LoadConfig(id int64, configPath string) (Config, error) {
 		return config, err
 	}
 	config.Id = id
+	if config.WalPath != "" && config.SnapshotInterval <= 0 {
+		// the WAL is only truncated once a snapshot covers it, so without
+		// snapshots it grows forever and is replayed in full on restart.
+		return config, ErrNoSnapshotInterval
+	}
+	if len(config.Learners) > 0 && config.SnapshotInterval <= 0 {
+		// learners do not hold back trimming, so one that falls behind the
+		// trimmed log can only catch up from a snapshot.
+		return config, ErrLearnersNeedSnapshots
+	}
 	return config, nil
 }
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfig(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	assert.Nil(t, os.WriteFile(path, []byte(data), 0644))
+	return path
+}
+
+func TestLoadConfigRequiresSnapshotsWithWAL(t *testing.T) {
+	_, err := LoadConfig(0, writeConfig(t, `{"wal_path": "/tmp/wal"}`))
+	assert.Equal(t, ErrNoSnapshotInterval, err)
+
+	config, err := LoadConfig(1, writeConfig(t,
+		`{"wal_path": "/tmp/wal", "snapshot_interval": 100}`))
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, config.Id)
+	assert.EqualValues(t, 100, config.SnapshotInterval)
+
+	_, err = LoadConfig(0, writeConfig(t, `{"commit_interval": 3000}`))
+	assert.Nil(t, err)
+}
+
+func TestLoadConfigRequiresSnapshotsWithLearners(t *testing.T) {
+	_, err := LoadConfig(0, writeConfig(t,
+		`{"learners": ["127.0.0.1:14000"]}`))
+	assert.Equal(t, ErrLearnersNeedSnapshots, err)
+
+	config, err := LoadConfig(0, writeConfig(t,
+		`{"learners": ["127.0.0.1:14000"], "snapshot_interval": 100}`))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"127.0.0.1:14000"}, config.Learners)
+}
@@ -44,6 +44,22 @@ func TestMemKVStore_GetPutDel(t *testing.T) {
 	assert.Nil(t, store.Get(key2))
 }
 
+func TestMemKVStore_Scan(t *testing.T) {
+	store := NewMemKVStore()
+	store.Put(key1, val1)
+	store.Put(key2, val2)
+
+	keys, err := store.Scan("bar", "foo")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{key2: val2}, keys)
+	keys, err = store.Scan("c", "")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{key1: val1}, keys)
+	keys, err = store.Scan("g", "")
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+}
+
 func TestMemKVStore_Execute(t *testing.T) {
 	store := NewMemKVStore()
 	getKey1 := &pb.Command{Key: key1, Value: "", Type: pb.Get}
@@ -100,3 +116,39 @@ func TestMemKVStore_Execute(t *testing.T) {
 		assert.True(t, r3.Ok && r3.Value == val2)
 	}
 }
+
+func TestMemKVStore_ExecuteReservedKey(t *testing.T) {
+	store := NewMemKVStore()
+	members := EncodeMembership(map[int64]string{0: "a"})
+	assert.True(t, store.Put(MembershipKey, members))
+
+	for _, command := range []*pb.Command{
+		{Key: MembershipKey, Value: "bad", Type: pb.Put},
+		{Key: MembershipKey, Value: "", Type: pb.Get},
+		{Key: ShardsKey, Value: "", Type: pb.Del},
+	} {
+		r := Execute(command, store)
+		assert.True(t, !r.Ok && r.Value == ReservedKey)
+	}
+	assert.Equal(t, members, *store.Get(MembershipKey))
+
+	store.Put(MembershipKey, "bad")
+	_, err := LoadMembership(store)
+	assert.NotNil(t, err)
+}
+
+func TestMemKVStore_SnapshotRestore(t *testing.T) {
+	store := NewMemKVStore()
+	assert.True(t, store.Put(key1, val1))
+	assert.True(t, store.Put(key2, val2))
+	snapshot, err := store.Snapshot()
+	assert.Nil(t, err)
+
+	restored := NewMemKVStore()
+	assert.True(t, restored.Put(key1, val2))
+	assert.Nil(t, restored.Restore(snapshot))
+	assert.Equal(t, val1, *restored.Get(key1))
+	assert.Equal(t, val2, *restored.Get(key2))
+
+	assert.NotNil(t, restored.Restore([]byte("bad snapshot")))
+}
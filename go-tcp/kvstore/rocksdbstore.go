@@ -1,6 +1,7 @@
 package kvstore
 
 import (
+	"encoding/json"
 	"github.com/linxGnu/grocksdb"
 	logger "github.com/sirupsen/logrus"
 )
@@ -52,6 +53,89 @@ func (s *RocksDBStore) Del(key string) bool {
 	}
 }
 
+func (s *RocksDBStore) Snapshot() ([]byte, error) {
+	return s.View()()
+}
+
+// Scan seeks to start, so that only the keys in the range are read.
+func (s *RocksDBStore) Scan(start string, end string) (map[string]string,
+	error) {
+	it := s.db.NewIterator(s.ro)
+	defer it.Close()
+	store := make(map[string]string)
+	for it.Seek([]byte(start)); it.Valid(); it.Next() {
+		key := it.Key()
+		k := string(key.Data())
+		key.Free()
+		if end != "" && k >= end {
+			break
+		}
+		value := it.Value()
+		store[k] = string(value.Data())
+		value.Free()
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// View pins a rocksdb snapshot, which the returned function reads and then
+// releases.
+func (s *RocksDBStore) View() func() ([]byte, error) {
+	snapshot := s.db.NewSnapshot()
+	return func() ([]byte, error) {
+		defer s.db.ReleaseSnapshot(snapshot)
+		return s.read(snapshot)
+	}
+}
+
+func (s *RocksDBStore) read(snapshot *grocksdb.Snapshot) ([]byte, error) {
+	ro := grocksdb.NewDefaultReadOptions()
+	defer ro.Destroy()
+	ro.SetSnapshot(snapshot)
+
+	it := s.db.NewIterator(ro)
+	defer it.Close()
+	store := make(map[string]string)
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		key := it.Key()
+		value := it.Value()
+		store[string(key.Data())] = string(value.Data())
+		key.Free()
+		value.Free()
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(store)
+}
+
+func (s *RocksDBStore) Restore(data []byte) error {
+	store := make(map[string]string)
+	if err := json.Unmarshal(data, &store); err != nil {
+		return err
+	}
+
+	wb := grocksdb.NewWriteBatch()
+	defer wb.Destroy()
+	it := s.db.NewIterator(s.ro)
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		key := it.Key()
+		wb.Delete(key.Data())
+		key.Free()
+	}
+	err := it.Err()
+	it.Close()
+	if err != nil {
+		return err
+	}
+	for key, value := range store {
+		wb.Put([]byte(key), []byte(value))
+	}
+	return s.db.Write(s.wo, wb)
+}
+
 func (s *RocksDBStore) Close() {
 	s.db.Close()
 }
@@ -1,10 +1,13 @@
 package log
 
 import (
+	"github.com/sosp23/replicated-store/go/config"
 	"github.com/sosp23/replicated-store/go/kvstore"
 	pb "github.com/sosp23/replicated-store/go/multipaxos/network"
+	"github.com/sosp23/replicated-store/go/shard"
 	"github.com/sosp23/replicated-store/go/util"
 	"github.com/stretchr/testify/assert"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -17,7 +20,7 @@ var (
 
 func setup() {
 	kvStore = kvstore.NewMemKVStore()
-	log = NewLog(kvStore)
+	log = NewLog(kvStore, nil)
 }
 
 func TestConstructor(t *testing.T) {
@@ -34,7 +37,7 @@ func TestInsert(t *testing.T) {
 	log := make(map[int64]*pb.Instance)
 	var (
 		index  int64 = 1
-		ballot int64 = 1
+		ballot       = pb.Ballot{Round: 1}
 	)
 	assert.True(t, Insert(log, util.MakeInstanceWithType(ballot, index,
 		pb.Put)))
@@ -47,13 +50,13 @@ func TestInsertUpdateInProgress(t *testing.T) {
 	log := make(map[int64]*pb.Instance)
 	var (
 		index  int64 = 1
-		ballot int64 = 1
+		ballot       = pb.Ballot{Round: 1}
 	)
 	assert.True(t, Insert(log, util.MakeInstanceWithType(ballot,
 		index, pb.Put)))
 	assert.Equal(t, pb.Put, log[index].Command.Type)
-	assert.False(t, Insert(log, util.MakeInstanceWithType(ballot+1,
-		index, pb.Del)))
+	assert.False(t, Insert(log, util.MakeInstanceWithType(
+		pb.Ballot{Round: ballot.Round + 1}, index, pb.Del)))
 	assert.Equal(t, pb.Del, log[index].Command.Type)
 }
 
@@ -61,7 +64,7 @@ func TestInsertUpdateCommitted(t *testing.T) {
 	log := make(map[int64]*pb.Instance)
 	var (
 		index  int64 = 1
-		ballot int64 = 1
+		ballot       = pb.Ballot{Round: 1}
 	)
 	assert.True(t, Insert(log, util.MakeInstanceWithAll(ballot, index,
 		pb.Committed, pb.Put)))
@@ -73,13 +76,13 @@ func TestInsertStale(t *testing.T) {
 	log := make(map[int64]*pb.Instance)
 	var (
 		index  int64 = 1
-		ballot int64 = 2
+		ballot       = pb.Ballot{Round: 2}
 	)
 	assert.True(t, Insert(log, util.MakeInstanceWithType(ballot,
 		index, pb.Put)))
 	assert.Equal(t, pb.Put, log[index].Command.Type)
-	assert.False(t, Insert(log, util.MakeInstanceWithType(ballot-1,
-		index, pb.Del)))
+	assert.False(t, Insert(log, util.MakeInstanceWithType(
+		pb.Ballot{Round: ballot.Round - 1}, index, pb.Del)))
 	assert.Equal(t, pb.Put, log[index].Command.Type)
 }
 
@@ -87,7 +90,7 @@ func TestInsertCase2Committed(t *testing.T) {
 	log := make(map[int64]*pb.Instance)
 	var (
 		index  int64 = 1
-		ballot int64 = 0
+		ballot       = pb.Ballot{Round: 0}
 	)
 	inst1 := util.MakeInstanceWithAll(ballot, index,
 		pb.Committed, pb.Put)
@@ -102,7 +105,7 @@ func TestInsertCase2Executed(t *testing.T) {
 	log := make(map[int64]*pb.Instance)
 	var (
 		index  int64 = 1
-		ballot int64 = 0
+		ballot       = pb.Ballot{Round: 0}
 	)
 	inst1 := util.MakeInstanceWithAll(ballot, index,
 		pb.Executed, pb.Put)
@@ -117,7 +120,7 @@ func TestInsertCase3(t *testing.T) {
 	log := make(map[int64]*pb.Instance)
 	var (
 		index  int64 = 1
-		ballot int64 = 0
+		ballot       = pb.Ballot{Round: 0}
 	)
 	inst1 := util.MakeInstanceWithAll(ballot, index,
 		pb.Inprogress, pb.Put)
@@ -130,8 +133,8 @@ func TestInsertCase3(t *testing.T) {
 
 func TestAppend(t *testing.T) {
 	setup()
-	log.Append(util.MakeInstance(0, log.AdvanceLastIndex()))
-	log.Append(util.MakeInstance(0, log.AdvanceLastIndex()))
+	log.Append(util.MakeInstance(pb.Ballot{}, log.AdvanceLastIndex()))
+	log.Append(util.MakeInstance(pb.Ballot{}, log.AdvanceLastIndex()))
 	assert.Equal(t, int64(1), log.At(1).Index)
 	assert.Equal(t, int64(2), log.At(2).Index)
 }
@@ -140,7 +143,7 @@ func TestAppendWithGap(t *testing.T) {
 	setup()
 
 	var index int64 = 42
-	log.Append(util.MakeInstance(0, index))
+	log.Append(util.MakeInstance(pb.Ballot{}, index))
 	assert.Equal(t, index, log.At(index).Index)
 	assert.Equal(t, index+1, log.AdvanceLastIndex())
 }
@@ -149,8 +152,8 @@ func TestAppendFillGaps(t *testing.T) {
 	setup()
 
 	var index int64 = 42
-	log.Append(util.MakeInstance(0, index))
-	log.Append(util.MakeInstance(0, index-10))
+	log.Append(util.MakeInstance(pb.Ballot{}, index))
+	log.Append(util.MakeInstance(pb.Ballot{}, index-10))
 	assert.Equal(t, index+1, log.AdvanceLastIndex())
 }
 
@@ -159,8 +162,8 @@ func TestAppendHighBallotOverride(t *testing.T) {
 
 	var (
 		index    int64 = 1
-		loBallot int64 = 0
-		hiBallot int64 = 1
+		loBallot       = pb.Ballot{}
+		hiBallot       = pb.Ballot{Round: 1}
 	)
 	log.Append(util.MakeInstanceWithType(loBallot, index, pb.Put))
 	log.Append(util.MakeInstanceWithType(hiBallot, index, pb.Del))
@@ -172,8 +175,8 @@ func TestAppendLowBallotNoEffect(t *testing.T) {
 
 	var (
 		index    int64 = 1
-		loBallot int64 = 0
-		hiBallot int64 = 1
+		loBallot       = pb.Ballot{}
+		hiBallot       = pb.Ballot{Round: 1}
 	)
 	log.Append(util.MakeInstanceWithType(hiBallot, index, pb.Put))
 	log.Append(util.MakeInstanceWithType(loBallot, index, pb.Del))
@@ -184,9 +187,9 @@ func TestCommit(t *testing.T) {
 	setup()
 
 	var index1 int64 = 1
-	log.Append(util.MakeInstance(0, index1))
+	log.Append(util.MakeInstance(pb.Ballot{}, index1))
 	var index2 int64 = 2
-	log.Append(util.MakeInstance(0, index2))
+	log.Append(util.MakeInstance(pb.Ballot{}, index2))
 	assert.True(t, IsInProgress(log.At(index1)))
 	assert.True(t, IsInProgress(log.At(index2)))
 	assert.False(t, log.IsExecutable())
@@ -214,7 +217,7 @@ func TestCommitBeforeAppend(t *testing.T) {
 	}(&wg)
 	time.Sleep(50 * time.Millisecond)
 
-	log.Append(util.MakeInstance(0, log.AdvanceLastIndex()))
+	log.Append(util.MakeInstance(pb.Ballot{}, log.AdvanceLastIndex()))
 	wg.Wait()
 	assert.True(t, IsCommitted(log.At(index1)))
 }
@@ -229,7 +232,7 @@ func TestAppendCommitExecute(t *testing.T) {
 	}(&wg)
 
 	var index int64 = 1
-	log.Append(util.MakeInstance(0, index))
+	log.Append(util.MakeInstance(pb.Ballot{}, index))
 	log.Commit(index)
 	wg.Wait()
 
@@ -255,9 +258,9 @@ func TestAppendCommitExecuteOutOfOrder(t *testing.T) {
 		index2
 		index3
 	)
-	log.Append(util.MakeInstance(0, index1))
-	log.Append(util.MakeInstance(0, index2))
-	log.Append(util.MakeInstance(0, index3))
+	log.Append(util.MakeInstance(pb.Ballot{}, index1))
+	log.Append(util.MakeInstance(pb.Ballot{}, index2))
+	log.Append(util.MakeInstance(pb.Ballot{}, index3))
 
 	log.Commit(index3)
 	log.Commit(index2)
@@ -271,14 +274,36 @@ func TestAppendCommitExecuteOutOfOrder(t *testing.T) {
 	assert.Equal(t, index3, log.LastExecuted())
 }
 
+func TestExecuteBatch(t *testing.T) {
+	setup()
+	var index int64 = 1
+	instance := util.MakeInstanceWithType(pb.Ballot{}, index, pb.Batch)
+	instance.Command.Commands = []*pb.Command{
+		{Type: pb.Put, Key: "foo", Value: "bar"},
+		{Type: pb.Get, Key: "foo"},
+	}
+	instance.Command.ClientIds = []int64{1, 2}
+	log.Append(instance)
+	log.Commit(index)
+
+	id1, r1 := log.Execute()
+	id2, r2 := log.Execute()
+	assert.EqualValues(t, 1, id1)
+	assert.True(t, r1.Ok)
+	assert.EqualValues(t, 2, id2)
+	assert.True(t, r2.Ok)
+	assert.Equal(t, "bar", r2.Value)
+	assert.Equal(t, index, log.LastExecuted())
+}
+
 func TestCommitUntil(t *testing.T) {
 	setup()
 	const (
-		ballot int64 = iota
-		index1
+		index1 int64 = iota + 1
 		index2
 		index3
 	)
+	ballot := pb.Ballot{}
 
 	log.Append(util.MakeInstance(ballot, index1))
 	log.Append(util.MakeInstance(ballot, index2))
@@ -299,17 +324,17 @@ func TestCommitUntil(t *testing.T) {
 func TestCommitUntilHigherBallot(t *testing.T) {
 	setup()
 	const (
-		ballot int64 = iota
-		index1
+		index1 int64 = iota + 1
 		index2
 		index3
 	)
+	ballot := pb.Ballot{}
 
 	log.Append(util.MakeInstance(ballot, index1))
 	log.Append(util.MakeInstance(ballot, index2))
 	log.Append(util.MakeInstance(ballot, index3))
 
-	log.CommitUntil(index3, ballot+1)
+	log.CommitUntil(index3, pb.Ballot{Round: ballot.Round + 1})
 
 	assert.False(t, IsCommitted(log.At(index1)))
 	assert.False(t, IsCommitted(log.At(index2)))
@@ -323,26 +348,26 @@ func TestCommitUntilCase2(t *testing.T) {
 		index1 int64 = iota
 		index2
 		index3
-		ballot
 	)
+	ballot := pb.Ballot{Round: 1}
 
 	log.Append(util.MakeInstance(ballot, index1))
 	log.Append(util.MakeInstance(ballot, index2))
 	log.Append(util.MakeInstance(ballot, index3))
 
 	defer expectDeath(t, "Commit until test2 - no panic")
-	log.CommitUntil(index3, ballot-1)
+	log.CommitUntil(index3, pb.Ballot{Round: ballot.Round - 1})
 }
 
 func TestCommitUntilWithGap(t *testing.T) {
 	setup()
 	const (
-		ballot int64 = iota
-		index1
+		index1 int64 = iota + 1
 		_
 		index3
 		index4
 	)
+	ballot := pb.Ballot{}
 
 	log.Append(util.MakeInstance(ballot, index1))
 	log.Append(util.MakeInstance(ballot, index3))
@@ -369,11 +394,11 @@ func TestAppendCommitUntilExecute(t *testing.T) {
 	}()
 
 	const (
-		ballot int64 = iota
-		index1
+		index1 int64 = iota + 1
 		index2
 		index3
 	)
+	ballot := pb.Ballot{}
 	log.Append(util.MakeInstance(ballot, index1))
 	log.Append(util.MakeInstance(ballot, index2))
 	log.Append(util.MakeInstance(ballot, index3))
@@ -399,11 +424,11 @@ func TestAppendCommitUntilExecuteTrimUntil(t *testing.T) {
 	}()
 
 	const (
-		ballot int64 = iota
-		index1
+		index1 int64 = iota + 1
 		index2
 		index3
 	)
+	ballot := pb.Ballot{}
 	log.Append(util.MakeInstance(ballot, index1))
 	log.Append(util.MakeInstance(ballot, index2))
 	log.Append(util.MakeInstance(ballot, index3))
@@ -432,10 +457,10 @@ func TestAppendAtTrimmedIndex(t *testing.T) {
 	}()
 
 	const (
-		ballot int64 = iota
-		index1
+		index1 int64 = iota + 1
 		index2
 	)
+	ballot := pb.Ballot{}
 	log.Append(util.MakeInstance(ballot, index1))
 	log.Append(util.MakeInstance(ballot, index2))
 	log.CommitUntil(index2, ballot)
@@ -466,7 +491,7 @@ func TestInstances(t *testing.T) {
 		wg.Done()
 	}()
 
-	var ballot int64 = 0
+	var ballot pb.Ballot
 	expect := make([]*pb.Instance, 0, 3)
 	assert.Equal(t, expect, log.Instances())
 
@@ -515,3 +540,425 @@ func expectDeath(t *testing.T, msg string) {
 		t.Errorf(msg)
 	}
 }
+
+func TestRecoverFromWAL(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(dir, 0)
+	assert.Nil(t, err)
+	log := NewLog(kvstore.NewMemKVStore(), wal)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		log.Execute()
+		log.Execute()
+		wg.Done()
+	}()
+
+	const (
+		index1 int64 = iota + 1
+		index2
+		index3
+		index4
+	)
+	ballot := pb.Ballot{}
+	log.Append(util.MakeInstance(ballot, index1))
+	log.Append(util.MakeInstance(ballot, index2))
+	log.Append(util.MakeInstance(ballot, index3))
+	log.Append(util.MakeInstance(ballot, index4))
+	log.CommitUntil(index2, ballot)
+	wg.Wait()
+	log.Commit(index3)
+	log.TrimUntil(index1)
+	log.Stop()
+
+	wal, err = OpenWAL(dir, 0)
+	assert.Nil(t, err)
+	log = NewLog(kvstore.NewMemKVStore(), wal)
+	defer log.Stop()
+
+	// nothing was snapshotted, so the committed instances are executed again.
+	assert.Equal(t, index4, log.LastIndex())
+	assert.EqualValues(t, 0, log.LastExecuted())
+	assert.EqualValues(t, 0, log.GlobalLastExecuted())
+	assert.True(t, IsCommitted(log.At(index1)))
+	assert.True(t, IsCommitted(log.At(index2)))
+	assert.True(t, IsCommitted(log.At(index3)))
+	assert.True(t, IsInProgress(log.At(index4)))
+	assert.True(t, log.IsExecutable())
+
+	log.Execute()
+	log.Execute()
+	log.Execute()
+	assert.Equal(t, index3, log.LastExecuted())
+	assert.False(t, log.IsExecutable())
+}
+
+func TestRecoverHigherBallotFromWAL(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(dir, 0)
+	assert.Nil(t, err)
+	log := NewLog(kvstore.NewMemKVStore(), wal)
+
+	const index int64 = 1
+	log.Append(util.MakeInstanceWithType(pb.Ballot{}, index, pb.Put))
+	log.Append(util.MakeInstanceWithType(pb.Ballot{Round: 1}, index, pb.Del))
+	log.Stop()
+
+	wal, err = OpenWAL(dir, 0)
+	assert.Nil(t, err)
+	log = NewLog(kvstore.NewMemKVStore(), wal)
+	defer log.Stop()
+
+	assert.True(t, IsEqualInstance(util.MakeInstanceWithType(
+		pb.Ballot{Round: 1}, index, pb.Del), log.At(index)))
+}
+
+func TestRecoverFromTruncatedWAL(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(dir, 64)
+	assert.Nil(t, err)
+	log := NewLog(kvstore.NewMemKVStore(), wal)
+	log.SetSnapshotInterval(2)
+
+	const numInstances int64 = 7
+	ballot := pb.Ballot{}
+	for index := int64(1); index <= numInstances; index++ {
+		instance := util.MakeInstanceWithAll(ballot, index, pb.Committed,
+			pb.Put)
+		instance.Command.Key = "foo"
+		instance.Command.Value = strconv.FormatInt(index, 10)
+		log.Append(instance)
+		log.Execute()
+	}
+	// the segments the latest snapshot covers are gone.
+	for _, record := range replayAll(t, wal) {
+		assert.GreaterOrEqual(t, record.Index, numInstances-1)
+	}
+	log.Stop()
+
+	wal, err = OpenWAL(dir, 64)
+	assert.Nil(t, err)
+	store := kvstore.NewMemKVStore()
+	log = NewLog(store, wal)
+	defer log.Stop()
+
+	assert.Equal(t, numInstances-1, log.LastExecuted())
+	assert.Equal(t, numInstances, log.LastIndex())
+	assert.Nil(t, log.At(numInstances-1))
+	assert.True(t, log.IsExecutable())
+	assert.Equal(t, "6", *store.Get("foo"))
+
+	log.Execute()
+	assert.Equal(t, "7", *store.Get("foo"))
+}
+
+func TestSnapshotTruncatesLog(t *testing.T) {
+	setup()
+	log.SetSnapshotInterval(2)
+
+	const (
+		index1 int64 = iota + 1
+		index2
+		index3
+	)
+	ballot := pb.Ballot{}
+	log.Append(util.MakeInstanceWithAll(ballot, index1, pb.Committed, pb.Put))
+	log.Append(util.MakeInstanceWithAll(ballot, index2, pb.Committed, pb.Put))
+	log.Append(util.MakeInstanceWithAll(ballot, index3, pb.Committed, pb.Put))
+	log.Execute()
+	assert.EqualValues(t, 0, log.LastIncludedIndex())
+	log.Execute()
+	assert.Equal(t, index2, log.LastIncludedIndex())
+	assert.Nil(t, log.At(index1))
+	assert.Nil(t, log.At(index2))
+	assert.NotNil(t, log.At(index3))
+	assert.EqualValues(t, 0, log.GlobalLastExecuted())
+
+	log.Append(util.MakeInstance(ballot, index1))
+	assert.Nil(t, log.At(index1))
+	assert.Len(t, log.Instances(), 1)
+
+	snapshot := log.Snapshot()
+	assert.Equal(t, index2, snapshot.LastIncludedIndex)
+	log.TrimUntil(index2)
+	assert.Equal(t, index2, log.GlobalLastExecuted())
+}
+
+func TestInstallSnapshot(t *testing.T) {
+	setup()
+	source := kvstore.NewMemKVStore()
+	source.Put("foo", "bar")
+	data, _ := source.Snapshot()
+
+	const (
+		index1 int64 = iota + 1
+		index2
+		index3
+	)
+	ballot := pb.Ballot{}
+	log.Append(util.MakeInstance(ballot, index1))
+	log.Append(util.MakeInstanceWithState(ballot, index3, pb.Committed))
+
+	assert.True(t, log.InstallSnapshot(&Snapshot{
+		LastIncludedIndex: index2, Data: data}))
+	assert.Equal(t, index2, log.LastExecuted())
+	assert.Equal(t, index2, log.LastIncludedIndex())
+	assert.Equal(t, index3, log.LastIndex())
+	assert.Nil(t, log.At(index1))
+	assert.Equal(t, "bar", *kvStore.Get("foo"))
+	assert.True(t, log.IsExecutable())
+
+	assert.False(t, log.InstallSnapshot(&Snapshot{
+		LastIncludedIndex: index1, Data: data}))
+}
+
+func TestAppendCommitted(t *testing.T) {
+	setup()
+
+	const (
+		index1 int64 = iota + 1
+		index2
+		index3
+	)
+	loBallot := pb.Ballot{Round: 1}
+	hiBallot := pb.Ballot{Round: 2}
+	log.Append(util.MakeInstanceWithType(loBallot, index1, pb.Del))
+	log.Append(util.MakeInstance(hiBallot, index2))
+
+	log.AppendCommitted([]*pb.Instance{
+		util.MakeInstanceWithAll(hiBallot, index1, pb.Executed, pb.Put),
+		util.MakeInstanceWithAll(loBallot, index2, pb.Executed, pb.Put),
+		util.MakeInstanceWithAll(hiBallot, index3, pb.Executed, pb.Put),
+	})
+	assert.Equal(t, pb.Put, log.At(index1).Command.Type)
+	assert.Equal(t, hiBallot, log.At(index2).Ballot)
+	for _, index := range []int64{index1, index2, index3} {
+		assert.True(t, IsCommitted(log.At(index)))
+	}
+	assert.Equal(t, index3, log.LastIndex())
+	assert.True(t, log.IsExecutable())
+
+	log.Execute()
+	log.Execute()
+	instances := log.Executed(index1, index3)
+	assert.Len(t, instances, 2)
+	assert.True(t, IsExecuted(instances[1]))
+	instances[0].State = pb.Committed
+	assert.True(t, IsExecuted(log.At(index1)))
+}
+
+func TestWitness(t *testing.T) {
+	setup()
+	log.SetWitness(true)
+	log.SetSnapshotInterval(1)
+
+	const (
+		index1 int64 = iota + 1
+		index2
+		index3
+	)
+	ballot := pb.Ballot{}
+	put := util.MakeInstanceWithAll(ballot, index1, pb.Committed, pb.Put)
+	put.Command.Key = "foo"
+	log.Append(put)
+	members1 := map[int64]string{0: "a", 1: "b"}
+	reconfig := util.MakeInstanceWithAll(ballot, index2, pb.Committed, pb.AddPeer)
+	reconfig.Command.Value = kvstore.EncodeMembership(members1)
+	log.Append(reconfig)
+	log.Execute()
+	log.Execute()
+	assert.Equal(t, index2, log.LastExecuted())
+	assert.EqualValues(t, 0, log.LastIncludedIndex())
+	assert.Nil(t, kvStore.Get("foo"))
+	assert.Equal(t, members1, log.Membership())
+
+	source := kvstore.NewMemKVStore()
+	source.Put("foo", "bar")
+	members2 := map[int64]string{0: "a", 1: "b", 2: "c"}
+	source.Put(kvstore.MembershipKey, kvstore.EncodeMembership(members2))
+	data, _ := source.Snapshot()
+	assert.True(t, log.InstallSnapshot(&Snapshot{
+		LastIncludedIndex: index3, Data: data}))
+	assert.Equal(t, index3, log.LastExecuted())
+	assert.Nil(t, kvStore.Get("foo"))
+	assert.Equal(t, members2, log.Membership())
+}
+
+func TestWitnessTruncatesWAL(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(dir, 64)
+	assert.Nil(t, err)
+	log := NewLog(kvstore.NewMemKVStore(), wal)
+	log.SetWitness(true)
+	log.SetSnapshotInterval(2)
+
+	const numInstances int64 = 7
+	ballot := pb.Ballot{}
+	members := map[int64]string{0: "a", 1: "b"}
+	for index := int64(1); index <= numInstances; index++ {
+		instance := util.MakeInstanceWithAll(ballot, index, pb.Committed,
+			pb.Put)
+		if index == 1 {
+			instance.Command.Type = pb.AddPeer
+			instance.Command.Value = kvstore.EncodeMembership(members)
+		}
+		log.Append(instance)
+		log.Execute()
+	}
+	assert.EqualValues(t, 0, log.LastIncludedIndex())
+
+	// the witness saves its store when it trims what every peer executed, and
+	// drops the segments before it.
+	log.TrimUntil(numInstances - 1)
+	assert.Equal(t, numInstances-1, log.LastIncludedIndex())
+	for _, record := range replayAll(t, wal) {
+		assert.GreaterOrEqual(t, record.Index, numInstances-1)
+	}
+	log.Stop()
+
+	wal, err = OpenWAL(dir, 64)
+	assert.Nil(t, err)
+	log = NewLog(kvstore.NewMemKVStore(), wal)
+	log.SetWitness(true)
+	defer log.Stop()
+	assert.Equal(t, numInstances-1, log.LastExecuted())
+	assert.Equal(t, numInstances, log.LastIndex())
+	assert.Equal(t, members, log.Membership())
+}
+
+func TestReservedKeys(t *testing.T) {
+	setup()
+	initial := shard.NewMap(config.DefaultConfig(0, 3))
+	log.SetShards(0, initial)
+
+	const (
+		index1 int64 = iota + 1
+		index2
+	)
+	put := util.MakeInstanceWithAll(pb.Ballot{}, index1, pb.Committed, pb.Put)
+	put.Command.Key = kvstore.MembershipKey
+	put.Command.Value = "bad"
+	log.Append(put)
+	_, result := log.Execute()
+	assert.False(t, result.Ok)
+	assert.Equal(t, kvstore.ReservedKey, result.Value)
+	assert.Nil(t, log.Membership())
+
+	// a snapshot whose peer set and shard maps cannot be decoded leaves them
+	// as they were.
+	source := kvstore.NewMemKVStore()
+	source.Put(kvstore.MembershipKey, "bad")
+	source.Put(kvstore.ShardsKey, "bad")
+	source.Put(kvstore.DirectoryKey, "bad")
+	data, _ := source.Snapshot()
+	assert.True(t, log.InstallSnapshot(&Snapshot{
+		LastIncludedIndex: index2, Data: data}))
+	assert.Nil(t, log.Membership())
+	assert.Equal(t, initial, log.Shards())
+	assert.Equal(t, initial, log.Directory())
+}
+
+func TestRecoverSnapshotFromWAL(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(dir, 0)
+	assert.Nil(t, err)
+	log := NewLog(kvstore.NewMemKVStore(), wal)
+	log.SetSnapshotInterval(2)
+
+	const (
+		index1 int64 = iota + 1
+		index2
+		index3
+	)
+	ballot := pb.Ballot{}
+	put := util.MakeInstanceWithAll(ballot, index1, pb.Committed, pb.Put)
+	put.Command.Key = "foo"
+	put.Command.Value = "bar"
+	log.Append(put)
+	log.Append(util.MakeInstanceWithState(ballot, index2, pb.Committed))
+	log.Append(util.MakeInstance(ballot, index3))
+	log.Execute()
+	log.Execute()
+	log.Stop()
+
+	wal, err = OpenWAL(dir, 0)
+	assert.Nil(t, err)
+	store := kvstore.NewMemKVStore()
+	log = NewLog(store, wal)
+	defer log.Stop()
+
+	// the store comes back from the snapshot.
+	assert.Equal(t, "bar", *store.Get("foo"))
+
+	assert.Equal(t, index2, log.LastIncludedIndex())
+	assert.Equal(t, index2, log.LastExecuted())
+	assert.Equal(t, index3, log.LastIndex())
+	assert.Nil(t, log.At(index2))
+	assert.NotNil(t, log.At(index3))
+}
+
+func TestReshard(t *testing.T) {
+	c := config.DefaultConfig(0, 3)
+	c.Groups = 2
+	c.Sharding = shard.ShardingRange
+	c.SplitKeys = []string{"m"}
+	initial := shard.NewMap(c)
+	from := NewLog(kvstore.NewMemKVStore(), nil)
+	from.SetShards(0, initial)
+	to := NewLog(kvstore.NewMemKVStore(), nil)
+	to.SetShards(1, initial)
+	run := func(l *Log, command *pb.Command) *kvstore.KVResult {
+		instance := util.MakeInstanceWithState(pb.Ballot{Round: 1},
+			l.LastIndex()+1, pb.Committed)
+		instance.Command = command
+		l.Append(instance)
+		_, result := l.Execute()
+		return result
+	}
+	put := func(key string, value string) *pb.Command {
+		return &pb.Command{Type: pb.Put, Key: key, Value: value}
+	}
+
+	run(from, put("a", "1"))
+	run(from, put("h", "2"))
+	// group 1 kept a copy of h from an earlier move.
+	to.kvStore.Put("h", "old")
+	r := run(from, put("x", "3"))
+	assert.Equal(t, MovedPrefix+"0", r.Value)
+
+	next, _ := initial.Split("g", 1)
+	r = run(from, &pb.Command{Type: pb.SetShards, Value: next.Encode()})
+	assert.True(t, r.Ok)
+	r = run(from, &pb.Command{Type: pb.SetShards, Value: next.Encode()})
+	assert.True(t, r.Ok)
+	assert.Equal(t, next, from.Directory())
+	r = run(from, &pb.Command{Type: pb.Get, Key: kvstore.DirectoryKey})
+	assert.Equal(t, next.Encode(), r.Value)
+	skipped, _ := next.Merge("g")
+	skipped.Version += 1
+	r = run(from, &pb.Command{Type: pb.SetShards, Value: skipped.Encode()})
+	assert.Equal(t, StaleShards, r.Value)
+
+	// group 0 hands h over and stops serving it.
+	r = run(from, &pb.Command{Type: pb.Reshard, Value: next.Encode()})
+	assert.Equal(t, `{"h":"2"}`, r.Value)
+	assert.False(t, run(from, &pb.Command{Type: pb.Get, Key: "h"}).Ok)
+	assert.Equal(t, "1", run(from, &pb.Command{Type: pb.Get, Key: "a"}).Value)
+	// and hands it over again if the move is repeated.
+	r = run(from, &pb.Command{Type: pb.Reshard, Value: next.Encode()})
+	assert.Equal(t, `{"h":"2"}`, r.Value)
+
+	// group 1 takes it over, but only once.
+	move := &pb.Command{Type: pb.Reshard, Value: next.Encode(),
+		Commands: []*pb.Command{put("h", "2"), put("a", "1")}}
+	assert.True(t, run(to, move).Ok)
+	assert.Equal(t, "2", run(to, &pb.Command{Type: pb.Get, Key: "h"}).Value)
+	assert.False(t, run(to, &pb.Command{Type: pb.Get, Key: "a"}).Ok)
+	run(to, put("h", "3"))
+	assert.True(t, run(to, move).Ok)
+	assert.Equal(t, "3", to.Read(&pb.Command{Type: pb.Get, Key: "h"}).Value)
+
+	stale := &pb.Command{Type: pb.Reshard, Value: initial.Encode()}
+	assert.Equal(t, StaleShards, run(to, stale).Value)
+}
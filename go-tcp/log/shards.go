@@ -0,0 +1,206 @@
+package log
+
+import (
+	"encoding/json"
+	logger "github.com/sirupsen/logrus"
+	"github.com/sosp23/replicated-store/go/kvstore"
+	tcp "github.com/sosp23/replicated-store/go/multipaxos/network"
+	"github.com/sosp23/replicated-store/go/shard"
+	"strconv"
+)
+
+// Consensus groups that split the keyspace move keys between them through
+// their logs. Group 0 keeps the directory, the shard map that routes keys to
+// groups, which a SetShards command replaces only with the version after the
+// one it holds. Every group also keeps the shard map it last applied, which
+// tells it the keys it owns. A get, put or delete of any other key returns a
+// redirect to the client instead of touching the store. A get of the directory
+// key returns the directory, initial or not.
+//
+// A Reshard command applies a new shard map to a group. The group returns the
+// keys that the map moves away from it as the result, and takes the keys that
+// the map moves to it from the puts the command carries, after dropping any
+// copies it kept from owning them before. A group that runs the command for a
+// map it already applied returns the same keys but takes none, so a move that
+// failed halfway through can be run again from the start.
+
+const (
+	MovedPrefix = "moved "
+	StaleShards = "stale shard map"
+	BadShards   = "bad shard map"
+)
+
+// SetShards makes the log that of consensus group group, which owns the keys
+// that initial assigns to it until it applies another shard map.
+func (l *Log) SetShards(group int64, initial *shard.Map) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.group = group
+	l.initialShards = initial
+	l.loadShards()
+}
+
+// Directory returns the shard map that routes keys to groups, as recorded in
+// the store of group 0.
+func (l *Log) Directory() *shard.Map {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.directory
+}
+
+// Shards returns the shard map this group last applied.
+func (l *Log) Shards() *shard.Map {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.shards
+}
+
+func (l *Log) loadShards() {
+	l.shards = l.loadShardMap(kvstore.ShardsKey, l.shards)
+	l.directory = l.loadShardMap(kvstore.DirectoryKey, l.directory)
+}
+
+// loadShardMap returns the shard map kept under key, or the initial one if
+// there is none. A map that cannot be decoded is logged and ignored, so
+// current is kept.
+func (l *Log) loadShardMap(key string, current *shard.Map) *shard.Map {
+	value := l.kvStore.Get(key)
+	if value == nil {
+		return l.initialShards
+	}
+	m, err := shard.Decode(*value)
+	if err != nil {
+		logger.Errorf("bad shard map in store: %v", err)
+		if current == nil {
+			return l.initialShards
+		}
+		return current
+	}
+	return m
+}
+
+func (l *Log) owns(key string) bool {
+	return l.shards == nil || l.shards.Group(key) == l.group
+}
+
+// execute runs command against the store, unless it reads or writes a key
+// that this group does not own.
+func (l *Log) execute(command *tcp.Command) kvstore.KVResult {
+	switch command.Type {
+	case tcp.SetShards:
+		return l.setShards(command)
+	case tcp.Reshard:
+		return l.reshard(command)
+	case tcp.Get, tcp.Put, tcp.Del:
+		if command.Type == tcp.Get && command.Key == kvstore.DirectoryKey {
+			return kvstore.KVResult{Ok: true, Value: l.directory.Encode()}
+		}
+		if !l.owns(command.Key) {
+			return kvstore.KVResult{
+				Ok:    false,
+				Value: MovedPrefix + strconv.FormatInt(l.shards.Version, 10),
+			}
+		}
+	}
+	return kvstore.Execute(command, l.kvStore)
+}
+
+func (l *Log) setShards(command *tcp.Command) kvstore.KVResult {
+	next, err := shard.Decode(command.Value)
+	if err != nil || l.directory == nil {
+		return kvstore.KVResult{Ok: false, Value: BadShards}
+	}
+	if next.Version == l.directory.Version &&
+		next.Encode() == l.directory.Encode() {
+		return kvstore.KVResult{Ok: true, Value: kvstore.Empty}
+	}
+	if next.Version != l.directory.Version+1 {
+		return kvstore.KVResult{Ok: false, Value: StaleShards}
+	}
+	l.kvStore.Put(kvstore.DirectoryKey, command.Value)
+	l.directory = next
+	return kvstore.KVResult{Ok: true, Value: kvstore.Empty}
+}
+
+func (l *Log) reshard(command *tcp.Command) kvstore.KVResult {
+	next, err := shard.Decode(command.Value)
+	if err != nil || l.shards == nil {
+		return kvstore.KVResult{Ok: false, Value: BadShards}
+	}
+	if next.Version < l.shards.Version ||
+		next.Version == l.shards.Version &&
+			next.Encode() != l.shards.Encode() {
+		return kvstore.KVResult{Ok: false, Value: StaleShards}
+	}
+	if next.Version > l.shards.Version {
+		if !l.witness {
+			l.takeOver(next, command.Commands)
+		}
+		l.kvStore.Put(kvstore.ShardsKey, command.Value)
+		l.shards = next
+	}
+	if l.witness {
+		return kvstore.KVResult{Ok: true, Value: kvstore.Empty}
+	}
+	return kvstore.KVResult{Ok: true, Value: l.handOver(next)}
+}
+
+// takeOver replaces what the store holds of the keys that next moves to this
+// group with the puts in commands.
+func (l *Log) takeOver(next *shard.Map, commands []*tcp.Command) {
+	var incoming []shard.Move
+	for _, move := range next.Moves {
+		if move.To == l.group {
+			incoming = append(incoming, move)
+		}
+	}
+	for key := range l.scan(incoming) {
+		l.kvStore.Del(key)
+	}
+	for _, c := range commands {
+		if c.Type == tcp.Put && !kvstore.IsReserved(c.Key) &&
+			contains(incoming, c.Key) {
+			l.kvStore.Put(c.Key, c.Value)
+		}
+	}
+}
+
+// handOver returns the keys that next moves away from this group and their
+// values, encoded as a json object.
+func (l *Log) handOver(next *shard.Map) string {
+	var outgoing []shard.Move
+	for _, move := range next.Moves {
+		if move.From == l.group {
+			outgoing = append(outgoing, move)
+		}
+	}
+	data, _ := json.Marshal(l.scan(outgoing))
+	return string(data)
+}
+
+// scan returns the keys in the store that moves hand over, and their values.
+// It reads only the ranges they cover, since it runs under the log lock.
+func (l *Log) scan(moves []shard.Move) map[string]string {
+	store := make(map[string]string)
+	for _, move := range moves {
+		keys, err := l.kvStore.Scan(move.Start, move.End)
+		if err != nil {
+			logger.Panic(err)
+		}
+		for key, value := range keys {
+			if !kvstore.IsReserved(key) {
+				store[key] = value
+			}
+		}
+	}
+	return store
+}
+
+func contains(moves []shard.Move, key string) bool {
+	for _, move := range moves {
+		if move.Contains(key) {
+			return true
+		}
+	}
+	return false
+}
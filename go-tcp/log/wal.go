@@ -0,0 +1,358 @@
+package log
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultSegmentSize int64 = 64 << 20
+	segmentSuffix            = ".wal"
+	snapshotName             = "snapshot"
+	headerSize               = 8
+	bodyPrefixSize           = 9
+)
+
+type RecordType uint8
+
+const (
+	InstanceRecord RecordType = iota + 1
+	CommitRecord
+	// ExecuteRecord is reserved; TrimRecord is only read for compatibility.
+	ExecuteRecord
+	TrimRecord
+	SnapshotRecord
+)
+
+type Record struct {
+	Type  RecordType
+	Index int64
+	Data  []byte
+}
+
+var (
+	ErrCorruptRecord = errors.New("wal: corrupt record")
+	crcTable         = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type segment struct {
+	seq      uint64
+	path     string
+	maxIndex int64
+}
+
+// WAL is a segmented write-ahead log. Every record is framed with its length
+// and a CRC32 of its body; a torn record at the tail of the last segment is
+// discarded when the WAL is opened. Next to the segments, the WAL keeps the
+// latest snapshot of the store, framed the same way, which has to be saved
+// before the segments it covers are truncated.
+type WAL struct {
+	dir           string
+	segmentSize   int64
+	segments      []*segment
+	file          *os.File
+	size          int64
+	snapshotMu    sync.Mutex
+	snapshotIndex int64
+}
+
+func OpenWAL(dir string, segmentSize int64) (*WAL, error) {
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WAL{
+		dir:         dir,
+		segmentSize: segmentSize,
+		segments:    segments,
+	}
+	for i, s := range segments {
+		last := i == len(segments)-1
+		valid, err := readSegment(s.path, func(r *Record) {
+			if r.Index > s.maxIndex {
+				s.maxIndex = r.Index
+			}
+		})
+		if err == ErrCorruptRecord && last {
+			if err := os.Truncate(s.path, valid); err != nil {
+				return nil, err
+			}
+		} else if err != nil {
+			return nil, fmt.Errorf("%v: %w", s.path, err)
+		}
+	}
+
+	if len(segments) == 0 {
+		if err := w.createSegment(1); err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+	active := segments[len(segments)-1]
+	w.file, err = os.OpenFile(active.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := w.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	w.size = info.Size()
+	return w, nil
+}
+
+// SaveSnapshot replaces the saved snapshot with data, the store as of index,
+// and syncs it, unless the saved snapshot is at least as recent. It may be
+// called while records are being written.
+func (w *WAL) SaveSnapshot(index int64, data []byte) error {
+	w.snapshotMu.Lock()
+	defer w.snapshotMu.Unlock()
+	if index <= w.snapshotIndex {
+		return nil
+	}
+	path := filepath.Join(w.dir, snapshotName)
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	frame := encodeRecord(&Record{Type: SnapshotRecord, Index: index,
+		Data: data})
+	if _, err := file.Write(frame); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	w.snapshotIndex = index
+	return syncDir(w.dir)
+}
+
+// LoadSnapshot returns the saved snapshot and the index it was taken at, or
+// false if there is none.
+func (w *WAL) LoadSnapshot() (int64, []byte, bool, error) {
+	path := filepath.Join(w.dir, snapshotName)
+	var snapshot *Record
+	_, err := readSegment(path, func(r *Record) {
+		snapshot = r
+	})
+	if os.IsNotExist(err) {
+		return 0, nil, false, nil
+	} else if err != nil {
+		return 0, nil, false, fmt.Errorf("%v: %w", path, err)
+	}
+	if snapshot == nil {
+		return 0, nil, false, fmt.Errorf("%v: %w", path, ErrCorruptRecord)
+	}
+	w.snapshotMu.Lock()
+	w.snapshotIndex = snapshot.Index
+	w.snapshotMu.Unlock()
+	return snapshot.Index, snapshot.Data, true, nil
+}
+
+// Replay calls fn for every record in the WAL in the order it was written.
+func (w *WAL) Replay(fn func(*Record)) error {
+	for _, s := range w.segments {
+		if _, err := readSegment(s.path, fn); err != nil {
+			return fmt.Errorf("%v: %w", s.path, err)
+		}
+	}
+	return nil
+}
+
+// Write appends records to the active segment without syncing them; call Sync
+// to make them durable.
+func (w *WAL) Write(records ...*Record) error {
+	active := w.segments[len(w.segments)-1]
+	for _, r := range records {
+		frame := encodeRecord(r)
+		if _, err := w.file.Write(frame); err != nil {
+			return err
+		}
+		w.size += int64(len(frame))
+		if r.Index > active.maxIndex {
+			active.maxIndex = r.Index
+		}
+	}
+	if w.size >= w.segmentSize {
+		return w.rotate()
+	}
+	return nil
+}
+
+func (w *WAL) Sync() error {
+	return w.file.Sync()
+}
+
+// Truncate removes every closed segment whose records all refer to indexes
+// at or below index. The active segment is never removed.
+func (w *WAL) Truncate(index int64) error {
+	kept := make([]*segment, 0, len(w.segments))
+	removed := false
+	for i, s := range w.segments {
+		if i != len(w.segments)-1 && s.maxIndex <= index {
+			if err := os.Remove(s.path); err != nil {
+				return err
+			}
+			removed = true
+			continue
+		}
+		kept = append(kept, s)
+	}
+	w.segments = kept
+	if removed {
+		return syncDir(w.dir)
+	}
+	return nil
+}
+
+func (w *WAL) Close() error {
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+func (w *WAL) rotate() error {
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return w.createSegment(w.segments[len(w.segments)-1].seq + 1)
+}
+
+func (w *WAL) createSegment(seq uint64) error {
+	path := filepath.Join(w.dir, segmentName(seq))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND,
+		0644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(w.dir); err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = 0
+	w.segments = append(w.segments, &segment{seq: seq, path: path})
+	return nil
+}
+
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%016x%v", seq, segmentSuffix)
+}
+
+func listSegments(dir string) ([]*segment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]*segment, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix),
+			16, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, &segment{
+			seq:  seq,
+			path: filepath.Join(dir, name),
+		})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].seq < segments[j].seq
+	})
+	return segments, nil
+}
+
+func encodeRecord(r *Record) []byte {
+	bodySize := bodyPrefixSize + len(r.Data)
+	frame := make([]byte, headerSize+bodySize)
+	body := frame[headerSize:]
+	body[0] = byte(r.Type)
+	binary.LittleEndian.PutUint64(body[1:bodyPrefixSize], uint64(r.Index))
+	copy(body[bodyPrefixSize:], r.Data)
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(bodySize))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.Checksum(body, crcTable))
+	return frame
+}
+
+// readSegment calls fn for each valid record in the segment at path and
+// returns the offset just past the last valid record.
+func readSegment(path string, fn func(*Record)) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, headerSize)
+	offset := int64(0)
+	for {
+		if _, err := io.ReadFull(reader, header); err == io.EOF {
+			return offset, nil
+		} else if err != nil {
+			return offset, ErrCorruptRecord
+		}
+		bodySize := int64(binary.LittleEndian.Uint32(header[0:4]))
+		checksum := binary.LittleEndian.Uint32(header[4:8])
+		if bodySize < bodyPrefixSize ||
+			offset+headerSize+bodySize > info.Size() {
+			return offset, ErrCorruptRecord
+		}
+		body := make([]byte, bodySize)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return offset, ErrCorruptRecord
+		}
+		if crc32.Checksum(body, crcTable) != checksum {
+			return offset, ErrCorruptRecord
+		}
+		fn(&Record{
+			Type:  RecordType(body[0]),
+			Index: int64(binary.LittleEndian.Uint64(body[1:bodyPrefixSize])),
+			Data:  body[bodyPrefixSize:],
+		})
+		offset += headerSize + bodySize
+	}
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
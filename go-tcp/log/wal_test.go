@@ -0,0 +1,123 @@
+package log
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func replayAll(t *testing.T, wal *WAL) []*Record {
+	records := make([]*Record, 0)
+	assert.Nil(t, wal.Replay(func(r *Record) {
+		records = append(records, r)
+	}))
+	return records
+}
+
+func TestWALWriteReplay(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(dir, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, wal.Write(&Record{Type: InstanceRecord, Index: 1,
+		Data: []byte("foo")}))
+	assert.Nil(t, wal.Write(&Record{Type: CommitRecord, Index: 1}))
+	assert.Nil(t, wal.Close())
+
+	wal, err = OpenWAL(dir, 0)
+	assert.Nil(t, err)
+	records := replayAll(t, wal)
+	assert.Len(t, records, 2)
+	assert.Equal(t, InstanceRecord, records[0].Type)
+	assert.EqualValues(t, 1, records[0].Index)
+	assert.Equal(t, []byte("foo"), records[0].Data)
+	assert.Equal(t, CommitRecord, records[1].Type)
+	wal.Close()
+}
+
+func TestWALRotateAndTruncate(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(dir, 32)
+	assert.Nil(t, err)
+	for i := int64(1); i <= 10; i++ {
+		assert.Nil(t, wal.Write(&Record{Type: InstanceRecord, Index: i,
+			Data: make([]byte, 32)}))
+	}
+	assert.Len(t, wal.segments, 11)
+	assert.Len(t, replayAll(t, wal), 10)
+
+	assert.Nil(t, wal.Truncate(5))
+	records := replayAll(t, wal)
+	assert.EqualValues(t, 6, records[0].Index)
+	assert.EqualValues(t, 10, records[len(records)-1].Index)
+
+	assert.Nil(t, wal.Truncate(10))
+	assert.Len(t, wal.segments, 1)
+	wal.Close()
+}
+
+func TestWALDiscardsTornTail(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(dir, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, wal.Write(&Record{Type: InstanceRecord, Index: 1}))
+	assert.Nil(t, wal.Write(&Record{Type: InstanceRecord, Index: 2,
+		Data: []byte("torn")}))
+	path := wal.segments[0].path
+	wal.Close()
+
+	info, _ := os.Stat(path)
+	assert.Nil(t, os.Truncate(path, info.Size()-2))
+
+	wal, err = OpenWAL(dir, 0)
+	assert.Nil(t, err)
+	records := replayAll(t, wal)
+	assert.Len(t, records, 1)
+	assert.EqualValues(t, 1, records[0].Index)
+
+	assert.Nil(t, wal.Write(&Record{Type: InstanceRecord, Index: 3}))
+	assert.Len(t, replayAll(t, wal), 2)
+	wal.Close()
+}
+
+func TestWALDetectsCorruption(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(dir, 32)
+	assert.Nil(t, err)
+	for i := int64(1); i <= 4; i++ {
+		assert.Nil(t, wal.Write(&Record{Type: InstanceRecord, Index: i,
+			Data: make([]byte, 32)}))
+	}
+	path := wal.segments[0].path
+	wal.Close()
+
+	data, _ := os.ReadFile(path)
+	data[len(data)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(path, data, 0644))
+
+	_, err = OpenWAL(dir, 32)
+	assert.ErrorIs(t, err, ErrCorruptRecord)
+}
+
+func TestWALSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(dir, 0)
+	assert.Nil(t, err)
+	_, _, ok, err := wal.LoadSnapshot()
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	assert.Nil(t, wal.SaveSnapshot(2, []byte("foo")))
+	// an older snapshot does not replace a newer one.
+	assert.Nil(t, wal.SaveSnapshot(1, []byte("bar")))
+	assert.Nil(t, wal.Close())
+
+	wal, err = OpenWAL(dir, 0)
+	assert.Nil(t, err)
+	assert.Len(t, replayAll(t, wal), 0)
+	index, data, ok, err := wal.LoadSnapshot()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.EqualValues(t, 2, index)
+	assert.Equal(t, []byte("foo"), data)
+	wal.Close()
+}
@@ -0,0 +1,103 @@
+package multipaxos
+
+import (
+	"encoding/json"
+	logger "github.com/sirupsen/logrus"
+	tcp "github.com/sosp23/replicated-store/go/multipaxos/network"
+	"time"
+)
+
+// A follower only commits instances it has, so one that missed an accept stops
+// executing at the gap. The leader watches the last executed index in commit
+// and heartbeat responses, and when a follower that lags made no progress
+// since its previous response, sends it the instances the leader executed from
+// there on, or a snapshot if they were trimmed. Catch-up sends catchUpBatchSize instances at a
+// time and waits catchUpInterval between batches, as snapshots do between
+// chunks, so that it does not crowd out the phases in flight.
+
+// catchUpIfBehind starts bringing peer up to date if it reported executing
+// only as far as lastExecuted.
+func (p *Multipaxos) catchUpIfBehind(peer *Peer, ballot tcp.Ballot,
+	lastExecuted int64) {
+	if lastExecuted < p.log.LastIncludedIndex() {
+		go p.sendSnapshot(peer, ballot)
+	} else if p.stalled(peer.Id, lastExecuted) {
+		go p.catchUp(peer, ballot, lastExecuted)
+	}
+}
+
+// stalled reports whether peer id lags behind this leader and executed nothing
+// since its previous response. A follower that is merely slower keeps moving,
+// so it is left alone.
+func (p *Multipaxos) stalled(id int64, lastExecuted int64) bool {
+	previous, ok := p.reportedExecuted.Load(id)
+	p.reportedExecuted.Store(id, lastExecuted)
+	return ok && previous.(int64) == lastExecuted &&
+		lastExecuted < p.log.LastExecuted()
+}
+
+func (p *Multipaxos) sleepForCatchUpInterval() {
+	time.Sleep(time.Duration(p.catchUpInterval) * time.Millisecond)
+}
+
+// catchUp sends peer the instances after lastExecuted up to what this leader
+// has executed now.
+func (p *Multipaxos) catchUp(peer *Peer, ballot tcp.Ballot,
+	lastExecuted int64) {
+	if _, inFlight := p.catchUpInFlight.LoadOrStore(peer.Id,
+		struct{}{}); inFlight {
+		return
+	}
+	defer p.catchUpInFlight.Delete(peer.Id)
+
+	target := p.log.LastExecuted()
+	for next := lastExecuted + 1; next <= target && p.Ballot() == ballot; {
+		instances := p.log.Executed(next, next+p.catchUpBatchSize-1)
+		if len(instances) == 0 {
+			// trimmed since, so only a snapshot brings peer up to date.
+			p.sendSnapshot(peer, ballot)
+			return
+		}
+		request, _ := json.Marshal(tcp.CatchUpRequest{
+			Ballot:    ballot,
+			Instances: instances,
+			Sender:    p.id,
+		})
+		logger.Infof("%v sent catch up request for %v instances to %v", p.id,
+			len(instances), peer.Id)
+		response, ok := p.call(peer, tcp.CATCHUPREQUEST, request,
+			p.rpcRetries, p.rpcTimeout)
+		if !ok {
+			return
+		}
+		var catchUpResponse tcp.CatchUpResponse
+		json.Unmarshal([]byte(response), &catchUpResponse)
+		if catchUpResponse.Type != tcp.Ok {
+			p.BecomeFollower(catchUpResponse.Ballot)
+			return
+		}
+		next = instances[len(instances)-1].Index + 1
+		p.sleepForCatchUpInterval()
+	}
+}
+
+// CatchUp adds the instances a leader sent to bring this peer up to date.
+func (p *Multipaxos) CatchUp(request tcp.CatchUpRequest) tcp.CatchUpResponse {
+	logger.Infof("%v <--catchup-- %v", p.id, request.Sender)
+
+	if request.Ballot.Less(p.Ballot()) {
+		return tcp.CatchUpResponse{
+			Type:   tcp.Reject,
+			Ballot: p.Ballot(),
+		}
+	}
+	p.heardFromLeader()
+	if p.Ballot().Less(request.Ballot) {
+		p.BecomeFollower(request.Ballot)
+	}
+	p.log.AppendCommitted(request.Instances)
+	return tcp.CatchUpResponse{
+		Type:   tcp.Ok,
+		Ballot: p.Ballot(),
+	}
+}
@@ -0,0 +1,90 @@
+package multipaxos
+
+import (
+	"encoding/json"
+	logger "github.com/sirupsen/logrus"
+	"github.com/sosp23/replicated-store/go/config"
+	"github.com/sosp23/replicated-store/go/kvstore"
+	tcp "github.com/sosp23/replicated-store/go/multipaxos/network"
+)
+
+// Learners get every accept and commit the leader sends, but never count
+// toward a quorum and never run for leader. Each executes the log into its own
+// store and answers gets from it, so a read from a learner may lag behind the
+// leader. Learners are listed in the config apart from the voting peers and
+// take the ids that follow theirs. They do not hold back trimming, so one that
+// joins late or falls behind catches up from a snapshot, which is why the
+// config needs a snapshot interval with learners.
+
+func (p *Multipaxos) makeLearners(config config.Config) []*Peer {
+	learners := make([]*Peer, 0, len(config.Learners))
+	for i, addr := range config.Learners {
+		id := int64(len(config.Peers) + i)
+		if id == p.id {
+			continue
+		}
+		learners = append(learners, &Peer{
+			Id:   id,
+			Addr: addr,
+			Stub: p.mux.link(p, addr),
+		})
+	}
+	return learners
+}
+
+func (p *Multipaxos) IsLearner() bool {
+	return p.learner
+}
+
+// LearnerRead serves a get from the local store of a learner.
+func (p *Multipaxos) LearnerRead(command *tcp.Command) (kvstore.KVResult,
+	bool) {
+	if command.Type != tcp.Get || !p.learner {
+		return kvstore.KVResult{}, false
+	}
+	return p.log.Read(command), true
+}
+
+func (p *Multipaxos) sendAcceptToLearners(request []byte) {
+	for _, learner := range p.learners {
+		go func(learner *Peer) {
+			logger.Infof("%v sent accept request to learner %v", p.id,
+				learner.Id)
+			p.call(learner, tcp.ACCEPTREQUEST, request, 0, p.rpcTimeout)
+		}(learner)
+	}
+}
+
+// sendCommitToLearners sends a commit to every learner and catches up any that
+// fell behind. Learners do not hold back trimming.
+func (p *Multipaxos) sendCommitToLearners(request []byte, ballot tcp.Ballot) {
+	for _, learner := range p.learners {
+		go func(learner *Peer) {
+			logger.Infof("%v sent commit request to learner %v", p.id,
+				learner.Id)
+			response, ok := p.call(learner, tcp.COMMITREQUEST, request, 0,
+				p.rpcTimeout)
+			if !ok {
+				return
+			}
+			var commitResponse tcp.CommitResponse
+			json.Unmarshal([]byte(response), &commitResponse)
+			if commitResponse.Type != tcp.Ok {
+				p.BecomeFollower(commitResponse.Ballot)
+				return
+			}
+			p.catchUpIfBehind(learner, ballot, commitResponse.LastExecuted)
+		}(learner)
+	}
+}
+
+// trimIndex returns how far to trim given the leader's global last executed.
+// That index only counts voting peers, so a learner may not have executed as
+// far yet.
+func (p *Multipaxos) trimIndex(globalLastExecuted int64) int64 {
+	if lastExecuted := p.log.LastExecuted(); p.learner &&
+		lastExecuted < globalLastExecuted {
+		return lastExecuted
+	}
+	return globalLastExecuted
+}
@@ -0,0 +1,184 @@
+package multipaxos
+
+import (
+	logger "github.com/sirupsen/logrus"
+	"github.com/sosp23/replicated-store/go/kvstore"
+	tcp "github.com/sosp23/replicated-store/go/multipaxos/network"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// Peers join and leave through AddPeer and RemovePeer commands that are
+// replicated like any other command. The leader encodes the resulting peer set
+// into the command and every peer switches to it when it executes the
+// command's index; phases started afterwards send to, and count quorums over,
+// the new set. Changing one peer at a time keeps every quorum of the old set
+// intersecting every quorum of the new one, so instances still in flight under
+// the old set stay safe.
+
+func membersFromConfig(addrs []string) map[int64]string {
+	members := make(map[int64]string)
+	for id, addr := range addrs {
+		if addr != "" {
+			members[int64(id)] = addr
+		}
+	}
+	return members
+}
+
+func findPeer(peers []*Peer, id int64) *Peer {
+	for _, peer := range peers {
+		if peer.Id == id {
+			return peer
+		}
+	}
+	return nil
+}
+
+// currentPeers returns the peers of the configuration in effect. The slice is
+// replaced, never modified, on a change, so callers may keep using it.
+func (p *Multipaxos) currentPeers() []*Peer {
+	p.peersMu.RLock()
+	defer p.peersMu.RUnlock()
+	return p.peers
+}
+
+func (p *Multipaxos) isMember(id int64) bool {
+	p.peersMu.RLock()
+	defer p.peersMu.RUnlock()
+	_, ok := p.members[id]
+	return ok
+}
+
+// Members returns the id and address of every peer in the configuration in
+// effect.
+func (p *Multipaxos) Members() map[int64]string {
+	p.peersMu.RLock()
+	defer p.peersMu.RUnlock()
+	members := make(map[int64]string, len(p.members))
+	for id, addr := range p.members {
+		members[id] = addr
+	}
+	return members
+}
+
+// applyMembership switches to members, opening links to peers that joined and
+// closing links to peers that left. It runs with the log locked.
+func (p *Multipaxos) applyMembership(members map[int64]string) {
+	ids := make([]int64, 0, len(members))
+	for id := range members {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	p.peersMu.Lock()
+	defer p.peersMu.Unlock()
+	peers := make([]*Peer, 0, len(ids))
+	for _, id := range ids {
+		peer := findPeer(p.peers, id)
+		if peer == nil || peer.Addr != members[id] {
+			logger.Infof("%v opening link to peer %v at %v", p.id, id,
+				members[id])
+			peer = &Peer{
+				Id:   id,
+				Addr: members[id],
+				Stub: p.mux.link(p, members[id]),
+			}
+		}
+		peers = append(peers, peer)
+	}
+	for _, peer := range p.peers {
+		if findPeer(peers, peer.Id) != peer {
+			logger.Infof("%v closing link to peer %v", p.id, peer.Id)
+			p.mux.release(peer.Addr)
+		}
+	}
+	p.peers = peers
+	p.members = members
+
+	if _, ok := members[p.id]; !ok && IsLeader(p.Ballot(), p.id) {
+		logger.Infof("%v left the configuration", p.id)
+		// the log is locked here and BecomeLeader locks it under p.mu.
+		go p.resign(p.Ballot())
+	}
+}
+
+// resign gives up leadership at ballot, so that the other peers elect a leader
+// among themselves.
+func (p *Multipaxos) resign(ballot tcp.Ballot) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Ballot() != ballot {
+		return
+	}
+	logger.Infof("%v giving up leadership: ballot: %v", p.id, ballot)
+	p.setBallot(tcp.Ballot{Round: ballot.Round + 1, Id: tcp.NoLeader})
+	p.cvFollower.Signal()
+	p.resetWindow(p.log.LastIndex())
+}
+
+// AddPeer adds peer id listening at addr, or moves it to addr if it is already
+// a member, and returns once the change is in effect here.
+func (p *Multipaxos) AddPeer(id int64, addr string, clientId int64) Result {
+	command := &tcp.Command{Type: tcp.AddPeer, Key: strconv.FormatInt(id, 10)}
+	return p.reconfigure(command, clientId, func(members map[int64]string) {
+		members[id] = addr
+	})
+}
+
+// RemovePeer removes peer id and returns once the change is in effect here. A
+// leader that removes itself gives up leadership.
+func (p *Multipaxos) RemovePeer(id int64, clientId int64) Result {
+	command := &tcp.Command{Type: tcp.RemovePeer,
+		Key: strconv.FormatInt(id, 10)}
+	return p.reconfigure(command, clientId, func(members map[int64]string) {
+		delete(members, id)
+	})
+}
+
+func (p *Multipaxos) reconfigure(command *tcp.Command, clientId int64,
+	change func(map[int64]string)) Result {
+	ballot := p.Ballot()
+	if IsSomeoneElseLeader(ballot, p.id) {
+		return Result{Type: SomeElseLeader, Leader: ExtractLeaderId(ballot)}
+	}
+	if !IsLeader(ballot, p.id) || atomic.LoadInt32(&p.transferring) == 1 {
+		return Result{Type: Retry, Leader: -1}
+	}
+
+	p.reconfigMu.Lock()
+	defer p.reconfigMu.Unlock()
+	p.leaseMu.Lock()
+	termStartIndex := p.termStartIndex
+	p.leaseMu.Unlock()
+	// the new peer set is computed from the one in effect here, so every
+	// earlier change, including any a previous leader proposed, has to be
+	// executed first.
+	lastExecuted := p.log.LastExecuted()
+	if lastExecuted < termStartIndex || lastExecuted < p.reconfigIndex {
+		return Result{Type: Retry, Leader: -1}
+	}
+	members := p.Members()
+	numPeers := len(members)
+	change(members)
+	if len(members) == 0 {
+		return Result{Type: Retry, Leader: -1}
+	}
+	if !p.validQuorums(numPeers, len(members)) {
+		logger.Errorf("%v cannot go from %v to %v peers with the configured "+
+			"quorums", p.id, numPeers, len(members))
+		return Result{Type: Retry, Leader: -1}
+	}
+	command.Value = kvstore.EncodeMembership(members)
+
+	index := p.log.AdvanceLastIndex()
+	p.reconfigIndex = index
+	p.acquireWindow(ballot, index)
+	r := p.runAcceptPhaseUntilChosen(ballot, index, command, clientId)
+	p.releaseWindow(index)
+	if r.Type == Ok {
+		p.log.WaitExecuted(index)
+	}
+	return r
+}
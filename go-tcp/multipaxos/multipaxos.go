@@ -2,116 +2,305 @@ package multipaxos
 
 import (
 	"encoding/json"
+	logger "github.com/sirupsen/logrus"
 	"github.com/sosp23/replicated-store/go/config"
 	Log "github.com/sosp23/replicated-store/go/log"
 	tcp "github.com/sosp23/replicated-store/go/multipaxos/network"
-	logger "github.com/sirupsen/logrus"
 	"math/rand"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type Multipaxos struct {
-	ballot         int64
-	log            *Log.Log
-	id             int64
-	commitReceived int32
-	commitInterval int64
-	port           string
-	peers          []*Peer
-	nextChannelId  uint64
-	channels       *tcp.ChannelMap
-	mu             sync.Mutex
+	ballot             atomic.Value
+	ballotStore        *BallotStore
+	log                *Log.Log
+	id                 int64
+	heartbeatReceived  int32
+	lastContact        int64
+	leaderSince        int64
+	peerContact        sync.Map
+	commitInterval     int64
+	heartbeatInterval  int64
+	electionTimeoutMin int64
+	electionTimeoutMax int64
+	replayWindow       int64
+	batchSize          int64
+	batchDelay         int64
+	port               string
+	peers              []*Peer
+	learners           []*Peer
+	learner            bool
+	witness            bool
+	witnesses          []int64
+	priorities         []int64
+	behindSnapshot     int64
+	members            map[int64]string
+	peersMu            sync.RWMutex
+	reconfigMu         sync.Mutex
+	reconfigIndex      int64
+	group              int64
+	mux                *Mux
+	channels           *tcp.ChannelMap
+	mu                 sync.Mutex
+
+	batchMu  sync.Mutex
+	batch    []*batchEntry
+	batchSeq int64
+
+	windowMu        sync.Mutex
+	windowCv        *sync.Cond
+	windowSize      int64
+	windowCommitted int64
+	windowDone      map[int64]bool
+
+	leaseDuration  int64
+	clockDrift     int64
+	readMode       string
+	leaseMu        sync.Mutex
+	leaseBallot    tcp.Ballot
+	leaseExpiry    time.Time
+	termStartIndex int64
+	grantBallot    tcp.Ballot
+	grantExpiry    time.Time
+
+	snapshotInFlight sync.Map
+
+	catchUpBatchSize int64
+	catchUpInterval  int64
+	catchUpInFlight  sync.Map
+	reportedExecuted sync.Map
+	snapshotMu       sync.Mutex
+	pendingSnapshot  *Log.Snapshot
+	pendingOffset    int64
 
 	cvLeader   *sync.Cond
 	cvFollower *sync.Cond
 
-	prepareThreadRunning int32
-	commitThreadRunning  int32
+	rpcTimeout int64
+	rpcRetries int64
+	rpcBackoff int64
+
+	prepareQuorum int64
+	acceptQuorum  int64
+
+	transferring int32
+	electNow     chan tcp.Ballot
+
+	prepareThreadRunning   int32
+	commitThreadRunning    int32
+	heartbeatThreadRunning int32
 }
 
 func NewMultipaxos(log *Log.Log, config config.Config) *Multipaxos {
+	return NewGroupMultipaxos(log, config, 0, NewMux())
+}
+
+// NewGroupMultipaxos returns consensus group group of this peer, which talks
+// to the other peers through mux.
+func NewGroupMultipaxos(log *Log.Log, config config.Config, group int64,
+	mux *Mux) *Multipaxos {
 	multipaxos := Multipaxos{
-		ballot:               MaxNumPeers,
 		log:                  log,
 		id:                   config.Id,
-		commitReceived:       0,
+		group:                group,
+		mux:                  mux,
+		channels:             mux.channels,
+		heartbeatReceived:    0,
 		commitInterval:       config.CommitInterval,
-		port:                 config.Peers[config.Id],
-		peers:                make([]*Peer, len(config.Peers)),
-		nextChannelId:        0,
+		heartbeatInterval:    config.HeartbeatInterval,
+		electionTimeoutMin:   config.ElectionTimeoutMin,
+		electionTimeoutMax:   config.ElectionTimeoutMax,
+		replayWindow:         config.ReplayWindow,
+		batchSize:            config.BatchSize,
+		batchDelay:           config.BatchDelay,
+		windowSize:           config.AcceptWindow,
+		windowDone:           make(map[int64]bool),
+		leaseDuration:        config.LeaseDuration,
+		clockDrift:           config.ClockDrift,
+		readMode:             config.ReadMode,
+		rpcTimeout:           config.RpcTimeout,
+		rpcRetries:           config.RpcRetries,
+		rpcBackoff:           config.RpcBackoff,
+		prepareQuorum:        config.PrepareQuorum,
+		acceptQuorum:         config.AcceptQuorum,
+		catchUpBatchSize:     config.CatchUpBatchSize,
+		catchUpInterval:      config.CatchUpInterval,
+		port:                 config.Addr(config.Id),
+		learner:              config.IsLearner(),
+		witness:              config.IsWitness(config.Id),
+		witnesses:            config.Witnesses,
+		priorities:           config.Priorities,
+		electNow:             make(chan tcp.Ballot, 1),
 		prepareThreadRunning: 0,
 		commitThreadRunning:  0,
 	}
-	multipaxos.channels = &tcp.ChannelMap{
-		Channels: make(map[uint64]chan string),
-	}
 	multipaxos.cvFollower = sync.NewCond(&multipaxos.mu)
 	multipaxos.cvLeader = sync.NewCond(&multipaxos.mu)
 	rand.Seed(multipaxos.id)
+	multipaxos.windowCv = sync.NewCond(&multipaxos.windowMu)
+	if multipaxos.replayWindow <= 0 {
+		multipaxos.replayWindow = DefaultReplayWindow
+	}
+	if multipaxos.windowSize <= 0 {
+		multipaxos.windowSize = DefaultAcceptWindow
+	}
+	if multipaxos.heartbeatInterval <= 0 {
+		multipaxos.heartbeatInterval = DefaultHeartbeatInterval
+	}
+	if multipaxos.electionTimeoutMin <= 0 {
+		multipaxos.electionTimeoutMin = DefaultElectionTimeoutMin
+	}
+	if multipaxos.electionTimeoutMax <= 0 {
+		multipaxos.electionTimeoutMax = 2 * multipaxos.electionTimeoutMin
+	}
+	if multipaxos.electionTimeoutMin <= multipaxos.heartbeatInterval ||
+		multipaxos.electionTimeoutMax < multipaxos.electionTimeoutMin {
+		logger.Panic("election timeouts have to exceed the heartbeat interval")
+	}
+	if multipaxos.rpcTimeout <= 0 {
+		multipaxos.rpcTimeout = DefaultRpcTimeout
+	}
+	if multipaxos.rpcBackoff <= 0 {
+		multipaxos.rpcBackoff = DefaultRpcBackoff
+	}
+	if multipaxos.catchUpBatchSize <= 0 {
+		multipaxos.catchUpBatchSize = DefaultCatchUpBatchSize
+	}
+	if multipaxos.catchUpInterval <= 0 {
+		multipaxos.catchUpInterval = DefaultCatchUpInterval
+	}
+	if multipaxos.readMode != "" && multipaxos.readMode != ReadModeLog &&
+		multipaxos.readMode != ReadModeLease &&
+		multipaxos.readMode != ReadModeReadIndex {
+		logger.Panic("no match read mode")
+	}
 
-	for id, addr := range config.Peers {
-		multipaxos.peers[id] = &Peer{
-			Id:   int64(id),
-			Stub: MakePeer(addr, multipaxos.channels),
+	multipaxos.ballot.Store(tcp.Ballot{Id: tcp.NoLeader})
+	if config.BallotPath != "" {
+		multipaxos.ballotStore = NewBallotStore(config.BallotPath)
+		ballot, ok, err := multipaxos.ballotStore.Load()
+		if err != nil {
+			logger.Panic(err)
+		}
+		if ok {
+			if IsLeader(ballot, multipaxos.id) {
+				// a restarted peer has to win a prepare phase again before it
+				// can lead, so give up the leadership without going below
+				// the ballot it promised.
+				ballot = tcp.Ballot{Round: ballot.Round + 1, Id: tcp.NoLeader}
+			}
+			multipaxos.ballot.Store(ballot)
 		}
 	}
 
+	members := log.Membership()
+	if members == nil {
+		members = membersFromConfig(config.Peers)
+	}
+	if len(config.Peers)+len(config.Learners) > int(MaxNumPeers) {
+		logger.Panic("too many peers and learners")
+	}
+	multipaxos.learners = multipaxos.makeLearners(config)
+	if !multipaxos.validQuorums(len(members), len(members)) {
+		logger.Panic("prepare and accept quorums have to add up to more than " +
+			"the number of peers")
+	}
+	multipaxos.applyMembership(members)
+	log.SetMembershipHandler(multipaxos.applyMembership)
+	mux.add(&multipaxos)
+
 	return &multipaxos
 }
 
-func (p *Multipaxos) Ballot() int64 {
-	return atomic.LoadInt64(&p.ballot)
+func (p *Multipaxos) Ballot() tcp.Ballot {
+	return p.ballot.Load().(tcp.Ballot)
 }
 
-func (p *Multipaxos) NextBallot() int64 {
-	nextBallot := p.Ballot()
-	nextBallot += RoundIncrement
-	nextBallot = (nextBallot & ^IdBits) | p.id
-	return nextBallot
+func (p *Multipaxos) NextBallot() tcp.Ballot {
+	return tcp.Ballot{Round: p.Ballot().Round + 1, Id: p.id}
 }
 
-func (p *Multipaxos) BecomeLeader(newBallot int64, newLastIndex int64) {
+func (p *Multipaxos) BecomeLeader(newBallot tcp.Ballot, newLastIndex int64) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	logger.Infof("%v became a leader: ballot: %v -> %v\n", p.id, p.Ballot(),
 		newBallot)
 	p.log.SetLastIndex(newLastIndex)
-	atomic.StoreInt64(&p.ballot, newBallot)
-	p.cvLeader.Signal()
+	p.resetWindow(newLastIndex)
+	p.leaseMu.Lock()
+	p.termStartIndex = newLastIndex
+	p.leaseMu.Unlock()
+	atomic.StoreInt64(&p.leaderSince, time.Now().UnixNano())
+	p.setBallot(newBallot)
+	p.cvLeader.Broadcast()
 }
 
-func (p *Multipaxos) BecomeFollower(newBallot int64) {
+func (p *Multipaxos) BecomeFollower(newBallot tcp.Ballot) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	if newBallot <= p.Ballot() {
+	if !p.Ballot().Less(newBallot) {
 		return
 	}
 
 	oldLeaderId := ExtractLeaderId(p.Ballot())
 	newLeaderId := ExtractLeaderId(newBallot)
-	if newLeaderId != p.id && (oldLeaderId == p.id || oldLeaderId == MaxNumPeers) {
+	if newLeaderId != p.id && (oldLeaderId == p.id || oldLeaderId == tcp.NoLeader) {
 		logger.Infof("%v became a follower: ballot: %v -> %v\n", p.id,
 			p.Ballot(), newBallot)
 		p.cvFollower.Signal()
 	}
-	atomic.StoreInt64(&p.ballot, newBallot)
+	p.setBallot(newBallot)
+	// wake proposers waiting on the accept window so they see the new ballot.
+	p.resetWindow(p.log.LastIndex())
+}
+
+func (p *Multipaxos) setBallot(ballot tcp.Ballot) {
+	if p.ballotStore != nil {
+		if err := p.ballotStore.Store(ballot); err != nil {
+			logger.Panic(err)
+		}
+	}
+	p.ballot.Store(ballot)
 }
 
 func (p *Multipaxos) sleepForCommitInterval() {
 	time.Sleep(time.Duration(p.commitInterval) * time.Millisecond)
 }
 
-func (p *Multipaxos) sleepForRandomInterval() {
-	sleepTime := p.commitInterval + p.commitInterval/2 +
-		rand.Int63n(p.commitInterval/2)
-	time.Sleep(time.Duration(sleepTime) * time.Millisecond)
+// sleepForRandomInterval returns early, reporting true, if the leader asked
+// this peer to take over. The sleep grows by the width of the election timeout
+// range for every replica that outranks this peer, so those run first.
+func (p *Multipaxos) sleepForRandomInterval() bool {
+	spread := p.electionTimeoutMax - p.electionTimeoutMin + 1
+	sleepTime := p.electionTimeoutMin + rand.Int63n(spread) +
+		p.outranked()*spread
+	timer := time.NewTimer(time.Duration(sleepTime) * time.Millisecond)
+	defer timer.Stop()
+	for {
+		select {
+		case ballot := <-p.electNow:
+			// a request from a transfer that the ballot moved past since is
+			// stale, and an election for it would ignore a live leader's lease.
+			if ballot == p.Ballot() {
+				return true
+			}
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+func (p *Multipaxos) receivedHeartbeat() bool {
+	return atomic.CompareAndSwapInt32(&p.heartbeatReceived, 1, 0)
 }
 
-func (p *Multipaxos) receivedCommit() bool {
-	return atomic.CompareAndSwapInt32(&p.commitReceived, 1, 0)
+func (p *Multipaxos) heardFromLeader() {
+	atomic.StoreInt32(&p.heartbeatReceived, 1)
+	atomic.StoreInt64(&p.lastContact, time.Now().UnixNano())
 }
 
 func (p *Multipaxos) PrepareThread() {
@@ -123,15 +312,22 @@ func (p *Multipaxos) PrepareThread() {
 		p.mu.Unlock()
 
 		for atomic.LoadInt32(&p.prepareThreadRunning) == 1 {
-			p.sleepForRandomInterval()
-			if p.receivedCommit() {
+			transfer := p.sleepForRandomInterval()
+			if (p.receivedHeartbeat() || p.leaseGranted(p.id)) && !transfer ||
+				!p.isMember(p.id) {
 				continue
 			}
 			nextBallot := p.NextBallot()
-			maxLastIndex, log := p.RunPreparePhase(nextBallot)
+			if !transfer && !p.runPreVotePhase(nextBallot) {
+				continue
+			}
+			maxLastIndex, log := p.runPreparePhase(nextBallot, transfer)
 			if log != nil {
 				p.BecomeLeader(nextBallot, maxLastIndex)
-				p.Replay(nextBallot, log)
+				p.Replay(nextBallot, maxLastIndex, log)
+				if p.witness {
+					go p.handOffFromWitness(nextBallot)
+				}
 				break
 			}
 		}
@@ -158,18 +354,55 @@ func (p *Multipaxos) CommitThread() {
 	}
 }
 
-func (p *Multipaxos) RunPreparePhase(ballot int64) (int64,
+// HeartbeatThread keeps followers from starting an election, and the lease
+// alive, with a heartbeat every heartbeatInterval while this peer leads.
+func (p *Multipaxos) HeartbeatThread() {
+	for atomic.LoadInt32(&p.heartbeatThreadRunning) == 1 {
+		p.mu.Lock()
+		for atomic.LoadInt32(&p.heartbeatThreadRunning) == 1 &&
+			!IsLeader(p.Ballot(), p.id) {
+			p.cvLeader.Wait()
+		}
+		p.mu.Unlock()
+
+		for atomic.LoadInt32(&p.heartbeatThreadRunning) == 1 {
+			ballot := p.Ballot()
+			if !IsLeader(ballot, p.id) {
+				break
+			}
+			interval := time.Duration(p.heartbeatInterval) * time.Millisecond
+			start := time.Now()
+			p.runHeartbeatPhase(ballot, 0, p.heartbeatInterval)
+			if !p.checkQuorum(ballot) {
+				break
+			}
+			time.Sleep(interval - time.Since(start))
+		}
+	}
+}
+
+func (p *Multipaxos) RunPreparePhase(ballot tcp.Ballot) (int64,
 	map[int64]*tcp.Instance) {
-	numPeers := len(p.peers)
+	return p.runPreparePhase(ballot, false)
+}
+
+// runPreparePhase asks peers to set aside the lease they granted if transfer
+// is set, since the leader holding it handed leadership to this peer.
+func (p *Multipaxos) runPreparePhase(ballot tcp.Ballot, transfer bool) (int64,
+	map[int64]*tcp.Instance) {
+	peers := p.currentPeers()
+	numPeers := len(peers)
+	quorum := p.prepareQuorumOf(numPeers)
 	numOks := 0
 	log := make(map[int64]*tcp.Instance)
 	maxLastIndex := int64(0)
+	maxLastIncludedIndex := int64(0)
 
-	if ballot > p.Ballot() {
+	if p.Ballot().Less(ballot) {
 		numOks += 1
 		log = p.log.GetLog()
 		maxLastIndex = p.log.LastIndex()
-		if numOks > numPeers/2 {
+		if numOks >= quorum {
 			return maxLastIndex, log
 		}
 	} else {
@@ -177,27 +410,40 @@ func (p *Multipaxos) RunPreparePhase(ballot int64) (int64,
 	}
 
 	request, _ := json.Marshal(tcp.PrepareRequest{
-		Sender: p.id,
-		Ballot: ballot,
+		Sender:   p.id,
+		Ballot:   ballot,
+		Transfer: transfer,
 	})
-	channelId, responseChan := p.addChannel(numPeers)
-	for _, peer := range p.peers {
+	responseChan := make(chan string, numPeers)
+	for _, peer := range peers {
 		if peer.Id != p.id {
 			go func(peer *Peer) {
-				peer.Stub.SendAwaitResponse(tcp.PREPAREREQUEST,
-					channelId, string(request))
 				logger.Infof("%v sent prepare request to %v", p.id, peer.Id)
+				response, _ := p.call(peer, tcp.PREPAREREQUEST, request,
+					p.rpcRetries, p.rpcTimeout)
+				responseChan <- response
 			}(peer)
 		}
 	}
 
+	numFailures := 0
 	for {
 		response := <-responseChan
+		if response == "" {
+			numFailures += 1
+			if numPeers-numFailures < quorum {
+				break
+			}
+			continue
+		}
 		var prepareResponse tcp.PrepareResponse
 		json.Unmarshal([]byte(response), &prepareResponse)
 
 		if prepareResponse.Type == tcp.Ok {
 			numOks += 1
+			if prepareResponse.LastIncludedIndex > maxLastIncludedIndex {
+				maxLastIncludedIndex = prepareResponse.LastIncludedIndex
+			}
 			for _, instance := range prepareResponse.Logs {
 				if instance.Index > maxLastIndex {
 					maxLastIndex = instance.Index
@@ -208,19 +454,27 @@ func (p *Multipaxos) RunPreparePhase(ballot int64) (int64,
 			p.BecomeFollower(prepareResponse.Ballot)
 			break
 		}
-		if numOks > numPeers/2 {
-			p.removeChannel(channelId)
+		if numOks >= quorum {
+			if maxLastIncludedIndex > p.log.LastExecuted() {
+				// a peer has trimmed instances we have not executed, so we
+				// cannot tell what was chosen there and must not lead.
+				atomic.StoreInt64(&p.behindSnapshot, maxLastIncludedIndex)
+				logger.Infof("%v is behind snapshot %v, giving up leadership",
+					p.id, maxLastIncludedIndex)
+				return -1, nil
+			}
 			return maxLastIndex, log
 		}
 	}
-	p.removeChannel(channelId)
 	return -1, nil
 }
 
-func (p *Multipaxos) RunAcceptPhase(ballot int64, index int64,
+func (p *Multipaxos) RunAcceptPhase(ballot tcp.Ballot, index int64,
 	command *tcp.Command, clientId int64) Result {
 
-	numPeers := len(p.peers)
+	peers := p.currentPeers()
+	numPeers := len(peers)
+	quorum := p.acceptQuorumOf(numPeers)
 	numOks := 0
 
 	if ballot == p.Ballot() {
@@ -233,10 +487,6 @@ func (p *Multipaxos) RunAcceptPhase(ballot int64, index int64,
 			Command:  command,
 		}
 		p.log.Append(&instance)
-		if numOks > numPeers/2 {
-			p.log.Commit(index)
-			return Result{Type: Ok, Leader: -1}
-		}
 	} else {
 		currentLeaderId := ExtractLeaderId(p.Ballot())
 		return Result{SomeElseLeader, currentLeaderId}
@@ -253,19 +503,33 @@ func (p *Multipaxos) RunAcceptPhase(ballot int64, index int64,
 		Sender:   p.id,
 		Instance: &instance,
 	})
-	channelId, responseChan := p.addChannel(numPeers)
-	for _, peer := range p.peers {
+	responseChan := make(chan string, numPeers)
+	for _, peer := range peers {
 		if peer.Id != p.id {
 			go func(peer *Peer) {
-				peer.Stub.SendAwaitResponse(tcp.ACCEPTREQUEST,
-					channelId, string(request))
 				logger.Infof("%v sent accept request to %v", p.id, peer.Id)
+				response, _ := p.call(peer, tcp.ACCEPTREQUEST, request,
+					p.rpcRetries, p.rpcTimeout)
+				responseChan <- response
 			}(peer)
 		}
 	}
+	p.sendAcceptToLearners(request)
+	if numOks >= quorum {
+		p.log.Commit(index)
+		return Result{Type: Ok, Leader: -1}
+	}
 
+	numFailures := 0
 	for {
 		response := <-responseChan
+		if response == "" {
+			numFailures += 1
+			if numPeers-numFailures < quorum {
+				break
+			}
+			continue
+		}
 		var acceptResponse tcp.AcceptResponse
 		json.Unmarshal([]byte(response), &acceptResponse)
 
@@ -275,89 +539,275 @@ func (p *Multipaxos) RunAcceptPhase(ballot int64, index int64,
 			p.BecomeFollower(acceptResponse.Ballot)
 			break
 		}
-		if numOks > numPeers/2 {
+		if numOks >= quorum {
 			p.log.Commit(index)
-			p.removeChannel(channelId)
 			return Result{Type: Ok, Leader: -1}
 		}
 	}
 	if !IsLeader(p.Ballot(), p.id) {
-		p.removeChannel(channelId)
 		return Result{Type: SomeElseLeader, Leader: ExtractLeaderId(p.Ballot())}
 	}
-	p.removeChannel(channelId)
 	return Result{Type: Retry, Leader: -1}
 }
 
-func (p *Multipaxos) RunCommitPhase(ballot int64, globalLastExecuted int64) int64 {
-	numPeers := len(p.peers)
+// runAcceptPhaseUntilChosen runs the accept phase for index until it reaches
+// a quorum or ballot is no longer current. The index is taken from the log
+// already and nothing else proposes it while this peer leads, so giving up
+// after a phase that timed out would stall execution there. A new leader fills
+// it in its Replay.
+func (p *Multipaxos) runAcceptPhaseUntilChosen(ballot tcp.Ballot, index int64,
+	command *tcp.Command, clientId int64) Result {
+	r := p.RunAcceptPhase(ballot, index, command, clientId)
+	for r.Type == Retry && p.Ballot() == ballot {
+		r = p.RunAcceptPhase(ballot, index, command, clientId)
+	}
+	return r
+}
+
+func (p *Multipaxos) RunCommitPhase(ballot tcp.Ballot, globalLastExecuted int64) int64 {
+	peers := p.currentPeers()
+	numPeers := len(peers)
 	numOks := 0
 	minLastExecuted := p.log.LastExecuted()
 
 	numOks++
 	p.log.TrimUntil(globalLastExecuted)
-	if numOks == numPeers {
-		return minLastExecuted
-	}
-
+	start := time.Now()
 	request, _ := json.Marshal(tcp.CommitRequest{
 		Ballot:             ballot,
 		LastExecuted:       minLastExecuted,
 		GlobalLastExecuted: globalLastExecuted,
 		Sender:             p.id,
 	})
-	channelId, responseChan := p.addChannel(numPeers)
-	for _, peer := range p.peers {
+	p.sendCommitToLearners(request, ballot)
+	if numOks == numPeers {
+		p.extendLease(ballot, start)
+		return minLastExecuted
+	}
+
+	responseChan := make(chan string, numPeers)
+	for _, peer := range peers {
 		if peer.Id != p.id {
 			go func(peer *Peer) {
-				peer.Stub.SendAwaitResponse(tcp.COMMITREQUEST,
-					channelId, string(request))
 				logger.Infof("%v sent commit request to %v", p.id, peer.Id)
+				response, _ := p.call(peer, tcp.COMMITREQUEST, request,
+					0, p.rpcTimeout)
+				responseChan <- response
 			}(peer)
 		}
 	}
 
+	numFailures := 0
 	for {
 		response := <-responseChan
+		if response == "" {
+			// a peer that did not answer may not have executed as far as the
+			// others, so nothing more can be trimmed this round.
+			numFailures += 1
+			if numOks+numFailures == numPeers {
+				return globalLastExecuted
+			}
+			continue
+		}
 		var commitResponse tcp.CommitResponse
 		json.Unmarshal([]byte(response), &commitResponse)
 		if commitResponse.Type == tcp.Ok {
+			p.heardFromPeer(commitResponse.Sender)
 			numOks += 1
+			if numOks == p.acceptQuorumOf(numPeers) {
+				p.extendLease(ballot, start)
+			}
 			if commitResponse.LastExecuted < minLastExecuted {
 				minLastExecuted = commitResponse.LastExecuted
 			}
+			peer := findPeer(peers, commitResponse.Sender)
+			if peer != nil {
+				p.catchUpIfBehind(peer, ballot, commitResponse.LastExecuted)
+				p.preferLeader(peer, commitResponse.LastExecuted)
+			}
 		} else {
 			p.BecomeFollower(commitResponse.Ballot)
 			break
 		}
 		if numOks == numPeers {
-			p.removeChannel(channelId)
 			return minLastExecuted
 		}
+		if numOks+numFailures == numPeers {
+			return globalLastExecuted
+		}
 	}
-	p.removeChannel(channelId)
 	return globalLastExecuted
 }
 
-func (p *Multipaxos) Replay(ballot int64, log map[int64]*tcp.Instance) {
-	for _, instance := range log {
-		var r Result
-		for {
-			r = p.RunAcceptPhase(ballot, instance.Index, instance.Command,
-				instance.ClientId)
-			if r.Type != Retry {
-				break
+// confirmLeadership sends a heartbeat round and reports whether a quorum
+// still accepts ballot.
+func (p *Multipaxos) confirmLeadership(ballot tcp.Ballot) bool {
+	return p.runHeartbeatPhase(ballot, p.rpcRetries, p.rpcTimeout)
+}
+
+// runHeartbeatPhase reports whether a quorum accepted a heartbeat for ballot,
+// and extends the lease if so. A heartbeat carries the last executed index as a
+// commit does, so followers execute and report progress between commit rounds.
+func (p *Multipaxos) runHeartbeatPhase(ballot tcp.Ballot, retries int64,
+	timeout int64) bool {
+	peers := p.currentPeers()
+	numPeers := len(peers)
+	quorum := p.acceptQuorumOf(numPeers)
+	numOks := 1
+	start := time.Now()
+	if numOks >= quorum {
+		p.extendLease(ballot, start)
+		return true
+	}
+
+	request, _ := json.Marshal(tcp.HeartbeatRequest{
+		Ballot:       ballot,
+		LastExecuted: p.log.LastExecuted(),
+		Sender:       p.id,
+	})
+	responseChan := make(chan *tcp.HeartbeatResponse, numPeers)
+	for _, peer := range peers {
+		if peer.Id != p.id {
+			go func(peer *Peer) {
+				response, ok := p.call(peer, tcp.HEARTBEATREQUEST, request,
+					retries, timeout)
+				if !ok {
+					responseChan <- nil
+					return
+				}
+				var heartbeatResponse tcp.HeartbeatResponse
+				json.Unmarshal([]byte(response), &heartbeatResponse)
+				// checked here rather than below, so that the peers that answer
+				// after the quorum are not skipped.
+				if heartbeatResponse.Type == tcp.Ok {
+					p.catchUpIfBehind(peer, ballot, heartbeatResponse.LastExecuted)
+					p.preferLeader(peer, heartbeatResponse.LastExecuted)
+				}
+				responseChan <- &heartbeatResponse
+			}(peer)
+		}
+	}
+
+	numFailures := 0
+	for {
+		heartbeatResponse := <-responseChan
+		if heartbeatResponse == nil {
+			numFailures += 1
+			if numPeers-numFailures < quorum {
+				return false
 			}
+			continue
+		}
+		if heartbeatResponse.Type != tcp.Ok {
+			p.BecomeFollower(heartbeatResponse.Ballot)
+			return false
+		}
+		p.heardFromPeer(heartbeatResponse.Sender)
+		numOks += 1
+		if numOks >= quorum {
+			p.extendLease(ballot, start)
+			return p.Ballot() == ballot
+		}
+	}
+}
+
+func (p *Multipaxos) sendSnapshot(peer *Peer, ballot tcp.Ballot) {
+	// a witness has no store to send, so it makes way for a full replica.
+	if p.witness {
+		logger.Infof("%v cannot send %v a snapshot", p.id, peer.Id)
+		p.resign(ballot)
+		return
+	}
+	if _, inFlight := p.snapshotInFlight.LoadOrStore(peer.Id,
+		struct{}{}); inFlight {
+		return
+	}
+	defer p.snapshotInFlight.Delete(peer.Id)
+
+	snapshot := p.log.Snapshot()
+	if snapshot == nil {
+		return
+	}
+	for offset := 0; ; offset += SnapshotChunkSize {
+		end := offset + SnapshotChunkSize
+		if end > len(snapshot.Data) {
+			end = len(snapshot.Data)
+		}
+		request, _ := json.Marshal(tcp.InstallSnapshotRequest{
+			Ballot:            ballot,
+			LastIncludedIndex: snapshot.LastIncludedIndex,
+			Offset:            int64(offset),
+			Data:              snapshot.Data[offset:end],
+			Done:              end == len(snapshot.Data),
+			Sender:            p.id,
+		})
+		logger.Infof("%v sent install snapshot request to %v", p.id, peer.Id)
+		response, ok := p.call(peer, tcp.INSTALLSNAPSHOTREQUEST, request,
+			p.rpcRetries, p.rpcTimeout)
+		if !ok {
+			return
 		}
-		if r.Type == SomeElseLeader {
+		var installSnapshotResponse tcp.InstallSnapshotResponse
+		json.Unmarshal([]byte(response), &installSnapshotResponse)
+		if installSnapshotResponse.Type != tcp.Ok {
+			p.BecomeFollower(installSnapshotResponse.Ballot)
 			return
 		}
+		if end == len(snapshot.Data) {
+			return
+		}
+		p.sleepForCatchUpInterval()
 	}
 }
 
+func (p *Multipaxos) Replay(ballot tcp.Ballot, lastIndex int64,
+	log map[int64]*tcp.Instance) {
+	// no peer in the prepare quorum accepted anything at a missing index, so
+	// it is safe to fill it with a no-op; otherwise execution stalls there.
+	for i := p.log.LastExecuted() + 1; i <= lastIndex; i++ {
+		if _, ok := log[i]; !ok {
+			log[i] = &tcp.Instance{
+				Index:    i,
+				ClientId: NoopClientId,
+				Command:  &tcp.Command{Type: tcp.Noop},
+			}
+		}
+	}
+	indexes := make([]int64, 0, len(log))
+	for index := range log {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		return indexes[i] < indexes[j]
+	})
+
+	var wg sync.WaitGroup
+	var stopped int32
+	window := make(chan struct{}, p.replayWindow)
+	for _, index := range indexes {
+		window <- struct{}{}
+		if atomic.LoadInt32(&stopped) == 1 {
+			break
+		}
+		wg.Add(1)
+		go func(instance *tcp.Instance) {
+			defer func() {
+				<-window
+				wg.Done()
+			}()
+			r := p.runAcceptPhaseUntilChosen(ballot, instance.Index,
+				instance.Command, instance.ClientId)
+			if r.Type == SomeElseLeader {
+				atomic.StoreInt32(&stopped, 1)
+			}
+		}(log[index])
+	}
+	wg.Wait()
+}
+
 func (p *Multipaxos) addChannel(numPeers int) (uint64, chan string) {
 	responseChan := make(chan string, numPeers-1)
-	channelId := atomic.AddUint64(&p.nextChannelId, 1)
+	channelId := atomic.AddUint64(&p.channels.NextId, 1)
 	p.channels.Lock()
 	p.channels.Channels[channelId] = responseChan
 	p.channels.Unlock()
@@ -373,13 +823,19 @@ func (p *Multipaxos) removeChannel(channelId uint64) {
 }
 
 func (p *Multipaxos) Start() {
-	p.StartPrepareThread()
+	if !p.learner {
+		p.StartPrepareThread()
+	}
 	p.StartCommitThread()
+	p.StartHeartbeatThread()
 }
 
 func (p *Multipaxos) Stop() {
-	p.StopPrepareThread()
+	if !p.learner {
+		p.StopPrepareThread()
+	}
 	p.StopCommitThread()
+	p.StopHeartbeatThread()
 }
 
 func (p *Multipaxos) StartPrepareThread() {
@@ -419,30 +875,180 @@ func (p *Multipaxos) StopCommitThread() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	atomic.StoreInt32(&p.commitThreadRunning, 0)
-	p.cvLeader.Signal()
+	p.cvLeader.Broadcast()
+}
+
+func (p *Multipaxos) StartHeartbeatThread() {
+	logger.Infof("%v starting heartbeat thread", p.id)
+	if p.heartbeatThreadRunning == 1 {
+		panic("heartbeatThreadRunning is true")
+	}
+	atomic.StoreInt32(&p.heartbeatThreadRunning, 1)
+	go p.HeartbeatThread()
+}
+
+func (p *Multipaxos) StopHeartbeatThread() {
+	logger.Infof("%v stopping heartbeat thread", p.id)
+	if p.heartbeatThreadRunning == 0 {
+		panic("heartbeatThreadRunning is false")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	atomic.StoreInt32(&p.heartbeatThreadRunning, 0)
+	p.cvLeader.Broadcast()
 }
 
 func (p *Multipaxos) Replicate(command *tcp.Command, clientId int64) Result {
+	return <-p.ReplicateAsync(command, clientId)
+}
+
+// ReplicateAsync reserves a log index for command, blocking while the accept
+// window is full, and runs the accept phase in the background. The returned
+// channel yields the result once the phase finishes.
+func (p *Multipaxos) ReplicateAsync(command *tcp.Command,
+	clientId int64) <-chan Result {
+	result := make(chan Result, 1)
 	ballot := p.Ballot()
 	if IsLeader(ballot, p.id) {
-		return p.RunAcceptPhase(ballot, p.log.AdvanceLastIndex(), command,
-			clientId)
+		if atomic.LoadInt32(&p.transferring) == 1 || p.witness {
+			// leadership is being handed off, or is about to be by a witness,
+			// so clients retry elsewhere.
+			result <- Result{Type: Retry, Leader: -1}
+			return result
+		}
+		if p.batchSize > 1 {
+			return p.replicateBatched(command, clientId)
+		}
+		p.propose(ballot, command, clientId, func(r Result) {
+			result <- r
+		})
+	} else if IsSomeoneElseLeader(ballot, p.id) {
+		result <- Result{Type: SomeElseLeader, Leader: ExtractLeaderId(ballot)}
+	} else {
+		result <- Result{Type: Retry, Leader: -1}
 	}
-	if IsSomeoneElseLeader(ballot, p.id) {
-		return Result{Type: SomeElseLeader, Leader: ExtractLeaderId(ballot)}
+	return result
+}
+
+func (p *Multipaxos) propose(ballot tcp.Ballot, command *tcp.Command,
+	clientId int64, done func(Result)) {
+	index := p.log.AdvanceLastIndex()
+	p.acquireWindow(ballot, index)
+	go func() {
+		r := p.runAcceptPhaseUntilChosen(ballot, index, command, clientId)
+		p.releaseWindow(index)
+		done(r)
+	}()
+}
+
+// acquireWindow blocks until index is within windowSize of the highest index
+// below which every accept phase has finished, or until ballot is stale.
+func (p *Multipaxos) acquireWindow(ballot tcp.Ballot, index int64) {
+	p.windowMu.Lock()
+	defer p.windowMu.Unlock()
+	for index-p.windowCommitted > p.windowSize && p.Ballot() == ballot {
+		p.windowCv.Wait()
+	}
+}
+
+func (p *Multipaxos) releaseWindow(index int64) {
+	p.windowMu.Lock()
+	defer p.windowMu.Unlock()
+	if index <= p.windowCommitted {
+		return
+	}
+	p.windowDone[index] = true
+	for p.windowDone[p.windowCommitted+1] {
+		delete(p.windowDone, p.windowCommitted+1)
+		p.windowCommitted += 1
+	}
+	p.windowCv.Broadcast()
+}
+
+func (p *Multipaxos) resetWindow(lastIndex int64) {
+	p.windowMu.Lock()
+	defer p.windowMu.Unlock()
+	p.windowCommitted = lastIndex
+	p.windowDone = make(map[int64]bool)
+	p.windowCv.Broadcast()
+}
+
+func (p *Multipaxos) replicateBatched(command *tcp.Command,
+	clientId int64) <-chan Result {
+	entry := &batchEntry{
+		command:  command,
+		clientId: clientId,
+		result:   make(chan Result, 1),
+	}
+
+	p.batchMu.Lock()
+	p.batch = append(p.batch, entry)
+	if int64(len(p.batch)) >= p.batchSize {
+		batch := p.batch
+		p.batch = nil
+		p.batchSeq += 1
+		p.batchMu.Unlock()
+		p.proposeBatch(batch)
+	} else {
+		if len(p.batch) == 1 {
+			seq := p.batchSeq
+			time.AfterFunc(time.Duration(p.batchDelay)*time.Millisecond,
+				func() { p.flushBatch(seq) })
+		}
+		p.batchMu.Unlock()
+	}
+	return entry.result
+}
+
+func (p *Multipaxos) flushBatch(seq int64) {
+	p.batchMu.Lock()
+	if seq != p.batchSeq || len(p.batch) == 0 {
+		p.batchMu.Unlock()
+		return
+	}
+	batch := p.batch
+	p.batch = nil
+	p.batchSeq += 1
+	p.batchMu.Unlock()
+	p.proposeBatch(batch)
+}
+
+func (p *Multipaxos) proposeBatch(batch []*batchEntry) {
+	command := batch[0].command
+	clientId := batch[0].clientId
+	if len(batch) > 1 {
+		command = &tcp.Command{Type: tcp.Batch}
+		clientId = NoopClientId
+		for _, entry := range batch {
+			command.Commands = append(command.Commands, entry.command)
+			command.ClientIds = append(command.ClientIds, entry.clientId)
+		}
+	}
+
+	done := func(r Result) {
+		for _, entry := range batch {
+			entry.result <- r
+		}
+	}
+	ballot := p.Ballot()
+	if IsLeader(ballot, p.id) {
+		p.propose(ballot, command, clientId, done)
+	} else {
+		done(Result{Type: Retry, Leader: -1})
 	}
-	return Result{Type: Retry, Leader: -1}
 }
 
 func (p *Multipaxos) Prepare(request tcp.PrepareRequest) tcp.PrepareResponse {
 	logger.Infof("%v <--prepare-- %v", p.id, request.Sender)
 
-	if request.Ballot > p.Ballot() {
+	if p.Ballot().Less(request.Ballot) && p.isMember(request.Sender) &&
+		(request.Transfer || !p.leaseGranted(request.Sender)) {
 		p.BecomeFollower(request.Ballot)
 		return tcp.PrepareResponse{
-			Type:   tcp.Ok,
-			Ballot: p.Ballot(),
-			Logs:   p.log.Instances(),
+			Type:              tcp.Ok,
+			Ballot:            p.Ballot(),
+			Logs:              p.log.Instances(),
+			LastIncludedIndex: p.log.LastIncludedIndex(),
 		}
 	}
 	return tcp.PrepareResponse{
@@ -455,43 +1061,141 @@ func (p *Multipaxos) Prepare(request tcp.PrepareRequest) tcp.PrepareResponse {
 func (p *Multipaxos) Accept(request tcp.AcceptRequest) tcp.AcceptResponse {
 	logger.Infof("%v <--accept-- %v", p.id, request.Sender)
 	response := tcp.AcceptResponse{}
-	if request.Instance.Ballot >= p.Ballot() {
-		p.log.Append(request.Instance)
-		response.Type = tcp.Ok
-		if request.Instance.Ballot > p.Ballot() {
+	if !request.Instance.Ballot.Less(p.Ballot()) {
+		// the promise is saved before the instance, so that a crash never
+		// leaves an accepted ballot above the saved one.
+		if p.Ballot().Less(request.Instance.Ballot) {
 			p.BecomeFollower(request.Instance.Ballot)
 		}
+		p.log.Append(request.Instance)
+		response.Type = tcp.Ok
 	}
-	if request.Instance.Ballot < p.Ballot() {
+	if request.Instance.Ballot.Less(p.Ballot()) {
 		response.Ballot = p.Ballot()
 		response.Type = tcp.Reject
 	}
 	return response
 }
 
+func (p *Multipaxos) Heartbeat(
+	request tcp.HeartbeatRequest) tcp.HeartbeatResponse {
+	if !request.Ballot.Less(p.Ballot()) {
+		p.heardFromLeader()
+		p.grantLease(request.Ballot)
+		p.log.CommitUntil(request.LastExecuted, request.Ballot)
+		if p.Ballot().Less(request.Ballot) {
+			p.BecomeFollower(request.Ballot)
+		}
+		return tcp.HeartbeatResponse{
+			Type:         tcp.Ok,
+			Ballot:       p.Ballot(),
+			LastExecuted: p.log.LastExecuted(),
+			Sender:       p.id,
+		}
+	}
+	return tcp.HeartbeatResponse{
+		Type:         tcp.Reject,
+		Ballot:       p.Ballot(),
+		LastExecuted: 0,
+		Sender:       p.id,
+	}
+}
+
 func (p *Multipaxos) Commit(request tcp.CommitRequest) tcp.CommitResponse {
 	logger.Infof("%v <--commit-- %v", p.id, request.Sender)
 
-	if request.Ballot >= p.Ballot() {
-		atomic.StoreInt32(&p.commitReceived, 1)
+	if !request.Ballot.Less(p.Ballot()) {
+		p.heardFromLeader()
+		p.grantLease(request.Ballot)
 		p.log.CommitUntil(request.LastExecuted, request.Ballot)
-		p.log.TrimUntil(request.GlobalLastExecuted)
-		if request.Ballot > p.Ballot() {
+		p.log.TrimUntil(p.trimIndex(request.GlobalLastExecuted))
+		if p.Ballot().Less(request.Ballot) {
 			p.BecomeFollower(request.Ballot)
 		}
 		return tcp.CommitResponse{
 			Type:         tcp.Ok,
 			Ballot:       p.Ballot(),
 			LastExecuted: p.log.LastExecuted(),
+			Sender:       p.id,
 		}
 	}
 	return tcp.CommitResponse{
 		Type:         tcp.Reject,
 		Ballot:       p.Ballot(),
 		LastExecuted: 0,
+		Sender:       p.id,
+	}
+}
+
+// appliedChunk reports whether request carries the chunk this peer applied
+// last, or the last chunk of a snapshot it already installed.
+func (p *Multipaxos) appliedChunk(request tcp.InstallSnapshotRequest) bool {
+	if p.pendingSnapshot == nil {
+		return request.Done &&
+			request.LastIncludedIndex <= p.log.LastExecuted()
+	}
+	return p.pendingSnapshot.LastIncludedIndex == request.LastIncludedIndex &&
+		p.pendingOffset == request.Offset &&
+		request.Offset+int64(len(request.Data)) ==
+			int64(len(p.pendingSnapshot.Data))
+}
+
+func (p *Multipaxos) InstallSnapshot(
+	request tcp.InstallSnapshotRequest) tcp.InstallSnapshotResponse {
+	logger.Infof("%v <--installsnapshot-- %v", p.id, request.Sender)
+
+	if request.Ballot.Less(p.Ballot()) {
+		return tcp.InstallSnapshotResponse{
+			Type:   tcp.Reject,
+			Ballot: p.Ballot(),
+		}
+	}
+	p.heardFromLeader()
+	if p.Ballot().Less(request.Ballot) {
+		p.BecomeFollower(request.Ballot)
+	}
+
+	p.snapshotMu.Lock()
+	defer p.snapshotMu.Unlock()
+	if p.appliedChunk(request) {
+		// the leader lost the response to this chunk and sent it again.
+		return tcp.InstallSnapshotResponse{
+			Type:         tcp.Ok,
+			Ballot:       p.Ballot(),
+			LastExecuted: p.log.LastExecuted(),
+		}
+	}
+	if request.Offset == 0 {
+		p.pendingSnapshot = &Log.Snapshot{
+			LastIncludedIndex: request.LastIncludedIndex,
+		}
+	}
+	if p.pendingSnapshot == nil ||
+		p.pendingSnapshot.LastIncludedIndex != request.LastIncludedIndex ||
+		int64(len(p.pendingSnapshot.Data)) != request.Offset {
+		p.pendingSnapshot = nil
+		return tcp.InstallSnapshotResponse{
+			Type:   tcp.Reject,
+			Ballot: p.Ballot(),
+		}
+	}
+	p.pendingOffset = request.Offset
+	p.pendingSnapshot.Data = append(p.pendingSnapshot.Data, request.Data...)
+	if request.Done {
+		p.log.InstallSnapshot(p.pendingSnapshot)
+		p.pendingSnapshot = nil
+	}
+	return tcp.InstallSnapshotResponse{
+		Type:         tcp.Ok,
+		Ballot:       p.Ballot(),
+		LastExecuted: p.log.LastExecuted(),
 	}
 }
 
 func (p *Multipaxos) Id() int64 {
 	return p.id
 }
+
+func (p *Multipaxos) Group() int64 {
+	return p.group
+}
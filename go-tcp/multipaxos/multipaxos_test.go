@@ -3,14 +3,17 @@ package multipaxos
 import (
 	"bufio"
 	"encoding/json"
+	logger "github.com/sirupsen/logrus"
 	"github.com/sosp23/replicated-store/go/config"
 	"github.com/sosp23/replicated-store/go/kvstore"
 	"github.com/sosp23/replicated-store/go/log"
 	tcp "github.com/sosp23/replicated-store/go/multipaxos/network"
 	"github.com/sosp23/replicated-store/go/util"
-	logger "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -18,13 +21,15 @@ import (
 const NumPeers = 3
 
 var (
-	configs = make([]config.Config, NumPeers)
-	logs    = make([]*log.Log, NumPeers)
-	peers   = make([]*Multipaxos, NumPeers)
-	stores  = make([]*kvstore.MemKVStore, NumPeers)
+	configs       = make([]config.Config, NumPeers)
+	logs          = make([]*log.Log, NumPeers)
+	peers         = make([]*Multipaxos, NumPeers)
+	stores        = make([]*kvstore.MemKVStore, NumPeers)
 	peerListeners = make([]net.Listener, NumPeers)
-	serverOn      = make([]bool, NumPeers)
-	isSetup = false
+	serverOn      = make([]atomic.Bool, NumPeers)
+	peerConns     = make([][]net.Conn, NumPeers)
+	peerConnsMu   sync.Mutex
+	isSetup       = false
 )
 
 func setup() {
@@ -33,7 +38,7 @@ func setup() {
 	}
 	for i := int64(0); i < NumPeers; i++ {
 		peerListeners[i], _ = net.Listen("tcp", configs[i].Peers[configs[i].Id])
-		serverOn[i] = false
+		serverOn[i].Store(false)
 	}
 	isSetup = true
 }
@@ -42,10 +47,10 @@ func initPeers() {
 	setup()
 	for i := int64(0); i < NumPeers; i++ {
 		stores[i] = kvstore.NewMemKVStore()
-		logs[i] = log.NewLog(stores[i])
+		logs[i] = log.NewLog(stores[i], nil)
 		peers[i] = NewMultipaxos(logs[i], configs[i])
-		serverOn[i] = false
-		go startServer(i, peers[i])
+		serverOn[i].Store(false)
+		go startServer(peerListeners[i], peers[i])
 	}
 }
 
@@ -54,14 +59,16 @@ func setupOnePeer(id int64) {
 		setup()
 	}
 	stores[id] = kvstore.NewMemKVStore()
-	logs[id] = log.NewLog(stores[id])
+	logs[id] = log.NewLog(stores[id], nil)
 	peers[id] = NewMultipaxos(logs[id], configs[id])
-	go startServer(id, peers[id])
+	go startServer(peerListeners[id], peers[id])
 }
 
+// tearDown and tearDownServers drop the connections the servers accepted
+// too, so that no handler from one test is left to answer the next.
 func tearDown() {
 	for i, peer := range peers {
-		peerListeners[i].Close()
+		killPeer(int64(i))
 		peer.Stop()
 	}
 	isSetup = false
@@ -69,7 +76,7 @@ func tearDown() {
 
 func tearDownServers() {
 	for i, _ := range peers {
-		peerListeners[i].Close()
+		killPeer(int64(i))
 	}
 	isSetup = false
 }
@@ -83,12 +90,12 @@ func IsLeaderByPeer(peer *Multipaxos) bool {
 }
 
 func IsSomeoneElseLeaderByPeer(peer *Multipaxos) bool {
-	return !IsLeaderByPeer(peer) && LeaderByPeer(peer) < MaxNumPeers
+	return !IsLeaderByPeer(peer) && LeaderByPeer(peer) != tcp.NoLeader
 }
 
-func sendCommit(p *Multipaxos, targetId int64, ballot int64,
+func sendCommit(p *Multipaxos, targetId int64, ballot tcp.Ballot,
 	lastExecuted int64, globalLastExecuted int64) *tcp.CommitResponse {
-	if !serverOn[targetId] {
+	if !serverOn[targetId].Load() {
 		return nil
 	}
 	commitRequest := tcp.CommitRequest{
@@ -98,21 +105,21 @@ func sendCommit(p *Multipaxos, targetId int64, ballot int64,
 	}
 	request, _ := json.Marshal(commitRequest)
 	cid, responseChan := p.addChannel(len(p.peers))
-	p.peers[targetId].Stub.SendAwaitResponse(tcp.COMMITREQUEST, cid, string(request))
+	p.peers[targetId].Stub.SendAwaitResponse(tcp.COMMITREQUEST, p.group, cid, string(request))
 	response := <-responseChan
 	var commitResponse tcp.CommitResponse
 	json.Unmarshal([]byte(response), &commitResponse)
 	return &commitResponse
 }
 
-func sendPrepare(p *Multipaxos, targetId int64, ballot int64) *tcp.PrepareResponse {
-	if !serverOn[targetId] {
+func sendPrepare(p *Multipaxos, targetId int64, ballot tcp.Ballot) *tcp.PrepareResponse {
+	if !serverOn[targetId].Load() {
 		return nil
 	}
 	prepareRequest := tcp.PrepareRequest{Ballot: ballot}
 	request, _ := json.Marshal(prepareRequest)
 	cid, responseChan := p.addChannel(len(p.peers))
-	p.peers[targetId].Stub.SendAwaitResponse(tcp.PREPAREREQUEST, cid, string(request))
+	p.peers[targetId].Stub.SendAwaitResponse(tcp.PREPAREREQUEST, p.group, cid, string(request))
 	response := <-responseChan
 	var prepareResponse tcp.PrepareResponse
 	json.Unmarshal([]byte(response), &prepareResponse)
@@ -121,7 +128,7 @@ func sendPrepare(p *Multipaxos, targetId int64, ballot int64) *tcp.PrepareRespon
 
 func sendAccept(p *Multipaxos, targetId int64,
 	inst *tcp.Instance) *tcp.AcceptResponse {
-	if !serverOn[targetId] {
+	if !serverOn[targetId].Load() {
 		return nil
 	}
 	acceptRequest := tcp.AcceptRequest{
@@ -129,7 +136,7 @@ func sendAccept(p *Multipaxos, targetId int64,
 	}
 	request, _ := json.Marshal(acceptRequest)
 	cid, responseChan := p.addChannel(len(p.peers))
-	p.peers[targetId].Stub.SendAwaitResponse(tcp.ACCEPTREQUEST, cid, string(request))
+	p.peers[targetId].Stub.SendAwaitResponse(tcp.ACCEPTREQUEST, p.group, cid, string(request))
 	response := <-responseChan
 	var acceptResponse tcp.AcceptResponse
 	json.Unmarshal([]byte(response), &acceptResponse)
@@ -144,7 +151,7 @@ func TestNewMultipaxos(t *testing.T) {
 	setupOnePeer(0)
 	defer tearDownServers()
 
-	assert.Equal(t, MaxNumPeers, LeaderByPeer(peers[0]))
+	assert.Equal(t, tcp.NoLeader, LeaderByPeer(peers[0]))
 	assert.False(t, IsLeaderByPeer(peers[0]))
 	assert.False(t, IsSomeoneElseLeaderByPeer(peers[0]))
 }
@@ -153,9 +160,8 @@ func TestNextBallot(t *testing.T) {
 	initPeers()
 	defer tearDownServers()
 	for id := 0; id < NumPeers; id++ {
-		ballot := id
-		ballot += RoundIncrement
-		assert.EqualValues(t, ballot, peers[id].NextBallot())
+		ballot := tcp.Ballot{Round: 1, Id: int64(id)}
+		assert.Equal(t, ballot, peers[id].NextBallot())
 	}
 }
 
@@ -223,13 +229,37 @@ func TestNextBallotAfterCommit(t *testing.T) {
 	StartPeerConnection(0)
 	defer tearDownServers()
 
-	ballot := peers[0].Id()
 	sendCommit(peers[1], 0, peers[1].NextBallot(), 0, 0)
 	assert.EqualValues(t, 1, LeaderByPeer(peers[0]))
 
-	ballot += RoundIncrement
-	ballot += RoundIncrement
-	assert.EqualValues(t, ballot, peers[0].NextBallot())
+	ballot := tcp.Ballot{Round: 2, Id: peers[0].Id()}
+	assert.Equal(t, ballot, peers[0].NextBallot())
+}
+
+func TestBallotRestoredAfterRestart(t *testing.T) {
+	setupOnePeer(0)
+	defer tearDownServers()
+
+	cfg := configs[0]
+	cfg.BallotPath = filepath.Join(t.TempDir(), "ballot")
+	peer := NewMultipaxos(logs[0], cfg)
+
+	ballot := tcp.Ballot{Round: 1, Id: 1}
+	r := peer.Prepare(tcp.PrepareRequest{Ballot: ballot, Sender: 1})
+	assert.EqualValues(t, tcp.Ok, r.Type)
+
+	peer = NewMultipaxos(logs[0], cfg)
+	assert.Equal(t, ballot, peer.Ballot())
+	assert.EqualValues(t, 1, LeaderByPeer(peer))
+
+	leaderBallot := peer.NextBallot()
+	peer.BecomeLeader(leaderBallot, logs[0].LastIndex())
+	assert.True(t, IsLeaderByPeer(peer))
+
+	peer = NewMultipaxos(logs[0], cfg)
+	assert.False(t, IsLeaderByPeer(peer))
+	assert.False(t, IsSomeoneElseLeaderByPeer(peer))
+	assert.True(t, leaderBallot.Less(peer.NextBallot()))
 }
 
 func TestCommitCommitsAndTrims(t *testing.T) {
@@ -557,6 +587,179 @@ func TestRunCommitPhase(t *testing.T) {
 	assert.EqualValues(t, numInstances, gle)
 }
 
+func TestRunCommitPhaseCatchesUp(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+	StartPeerConnection(0)
+	StartPeerConnection(1)
+	StartPeerConnection(2)
+	go func() {
+		for {
+			if _, result := logs[2].Execute(); result == nil {
+				return
+			}
+		}
+	}()
+	defer logs[2].Stop()
+
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+	peers[0].catchUpBatchSize = 2
+
+	// peer 2 missed every accept.
+	const numInstances int64 = 5
+	for index := int64(1); index <= numInstances; index++ {
+		for _, log := range logs[:2] {
+			instance := util.MakeInstanceWithAll(ballot, index, tcp.Committed,
+				tcp.Put)
+			instance.Command.Key = "foo"
+			log.Append(instance)
+			log.Execute()
+		}
+	}
+
+	peers[0].RunCommitPhase(ballot, 0)
+	assert.EqualValues(t, 0, logs[2].LastExecuted())
+
+	// peer 2 made no progress since the last commit, so the leader sends it
+	// the instances it missed.
+	peers[0].RunCommitPhase(ballot, 0)
+	assert.Eventually(t, func() bool {
+		return logs[2].LastExecuted() == numInstances
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NotNil(t, stores[2].Get("foo"))
+	assert.EqualValues(t, numInstances,
+		peers[0].RunCommitPhase(ballot, 0))
+}
+
+func TestHeartbeatCatchesUp(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+	StartPeerConnection(0)
+	StartPeerConnection(1)
+	StartPeerConnection(2)
+	go func() {
+		for {
+			if _, result := logs[2].Execute(); result == nil {
+				return
+			}
+		}
+	}()
+	defer logs[2].Stop()
+
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+
+	// peer 2 missed every accept, and no commit round runs.
+	const numInstances int64 = 5
+	for index := int64(1); index <= numInstances; index++ {
+		for _, log := range logs[:2] {
+			instance := util.MakeInstanceWithAll(ballot, index, tcp.Committed,
+				tcp.Put)
+			instance.Command.Key = "foo"
+			log.Append(instance)
+			log.Execute()
+		}
+	}
+
+	// heartbeats alone show that peer 2 makes no progress.
+	assert.Eventually(t, func() bool {
+		peers[0].runHeartbeatPhase(ballot, 0, peers[0].rpcTimeout)
+		return logs[2].LastExecuted() == numInstances
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NotNil(t, stores[2].Get("foo"))
+}
+
+func TestRunPreparePhaseBehindSnapshot(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+	StartPeerConnection(0)
+	StartPeerConnection(1)
+	StartPeerConnection(2)
+
+	const index int64 = 1
+	for i := 1; i < NumPeers; i++ {
+		logs[i].SetSnapshotInterval(1)
+		logs[i].Append(util.MakeInstanceWithState(tcp.Ballot{}, index,
+			tcp.Committed))
+		logs[i].Execute()
+		assert.Equal(t, index, logs[i].LastIncludedIndex())
+	}
+
+	_, log := peers[0].RunPreparePhase(peers[0].NextBallot())
+	assert.Nil(t, log)
+}
+
+func TestRunCommitPhaseInstallsSnapshot(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+	StartPeerConnection(0)
+	StartPeerConnection(1)
+	StartPeerConnection(2)
+
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+
+	const (
+		index1 int64 = iota + 1
+		index2
+	)
+	logs[0].SetSnapshotInterval(index2)
+	for _, index := range []int64{index1, index2} {
+		instance := util.MakeInstanceWithAll(ballot, index, tcp.Committed,
+			tcp.Put)
+		instance.Command.Key = "foo"
+		logs[0].Append(instance)
+		logs[0].Execute()
+	}
+	assert.Equal(t, index2, logs[0].LastIncludedIndex())
+	assert.Nil(t, logs[0].At(index1))
+
+	peers[0].RunCommitPhase(ballot, 0)
+	for i := 1; i < NumPeers; i++ {
+		assert.Eventually(t, func() bool {
+			return logs[i].LastExecuted() == index2
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.NotNil(t, stores[i].Get("foo"))
+		assert.Equal(t, index2, logs[i].LastIncludedIndex())
+	}
+}
+
+func TestInstallSnapshotChunkSentAgain(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+
+	ballot := peers[0].NextBallot()
+	data := []byte(`{"foo":"bar"}`)
+	chunk := func(offset int, end int) tcp.InstallSnapshotRequest {
+		return tcp.InstallSnapshotRequest{
+			Ballot:            ballot,
+			LastIncludedIndex: 2,
+			Offset:            int64(offset),
+			Data:              data[offset:end],
+			Done:              end == len(data),
+			Sender:            0,
+		}
+	}
+
+	// a chunk whose response got lost is acknowledged again, and the
+	// transfer goes on.
+	for _, request := range []tcp.InstallSnapshotRequest{chunk(0, 5),
+		chunk(0, 5), chunk(5, len(data)), chunk(5, len(data))} {
+		r := peers[1].InstallSnapshot(request)
+		assert.Equal(t, tcp.Ok, r.Type)
+	}
+	assert.EqualValues(t, 2, logs[1].LastExecuted())
+	assert.Equal(t, "bar", *stores[1].Get("foo"))
+
+	// a gap still aborts the transfer.
+	assert.Equal(t, tcp.Ok, peers[2].InstallSnapshot(chunk(0, 5)).Type)
+	assert.Equal(t, tcp.Reject, peers[2].InstallSnapshot(chunk(7, 9)).Type)
+	assert.Equal(t, tcp.Reject,
+		peers[2].InstallSnapshot(chunk(5, len(data))).Type)
+	assert.EqualValues(t, 0, logs[2].LastExecuted())
+}
+
 func TestReplay(t *testing.T) {
 	initPeers()
 	defer tearDownServers()
@@ -590,7 +793,7 @@ func TestReplay(t *testing.T) {
 
 	newBallot := peers[0].NextBallot()
 	peers[0].BecomeLeader(newBallot, logs[0].LastIndex())
-	peers[0].Replay(newBallot, replayLog)
+	peers[0].Replay(newBallot, index3, replayLog)
 
 	assert.True(t, log.IsEqualInstance(util.MakeInstanceWithAll(newBallot,
 		index1, tcp.Committed, tcp.Put),
@@ -613,6 +816,769 @@ func TestReplay(t *testing.T) {
 		logs[1].At(index3)))
 }
 
+func TestReplayFillsHoles(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+	StartPeerConnection(0)
+	StartPeerConnection(1)
+
+	const (
+		index1 int64 = iota + 1
+		index2
+		index3
+	)
+	ballot := peers[0].NextBallot()
+	replayLog := map[int64]*tcp.Instance{
+		index1: util.MakeInstanceWithAll(ballot, index1,
+			tcp.Inprogress, tcp.Put),
+		index3: util.MakeInstanceWithAll(ballot, index3,
+			tcp.Inprogress, tcp.Del),
+	}
+
+	peers[0].BecomeLeader(ballot, index3)
+	peers[0].Replay(ballot, index3, replayLog)
+
+	noop := util.MakeInstanceWithAll(ballot, index2, tcp.Committed, tcp.Noop)
+	noop.ClientId = NoopClientId
+	assert.True(t, log.IsEqualInstance(noop, logs[0].At(index2)))
+	noop.State = tcp.Inprogress
+	assert.True(t, log.IsEqualInstance(noop, logs[1].At(index2)))
+
+	result := kvstore.Execute(noop.Command, stores[0])
+	assert.True(t, result.Ok)
+	assert.Equal(t, kvstore.Empty, result.Value)
+}
+
+func TestReplayLatency(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+	StartPeerConnection(0)
+	StartPeerConnection(1)
+
+	const numInstances int64 = 4000
+	ballot := peers[0].NextBallot()
+	replayLog := make(map[int64]*tcp.Instance, numInstances)
+	for i := int64(1); i <= numInstances; i++ {
+		replayLog[i] = util.MakeInstanceWithAll(ballot, i, tcp.Inprogress,
+			tcp.Put)
+	}
+
+	peers[0].BecomeLeader(ballot, numInstances)
+	start := time.Now()
+	peers[0].Replay(ballot, numInstances, replayLog)
+	t.Logf("replayed %v instances in %v", numInstances, time.Since(start))
+
+	for i := int64(1); i <= numInstances; i++ {
+		assert.Equal(t, tcp.Committed, logs[0].At(i).State)
+		assert.NotNil(t, logs[1].At(i))
+	}
+}
+
+func TestReplicateBatch(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+	StartPeerConnection(0)
+	StartPeerConnection(1)
+
+	peers[0].batchSize = 3
+	peers[0].batchDelay = 10
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+
+	var wg sync.WaitGroup
+	results := make([]Result, 3)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = peers[0].Replicate(&tcp.Command{}, int64(i))
+		}(i)
+	}
+	wg.Wait()
+	for _, r := range results {
+		assert.Equal(t, Ok, r.Type)
+	}
+	assert.EqualValues(t, 1, logs[0].LastIndex())
+	batch := logs[0].At(1).Command
+	assert.Equal(t, tcp.Batch, batch.Type)
+	assert.Len(t, batch.Commands, 3)
+	assert.ElementsMatch(t, []int64{0, 1, 2}, batch.ClientIds)
+
+	r := peers[0].Replicate(&tcp.Command{}, 0)
+	assert.Equal(t, Ok, r.Type)
+	assert.EqualValues(t, 2, logs[0].LastIndex())
+	assert.True(t, log.IsEqualCommand(&tcp.Command{}, logs[0].At(2).Command))
+}
+
+func TestAcceptWindow(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+	peers[0].windowSize = 2
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, 0)
+
+	peers[0].acquireWindow(ballot, 1)
+	peers[0].acquireWindow(ballot, 2)
+	acquired := make(chan struct{})
+	go func() {
+		peers[0].acquireWindow(ballot, 3)
+		close(acquired)
+	}()
+
+	peers[0].releaseWindow(2)
+	select {
+	case <-acquired:
+		t.Fatal("acquired a slot past an unfinished index")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	peers[0].releaseWindow(1)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("slot not released in index order")
+	}
+	assert.EqualValues(t, 2, peers[0].windowCommitted)
+
+	peers[0].acquireWindow(ballot, 4)
+	blocked := make(chan struct{})
+	go func() {
+		peers[0].acquireWindow(ballot, 5)
+		close(blocked)
+	}()
+	peers[0].BecomeFollower(peers[1].NextBallot())
+	select {
+	case <-blocked:
+	case <-time.After(time.Second):
+		t.Fatal("stale proposer still waiting on the window")
+	}
+}
+
+func TestLeaseRead(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+	for i, peer := range peers {
+		StartPeerConnection(int64(i))
+		peer.leaseDuration = 1000
+	}
+
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+	get := &tcp.Command{Type: tcp.Get, Key: "foo"}
+	_, ok := peers[0].LeaseRead(get)
+	assert.False(t, ok)
+
+	peers[0].RunCommitPhase(ballot, 0)
+	stores[0].Put("foo", "bar")
+	result, ok := peers[0].LeaseRead(get)
+	assert.True(t, ok)
+	assert.Equal(t, "bar", result.Value)
+	_, ok = peers[1].LeaseRead(get)
+	assert.False(t, ok)
+
+	// a round that finishes while leadership is being transferred does not
+	// extend the lease.
+	atomic.StoreInt32(&peers[0].transferring, 1)
+	_, ok = peers[0].LeaseRead(get)
+	assert.False(t, ok)
+	peers[0].leaseMu.Lock()
+	peers[0].leaseExpiry = time.Time{}
+	peers[0].leaseMu.Unlock()
+	peers[0].RunCommitPhase(ballot, 0)
+	atomic.StoreInt32(&peers[0].transferring, 0)
+	_, ok = peers[0].LeaseRead(get)
+	assert.False(t, ok)
+
+	prepare := tcp.PrepareRequest{Ballot: peers[2].NextBallot(), Sender: 2}
+	assert.Equal(t, tcp.Reject, peers[1].Prepare(prepare).Type)
+
+	time.Sleep(1100 * time.Millisecond)
+	_, ok = peers[0].LeaseRead(get)
+	assert.False(t, ok)
+	assert.Equal(t, tcp.Ok, peers[1].Prepare(prepare).Type)
+}
+
+func TestReadIndexRead(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+	for i := range peers {
+		StartPeerConnection(int64(i))
+	}
+	ballot := peers[0].NextBallot()
+	logs[0].Append(util.MakeInstanceWithType(ballot, 1, tcp.Put))
+	peers[0].BecomeLeader(ballot, 1)
+	peers[0].readMode = ReadModeReadIndex
+	stores[0].Put("foo", "bar")
+	get := &tcp.Command{Type: tcp.Get, Key: "foo"}
+
+	done := make(chan kvstore.KVResult, 1)
+	go func() {
+		result, ok := peers[0].Read(get)
+		assert.True(t, ok)
+		done <- result
+	}()
+	select {
+	case <-done:
+		t.Fatal("read answered before the log caught up")
+	case <-time.After(100 * time.Millisecond):
+	}
+	logs[0].Commit(1)
+	logs[0].Execute()
+	select {
+	case result := <-done:
+		assert.Equal(t, "bar", result.Value)
+	case <-time.After(time.Second):
+		t.Fatal("read not answered after the log caught up")
+	}
+
+	_, ok := peers[1].ReadIndexRead(get)
+	assert.False(t, ok)
+
+	newBallot := peers[2].NextBallot()
+	peers[1].BecomeFollower(newBallot)
+	peers[2].BecomeFollower(newBallot)
+	_, ok = peers[0].ReadIndexRead(get)
+	assert.False(t, ok)
+	assert.False(t, IsLeaderByPeer(peers[0]))
+}
+
+func TestReconfigure(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+	for i := range peers {
+		StartPeerConnection(int64(i))
+	}
+	for i := range logs {
+		go func(l *log.Log) {
+			for {
+				if _, result := l.Execute(); result == nil {
+					return
+				}
+			}
+		}(logs[i])
+		defer logs[i].Stop()
+	}
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+
+	r := peers[0].RemovePeer(2, NoopClientId)
+	assert.EqualValues(t, Ok, r.Type)
+	assert.Len(t, peers[0].Members(), 2)
+	assert.Len(t, peers[0].currentPeers(), 2)
+	// the accept phase returns at a quorum, so the accept may reach peer 1
+	// after a commit does.
+	assert.Eventually(t, func() bool {
+		peers[0].RunCommitPhase(ballot, 0)
+		return logs[1].LastExecuted() == logs[0].LastIndex()
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Len(t, peers[1].Members(), 2)
+
+	r = peers[0].AddPeer(2, configs[2].Peers[2], NoopClientId)
+	assert.EqualValues(t, Ok, r.Type)
+	assert.Equal(t, configs[2].Peers[2], peers[0].Members()[2])
+	assert.Len(t, peers[0].currentPeers(), 3)
+	serverOn[1].Store(false)
+	assert.True(t, peers[0].confirmLeadership(ballot))
+
+	r = peers[0].RemovePeer(1, NoopClientId)
+	assert.EqualValues(t, Ok, r.Type)
+	assert.Len(t, peers[0].currentPeers(), 2)
+	// with two peers left, the leader cannot form a quorum on its own.
+	serverOn[2].Store(false)
+	assert.False(t, peers[0].confirmLeadership(ballot))
+}
+
+func TestPreVote(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+	for i := range peers {
+		StartPeerConnection(int64(i))
+	}
+
+	// no peer has heard from a leader yet, so all of them take part.
+	assert.True(t, peers[1].runPreVotePhase(peers[1].NextBallot()))
+
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+	assert.True(t, peers[0].confirmLeadership(ballot))
+
+	// peer 2 still hears from the leader, so peer 1 cannot start an election
+	// and nobody raises their ballot.
+	assert.False(t, peers[1].runPreVotePhase(peers[1].NextBallot()))
+	for _, peer := range peers {
+		assert.Equal(t, ballot, peer.Ballot())
+	}
+
+	time.Sleep(time.Duration(peers[2].electionTimeoutMin) * time.Millisecond)
+	assert.True(t, peers[1].runPreVotePhase(peers[1].NextBallot()))
+}
+
+func TestCheckQuorum(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+	for i := range peers {
+		StartPeerConnection(int64(i))
+	}
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+	peers[0].StartHeartbeatThread()
+	defer peers[0].StopHeartbeatThread()
+	electionTimeout := time.Duration(peers[0].electionTimeoutMin) *
+		time.Millisecond
+
+	// peer 1 still acknowledges the heartbeats, so the leader keeps a quorum.
+	serverOn[2].Store(false)
+	time.Sleep(2 * electionTimeout)
+	assert.Equal(t, ballot, peers[0].Ballot())
+
+	serverOn[1].Store(false)
+	assert.Eventually(t, func() bool {
+		return !IsLeaderByPeer(peers[0])
+	}, 2*electionTimeout, 10*time.Millisecond)
+	assert.True(t, ballot.Less(peers[0].Ballot()))
+	r := peers[0].Replicate(&tcp.Command{}, 0)
+	assert.Equal(t, Retry, r.Type)
+}
+
+func TestTransferLeadership(t *testing.T) {
+	initPeers()
+	defer tearDown()
+	for i := range peers {
+		StartPeerConnection(int64(i))
+	}
+	peers[0].BecomeLeader(peers[0].NextBallot(), logs[0].LastIndex())
+	for _, peer := range peers {
+		peer.Start()
+	}
+	r := peers[0].Replicate(&tcp.Command{}, 0)
+	assert.Equal(t, Ok, r.Type)
+
+	r = peers[1].TransferLeadership(2)
+	assert.EqualValues(t, SomeElseLeader, r.Type)
+	assert.EqualValues(t, 0, r.Leader)
+
+	r = peers[0].TransferLeadership(2)
+	assert.Equal(t, Ok, r.Type)
+	assert.EqualValues(t, 2, r.Leader)
+	// peer 0 learns of the new ballot from peer 2's prepare request, before
+	// peer 2 becomes the leader.
+	assert.Eventually(t, func() bool {
+		return IsLeaderByPeer(peers[2])
+	}, time.Second, 10*time.Millisecond)
+	assert.False(t, IsLeaderByPeer(peers[0]))
+
+	r = peers[0].Replicate(&tcp.Command{}, 0)
+	assert.EqualValues(t, SomeElseLeader, r.Type)
+	assert.EqualValues(t, 2, r.Leader)
+	r = peers[2].Replicate(&tcp.Command{}, 0)
+	assert.Equal(t, Ok, r.Type)
+}
+
+func TestTimeoutNowDroppedAfterBallotChange(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+
+	r := peers[1].TimeoutNow(tcp.TimeoutNowRequest{
+		Ballot: peers[0].NextBallot(),
+		Sender: 0,
+	})
+	assert.Equal(t, tcp.Ok, r.Type)
+	// the transfer failed and another leader took over since, so the request
+	// no longer starts an election.
+	peers[1].BecomeFollower(peers[2].NextBallot())
+	assert.False(t, peers[1].sleepForRandomInterval())
+
+	r = peers[1].TimeoutNow(tcp.TimeoutNowRequest{
+		Ballot: peers[1].Ballot(),
+		Sender: 2,
+	})
+	assert.Equal(t, tcp.Ok, r.Type)
+	assert.True(t, peers[1].sleepForRandomInterval())
+}
+
+func TestPriority(t *testing.T) {
+	initPeers()
+	defer tearDown()
+	for i, peer := range peers {
+		StartPeerConnection(int64(i))
+		peer.priorities = []int64{0, 2, 1}
+		peer.commitInterval = 10
+	}
+	assert.EqualValues(t, 2, peers[0].outranked())
+	assert.EqualValues(t, 0, peers[1].outranked())
+	assert.EqualValues(t, 1, peers[2].outranked())
+
+	// both other peers outrank peer 0 and would run first, so peer 0 gets no
+	// prevote quorum.
+	assert.False(t, peers[0].runPreVotePhase(peers[0].NextBallot()))
+	assert.True(t, peers[1].runPreVotePhase(peers[1].NextBallot()))
+
+	// peer 0 hands leadership on until it lands on peer 1.
+	peers[0].BecomeLeader(peers[0].NextBallot(), logs[0].LastIndex())
+	for _, peer := range peers {
+		peer.Start()
+	}
+	assert.Eventually(t, func() bool {
+		return IsLeaderByPeer(peers[1])
+	}, 5*time.Second, 10*time.Millisecond)
+	r := peers[1].Replicate(&tcp.Command{}, 0)
+	assert.Equal(t, Ok, r.Type)
+	assert.True(t, IsLeaderByPeer(peers[1]))
+}
+
+func TestHeartbeatPrefersLeader(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+	for i, peer := range peers {
+		StartPeerConnection(int64(i))
+		peer.priorities = []int64{0, 2, 0}
+	}
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+
+	// no commit round runs, so only heartbeat responses show that peer 1 is
+	// caught up. Peer 1 runs no election of its own, so the request to take
+	// over can only come from peer 0.
+	assert.Eventually(t, func() bool {
+		peers[0].runHeartbeatPhase(ballot, 0, peers[0].rpcTimeout)
+		return len(peers[1].electNow) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestPriorityBehindSnapshot(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+	StartPeerConnection(0)
+	StartPeerConnection(1)
+	for _, peer := range peers {
+		peer.priorities = []int64{0, 2, 0}
+	}
+	// peer 0 trimmed an instance that peer 1 never executed.
+	logs[0].SetSnapshotInterval(1)
+	logs[0].Append(util.MakeInstanceWithState(tcp.Ballot{}, 1, tcp.Committed))
+	logs[0].Execute()
+
+	// peer 1 cannot lead and peer 2 is down, so peer 1 takes part in an
+	// election of peer 0 although it outranks it.
+	_, log := peers[1].RunPreparePhase(peers[1].NextBallot())
+	assert.Nil(t, log)
+	assert.True(t, peers[0].runPreVotePhase(peers[0].NextBallot()))
+}
+
+func TestPhasesWithDeadPeers(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+	for i := range peers {
+		StartPeerConnection(int64(i))
+	}
+	peers[0].rpcTimeout = 200
+	peers[0].rpcRetries = 1
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+
+	// peer 2 dies while it holds the accept request; peer 1 still makes a
+	// quorum.
+	serverOn[2].Store(false)
+	time.AfterFunc(100*time.Millisecond, func() { killPeer(2) })
+	r := peers[0].RunAcceptPhase(ballot, logs[0].AdvanceLastIndex(),
+		&tcp.Command{}, 0)
+	assert.Equal(t, Ok, r.Type)
+
+	start := time.Now()
+	assert.EqualValues(t, 0, peers[0].RunCommitPhase(ballot, 0))
+	assert.Less(t, time.Since(start), time.Second)
+
+	// with peer 1 gone as well, the phases give up after the retries.
+	serverOn[1].Store(false)
+	time.AfterFunc(100*time.Millisecond, func() { killPeer(1) })
+	r = peers[0].RunAcceptPhase(ballot, logs[0].AdvanceLastIndex(),
+		&tcp.Command{}, 0)
+	assert.Equal(t, Retry, r.Type)
+	assert.True(t, IsLeaderByPeer(peers[0]))
+	assert.False(t, peers[0].confirmLeadership(ballot))
+
+	_, log := peers[0].RunPreparePhase(peers[0].NextBallot())
+	assert.Nil(t, log)
+}
+
+func TestAcceptRetriedAfterTimeout(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+	StartPeerConnection(0)
+	peers[0].rpcTimeout = 100
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+
+	// no follower answers the accept in time, so it is run again until one
+	// does instead of leaving its index unchosen.
+	put := &tcp.Command{Type: tcp.Put, Key: "foo", Value: "bar"}
+	result := peers[0].ReplicateAsync(put, 0)
+	select {
+	case <-result:
+		t.Fatal("accept finished without a quorum")
+	case <-time.After(300 * time.Millisecond):
+	}
+	StartPeerConnection(1)
+	assert.Equal(t, Ok, (<-result).Type)
+
+	// and a later write executes after it.
+	put = &tcp.Command{Type: tcp.Put, Key: "foo", Value: "baz"}
+	assert.Equal(t, Ok, peers[0].Replicate(put, 0).Type)
+	logs[0].Execute()
+	logs[0].Execute()
+	assert.Equal(t, "baz", *stores[0].Get("foo"))
+}
+
+func TestFailover(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+	for i := range peers {
+		StartPeerConnection(int64(i))
+		peers[i].Start()
+	}
+	assert.Eventually(t, func() bool {
+		leader := oneLeader()
+		return leader != -1 && leader != tcp.NoLeader
+	}, 2*time.Second, 10*time.Millisecond)
+	leader := oneLeader()
+	defer func() {
+		for i, peer := range peers {
+			if int64(i) != leader {
+				peer.Stop()
+			}
+		}
+	}()
+
+	// no commit is due for seconds, but heartbeats keep the followers from
+	// electing another leader.
+	ballot := peers[leader].Ballot()
+	time.Sleep(time.Second)
+	for _, peer := range peers {
+		assert.Equal(t, ballot, peer.Ballot())
+	}
+
+	killPeer(leader)
+	peers[leader].Stop()
+	follower := (leader + 1) % NumPeers
+	assert.Eventually(t, func() bool {
+		newLeader := LeaderByPeer(peers[follower])
+		return newLeader != leader && newLeader != tcp.NoLeader
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestQuorums(t *testing.T) {
+	q1, q2 := quorums(0, 0, 5)
+	assert.Equal(t, 3, q1)
+	assert.Equal(t, 3, q2)
+	q1, q2 = quorums(0, 2, 5)
+	assert.Equal(t, 4, q1)
+	assert.Equal(t, 2, q2)
+	q1, q2 = quorums(4, 0, 5)
+	assert.Equal(t, 4, q1)
+	assert.Equal(t, 2, q2)
+
+	p := Multipaxos{prepareQuorum: 2, acceptQuorum: 2}
+	assert.True(t, p.validQuorums(3, 3))
+	assert.False(t, p.validQuorums(4, 4))
+	assert.False(t, p.validQuorums(3, 4))
+	p = Multipaxos{prepareQuorum: 3, acceptQuorum: 2}
+	assert.True(t, p.validQuorums(4, 4))
+	assert.False(t, p.validQuorums(3, 2))
+	p = Multipaxos{acceptQuorum: 1}
+	assert.True(t, p.validQuorums(3, 3))
+	// a value only the leader accepted is lost if either change leaves it out.
+	assert.False(t, p.validQuorums(3, 4))
+	assert.False(t, p.validQuorums(4, 3))
+}
+
+func TestFlexibleQuorums(t *testing.T) {
+	initPeers()
+	defer tearDownServers()
+	StartPeerConnection(0)
+	peers[0].prepareQuorum = 3
+	peers[0].acceptQuorum = 1
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+
+	// the leader makes an accept quorum on its own.
+	index := logs[0].AdvanceLastIndex()
+	r := peers[0].RunAcceptPhase(ballot, index, &tcp.Command{}, 0)
+	assert.Equal(t, Ok, r.Type)
+	assert.True(t, log.IsCommitted(logs[0].At(index)))
+
+	// but a prepare phase needs every peer.
+	StartPeerConnection(1)
+	nextBallot := peers[0].NextBallot()
+	_, instances := peers[0].RunPreparePhase(nextBallot)
+	assert.Nil(t, instances)
+	StartPeerConnection(2)
+	_, instances = peers[0].RunPreparePhase(tcp.Ballot{Round: nextBallot.Round + 1,
+		Id: nextBallot.Id})
+	assert.NotNil(t, instances)
+}
+
+func TestLearner(t *testing.T) {
+	setup()
+	defer tearDownServers()
+	for i := int64(0); i < NumPeers; i++ {
+		configs[i].Learners = configs[i].Peers[NumPeers-1:]
+		configs[i].Peers = configs[i].Peers[:NumPeers-1]
+		setupOnePeer(i)
+	}
+	assert.False(t, peers[0].IsLearner())
+	assert.True(t, peers[2].IsLearner())
+	StartPeerConnection(0)
+	StartPeerConnection(2)
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+
+	// the learner accepts but does not count toward the quorum.
+	index1 := logs[0].AdvanceLastIndex()
+	r := peers[0].RunAcceptPhase(ballot, index1, &tcp.Command{}, 0)
+	assert.Equal(t, Retry, r.Type)
+	assert.Eventually(t, func() bool { return logs[2].At(index1) != nil },
+		time.Second, 10*time.Millisecond)
+
+	StartPeerConnection(1)
+	index2 := logs[0].AdvanceLastIndex()
+	command := &tcp.Command{Type: tcp.Put, Key: "foo", Value: "bar"}
+	r = peers[0].RunAcceptPhase(ballot, index2, command, 0)
+	assert.Equal(t, Ok, r.Type)
+
+	// and executes what is committed into its own store.
+	logs[0].Commit(index1)
+	logs[0].Execute()
+	logs[0].Execute()
+	peers[0].RunCommitPhase(ballot, 0)
+	assert.Eventually(t, func() bool {
+		return log.IsCommitted(logs[2].At(index1)) &&
+			log.IsCommitted(logs[2].At(index2))
+	}, time.Second, 10*time.Millisecond)
+	assert.EqualValues(t, 0, peers[2].trimIndex(index2))
+	logs[2].Execute()
+	logs[2].Execute()
+	assert.Equal(t, "bar", *stores[2].Get("foo"))
+	assert.EqualValues(t, index2, peers[2].trimIndex(index2))
+}
+
+func TestLearnerJoinsLate(t *testing.T) {
+	setup()
+	defer tearDownServers()
+	for i := int64(0); i < NumPeers; i++ {
+		configs[i].Learners = configs[i].Peers[NumPeers-1:]
+		configs[i].Peers = configs[i].Peers[:NumPeers-1]
+		setupOnePeer(i)
+	}
+	StartPeerConnection(0)
+	StartPeerConnection(1)
+	ballot := peers[0].NextBallot()
+	peers[0].BecomeLeader(ballot, logs[0].LastIndex())
+
+	// the leader trims what the learner never saw.
+	const (
+		index1 int64 = iota + 1
+		index2
+	)
+	logs[0].SetSnapshotInterval(index2)
+	for _, index := range []int64{index1, index2} {
+		instance := util.MakeInstanceWithAll(ballot, index, tcp.Committed,
+			tcp.Put)
+		instance.Command.Key = "foo"
+		logs[0].Append(instance)
+		logs[0].Execute()
+	}
+	assert.Nil(t, logs[0].At(index1))
+
+	// so the learner that comes up later gets the snapshot.
+	StartPeerConnection(2)
+	assert.Eventually(t, func() bool {
+		peers[0].RunCommitPhase(ballot, 0)
+		return logs[2].LastExecuted() == index2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NotNil(t, stores[2].Get("foo"))
+}
+
+func TestWitness(t *testing.T) {
+	setup()
+	defer tearDown()
+	for i := int64(0); i < NumPeers; i++ {
+		configs[i].Witnesses = []int64{0, 1}
+		setupOnePeer(i)
+		StartPeerConnection(i)
+	}
+	assert.True(t, peers[0].IsWitness())
+	assert.False(t, peers[2].IsWitness())
+	peers[0].BecomeLeader(peers[0].NextBallot(), logs[0].LastIndex())
+	for _, peer := range peers {
+		peer.Start()
+	}
+
+	// a witness leader does not serve clients.
+	r := peers[0].Replicate(&tcp.Command{}, 0)
+	assert.Equal(t, Retry, r.Type)
+	_, ok := peers[0].Read(&tcp.Command{Type: tcp.Get})
+	assert.False(t, ok)
+
+	// and hands leadership to a full replica, never to another witness.
+	r = peers[0].TransferLeadership(1)
+	assert.Equal(t, Retry, r.Type)
+	assert.True(t, peers[0].handOff())
+	assert.Eventually(t, func() bool {
+		return IsLeaderByPeer(peers[2])
+	}, time.Second, 10*time.Millisecond)
+	r = peers[2].Replicate(&tcp.Command{}, 0)
+	assert.Equal(t, Ok, r.Type)
+}
+
+func TestGroups(t *testing.T) {
+	initPeers()
+	defer tearDown()
+	groupLogs := make([]*log.Log, NumPeers)
+	groups := make([]*Multipaxos, NumPeers)
+	for i := int64(0); i < NumPeers; i++ {
+		StartPeerConnection(i)
+		groupLogs[i] = log.NewLog(kvstore.NewMemKVStore(), nil)
+		groups[i] = NewGroupMultipaxos(groupLogs[i], configs[i], 1,
+			peers[i].mux)
+	}
+	defer func() {
+		for _, group := range groups {
+			group.Stop()
+		}
+	}()
+	// both groups on a peer share its links to the others.
+	assert.Equal(t, 2, peers[0].mux.links[configs[0].Peers[1]].refs)
+
+	// each group elects its own leader.
+	peers[0].BecomeLeader(peers[0].NextBallot(), logs[0].LastIndex())
+	groups[1].BecomeLeader(groups[1].NextBallot(), groupLogs[1].LastIndex())
+	for i := range peers {
+		peers[i].Start()
+		groups[i].Start()
+	}
+	assert.Eventually(t, func() bool {
+		return LeaderByPeer(peers[2]) == 0 && LeaderByPeer(groups[2]) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// and keeps its own log.
+	put := func(value string) *tcp.Command {
+		return &tcp.Command{Type: tcp.Put, Key: "foo", Value: value}
+	}
+	accepted := func(l *log.Log, index int64, value string) func() bool {
+		return func() bool {
+			instance := l.At(index)
+			return instance != nil && instance.Command.Value == value
+		}
+	}
+	assert.Equal(t, Ok, peers[0].Replicate(put("bar"), 0).Type)
+	assert.Equal(t, Ok, groups[1].Replicate(put("baz"), 0).Type)
+	assert.Eventually(t, accepted(logs[2], logs[0].LastIndex(), "bar"),
+		time.Second, 10*time.Millisecond)
+	assert.Eventually(t, accepted(groupLogs[2], groupLogs[1].LastIndex(),
+		"baz"), time.Second, 10*time.Millisecond)
+	assert.Equal(t, SomeElseLeader, groups[0].Replicate(put("qux"), 0).Type)
+}
+
 func TestReplicate(t *testing.T) {
 	initPeers()
 	defer tearDown()
@@ -658,16 +1624,19 @@ func oneLeader() int64 {
 }
 
 func StartPeerConnection(id int64) {
-	serverOn[id] = true
+	serverOn[id].Store(true)
 }
 
-func startServer(id int64, peer *Multipaxos) {
+func startServer(listener net.Listener, peer *Multipaxos) {
 	for {
-		client, err := peerListeners[id].Accept()
+		client, err := listener.Accept()
 		if err != nil {
 			logger.Error(err)
 			break
 		}
+		peerConnsMu.Lock()
+		peerConns[peer.id] = append(peerConns[peer.id], client)
+		peerConnsMu.Unlock()
 		go func(client net.Conn) {
 			reader := bufio.NewReader(client)
 			writer := bufio.NewWriter(client)
@@ -683,12 +1652,36 @@ func startServer(id int64, peer *Multipaxos) {
 	}
 }
 
-func handlePeerRequest(multipaxos *Multipaxos,writer *bufio.Writer, line string) {
+// killPeer stops peer id from accepting connections and drops the ones it
+// has, along with any request it has not answered yet.
+func killPeer(id int64) {
+	peerListeners[id].Close()
+	peerConnsMu.Lock()
+	defer peerConnsMu.Unlock()
+	for _, conn := range peerConns[id] {
+		conn.Close()
+	}
+	peerConns[id] = nil
+}
+
+var writerLock sync.Mutex
+
+func writeResponse(writer *bufio.Writer, response string) {
+	writerLock.Lock()
+	defer writerLock.Unlock()
+	writer.WriteString(response + "\n")
+	writer.Flush()
+}
+
+func handlePeerRequest(multipaxos *Multipaxos, writer *bufio.Writer, line string) {
 	var request tcp.Message
 	err := json.Unmarshal([]byte(line), &request)
 	if err != nil {
 		return
 	}
+	if group, ok := multipaxos.mux.Group(request.Group); ok {
+		multipaxos = group
+	}
 
 	msg := []byte(request.Msg)
 	go func() {
@@ -696,9 +1689,9 @@ func handlePeerRequest(multipaxos *Multipaxos,writer *bufio.Writer, line string)
 		case tcp.PREPAREREQUEST:
 			prepareResponse := tcp.PrepareResponse{
 				Type:   tcp.Reject,
-				Ballot: 0,
+				Ballot: tcp.Ballot{},
 			}
-			if serverOn[multipaxos.id] {
+			if serverOn[multipaxos.id].Load() {
 				var prepareRequest tcp.PrepareRequest
 				json.Unmarshal(msg, &prepareRequest)
 				prepareResponse = multipaxos.Prepare(prepareRequest)
@@ -712,14 +1705,13 @@ func handlePeerRequest(multipaxos *Multipaxos,writer *bufio.Writer, line string)
 				Msg:       string(responseJson),
 			})
 			logger.Info(string(tcpMessage))
-			writer.WriteString(string(tcpMessage) + "\n")
-			writer.Flush()
+			writeResponse(writer, string(tcpMessage))
 		case tcp.ACCEPTREQUEST:
 			acceptResponse := tcp.AcceptResponse{
 				Type:   tcp.Reject,
-				Ballot: 0,
+				Ballot: tcp.Ballot{},
 			}
-			if serverOn[multipaxos.id] {
+			if serverOn[multipaxos.id].Load() {
 				var acceptRequest tcp.AcceptRequest
 				json.Unmarshal(msg, &acceptRequest)
 				acceptResponse = multipaxos.Accept(acceptRequest)
@@ -732,14 +1724,13 @@ func handlePeerRequest(multipaxos *Multipaxos,writer *bufio.Writer, line string)
 				ChannelId: request.ChannelId,
 				Msg:       string(responseJson),
 			})
-			writer.WriteString(string(tcpMessage) + "\n")
-			writer.Flush()
+			writeResponse(writer, string(tcpMessage))
 		case tcp.COMMITREQUEST:
 			commitResponse := tcp.CommitResponse{
-				Type:         tcp.Reject,
-				Ballot:       0,
+				Type:   tcp.Reject,
+				Ballot: tcp.Ballot{},
 			}
-			if serverOn[multipaxos.id] {
+			if serverOn[multipaxos.id].Load() {
 				var commitRequest tcp.CommitRequest
 				json.Unmarshal(msg, &commitRequest)
 				commitResponse = multipaxos.Commit(commitRequest)
@@ -752,8 +1743,103 @@ func handlePeerRequest(multipaxos *Multipaxos,writer *bufio.Writer, line string)
 				ChannelId: request.ChannelId,
 				Msg:       string(responseJson),
 			})
-			writer.WriteString(string(tcpMessage) + "\n")
-			writer.Flush()
+			writeResponse(writer, string(tcpMessage))
+		case tcp.INSTALLSNAPSHOTREQUEST:
+			installSnapshotResponse := tcp.InstallSnapshotResponse{
+				Type:   tcp.Reject,
+				Ballot: tcp.Ballot{},
+			}
+			if serverOn[multipaxos.id].Load() {
+				var installSnapshotRequest tcp.InstallSnapshotRequest
+				json.Unmarshal(msg, &installSnapshotRequest)
+				installSnapshotResponse = multipaxos.InstallSnapshot(
+					installSnapshotRequest)
+			} else {
+				time.Sleep(500 * time.Millisecond)
+			}
+			responseJson, _ := json.Marshal(installSnapshotResponse)
+			tcpMessage, _ := json.Marshal(tcp.Message{
+				Type:      uint8(tcp.INSTALLSNAPSHOTRESPONSE),
+				ChannelId: request.ChannelId,
+				Msg:       string(responseJson),
+			})
+			writeResponse(writer, string(tcpMessage))
+		case tcp.TIMEOUTNOWREQUEST:
+			timeoutNowResponse := tcp.TimeoutNowResponse{
+				Type:   tcp.Reject,
+				Ballot: tcp.Ballot{},
+			}
+			if serverOn[multipaxos.id].Load() {
+				var timeoutNowRequest tcp.TimeoutNowRequest
+				json.Unmarshal(msg, &timeoutNowRequest)
+				timeoutNowResponse = multipaxos.TimeoutNow(timeoutNowRequest)
+			} else {
+				time.Sleep(500 * time.Millisecond)
+			}
+			responseJson, _ := json.Marshal(timeoutNowResponse)
+			tcpMessage, _ := json.Marshal(tcp.Message{
+				Type:      uint8(tcp.TIMEOUTNOWRESPONSE),
+				ChannelId: request.ChannelId,
+				Msg:       string(responseJson),
+			})
+			writeResponse(writer, string(tcpMessage))
+		case tcp.HEARTBEATREQUEST:
+			heartbeatResponse := tcp.HeartbeatResponse{
+				Type:   tcp.Reject,
+				Ballot: tcp.Ballot{},
+			}
+			if serverOn[multipaxos.id].Load() {
+				var heartbeatRequest tcp.HeartbeatRequest
+				json.Unmarshal(msg, &heartbeatRequest)
+				heartbeatResponse = multipaxos.Heartbeat(heartbeatRequest)
+			} else {
+				time.Sleep(500 * time.Millisecond)
+			}
+			responseJson, _ := json.Marshal(heartbeatResponse)
+			tcpMessage, _ := json.Marshal(tcp.Message{
+				Type:      uint8(tcp.HEARTBEATRESPONSE),
+				ChannelId: request.ChannelId,
+				Msg:       string(responseJson),
+			})
+			writeResponse(writer, string(tcpMessage))
+		case tcp.PREVOTEREQUEST:
+			preVoteResponse := tcp.PreVoteResponse{
+				Type:   tcp.Reject,
+				Ballot: tcp.Ballot{},
+			}
+			if serverOn[multipaxos.id].Load() {
+				var preVoteRequest tcp.PreVoteRequest
+				json.Unmarshal(msg, &preVoteRequest)
+				preVoteResponse = multipaxos.PreVote(preVoteRequest)
+			} else {
+				time.Sleep(500 * time.Millisecond)
+			}
+			responseJson, _ := json.Marshal(preVoteResponse)
+			tcpMessage, _ := json.Marshal(tcp.Message{
+				Type:      uint8(tcp.PREVOTERESPONSE),
+				ChannelId: request.ChannelId,
+				Msg:       string(responseJson),
+			})
+			writeResponse(writer, string(tcpMessage))
+		case tcp.CATCHUPREQUEST:
+			catchUpResponse := tcp.CatchUpResponse{
+				Type:   tcp.Reject,
+				Ballot: tcp.Ballot{},
+			}
+			if serverOn[multipaxos.id].Load() {
+				var catchUpRequest tcp.CatchUpRequest
+				json.Unmarshal(msg, &catchUpRequest)
+				catchUpResponse = multipaxos.CatchUp(catchUpRequest)
+			} else {
+				time.Sleep(500 * time.Millisecond)
+			}
+			responseJson, _ := json.Marshal(catchUpResponse)
+			tcpMessage, _ := json.Marshal(tcp.Message{
+				Type:      uint8(tcp.CATCHUPRESPONSE),
+				ChannelId: request.ChannelId,
+				Msg:       string(responseJson),
+			})
+			writeResponse(writer, string(tcpMessage))
 		}
 	}()
-}
\ No newline at end of file
+}
@@ -0,0 +1,81 @@
+package multipaxos
+
+import (
+	logger "github.com/sirupsen/logrus"
+	tcp "github.com/sosp23/replicated-store/go/multipaxos/network"
+	"sync"
+)
+
+// A peer may host several consensus groups, each with its own log, ballot and
+// leader. The groups on a peer share a Mux, which keeps one link to every
+// other peer for all of them and tags each message with the group it is for,
+// so that the receiving peer hands it to the same group there.
+
+type Mux struct {
+	channels *tcp.ChannelMap
+	mu       sync.RWMutex
+	links    map[string]*muxLink
+	groups   map[int64]*Multipaxos
+}
+
+type muxLink struct {
+	link *tcp.TcpLink
+	refs int
+}
+
+func NewMux() *Mux {
+	return &Mux{
+		channels: &tcp.ChannelMap{
+			Channels: make(map[uint64]chan string),
+		},
+		links:  make(map[string]*muxLink),
+		groups: make(map[int64]*Multipaxos),
+	}
+}
+
+// Group returns consensus group id on this peer.
+func (m *Mux) Group(id int64) (*Multipaxos, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	p, ok := m.groups[id]
+	return p, ok
+}
+
+func (m *Mux) add(p *Multipaxos) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.groups[p.group]; ok {
+		logger.Panicf("group %v already exists", p.group)
+	}
+	m.groups[p.group] = p
+}
+
+// link returns the link to addr, opening it with the backoff of group p if no
+// group uses it yet.
+func (m *Mux) link(p *Multipaxos, addr string) *tcp.TcpLink {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.links[addr]
+	if !ok {
+		l = &muxLink{link: MakePeer(addr, m.channels, p.rpcBackoff,
+			p.heartbeatInterval)}
+		m.links[addr] = l
+	}
+	l.refs += 1
+	return l.link
+}
+
+// release closes the link to addr once no group uses it anymore.
+func (m *Mux) release(addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.links[addr]
+	if !ok {
+		return
+	}
+	l.refs -= 1
+	if l.refs == 0 {
+		l.link.Close()
+		delete(m.links, addr)
+	}
+}
@@ -10,9 +10,15 @@ const (
 type CommandType int32
 
 const (
-	Get CommandType = 0
-	Put CommandType = 1
-	Del CommandType = 2
+	Get        CommandType = 0
+	Put        CommandType = 1
+	Del        CommandType = 2
+	Noop       CommandType = 3
+	Batch      CommandType = 4
+	AddPeer    CommandType = 5
+	RemovePeer CommandType = 6
+	SetShards  CommandType = 7
+	Reshard    CommandType = 8
 )
 
 type InstanceState int32
@@ -32,16 +38,42 @@ const (
 	ACCEPTRESPONSE
 	COMMITREQUEST
 	COMMITRESPONSE
+	INSTALLSNAPSHOTREQUEST
+	INSTALLSNAPSHOTRESPONSE
+	TIMEOUTNOWREQUEST
+	TIMEOUTNOWRESPONSE
+	HEARTBEATREQUEST
+	HEARTBEATRESPONSE
+	PREVOTEREQUEST
+	PREVOTERESPONSE
+	CATCHUPREQUEST
+	CATCHUPRESPONSE
 )
 
+// Ballot orders proposals by round, then by the id of the peer that proposed
+// it. A ballot whose id is NoLeader stands for a round that no peer leads.
+type Ballot struct {
+	Round int64
+	Id    int64
+}
+
+const NoLeader int64 = -1
+
+// Less reports whether b orders before other.
+func (b Ballot) Less(other Ballot) bool {
+	return b.Round < other.Round || b.Round == other.Round && b.Id < other.Id
+}
+
 type Command struct {
-	Type  CommandType
-	Key   string
-	Value string
+	Type      CommandType
+	Key       string
+	Value     string
+	Commands  []*Command
+	ClientIds []int64
 }
 
 type Instance struct {
-	Ballot   int64
+	Ballot   Ballot
 	Index    int64
 	ClientId int64
 	State    InstanceState
@@ -49,14 +81,16 @@ type Instance struct {
 }
 
 type PrepareRequest struct {
-	Ballot int64
-	Sender int64
+	Ballot   Ballot
+	Sender   int64
+	Transfer bool
 }
 
 type PrepareResponse struct {
-	Type   ResponseType
-	Ballot int64
-	Logs   []*Instance
+	Type              ResponseType
+	Ballot            Ballot
+	Logs              []*Instance
+	LastIncludedIndex int64
 }
 
 type AcceptRequest struct {
@@ -66,11 +100,11 @@ type AcceptRequest struct {
 
 type AcceptResponse struct {
 	Type   ResponseType
-	Ballot int64
+	Ballot Ballot
 }
 
 type CommitRequest struct {
-	Ballot             int64
+	Ballot             Ballot
 	LastExecuted       int64
 	GlobalLastExecuted int64
 	Sender             int64
@@ -78,6 +112,66 @@ type CommitRequest struct {
 
 type CommitResponse struct {
 	Type         ResponseType
-	Ballot       int64
+	Ballot       Ballot
+	LastExecuted int64
+	Sender       int64
+}
+
+type InstallSnapshotRequest struct {
+	Ballot            Ballot
+	LastIncludedIndex int64
+	Offset            int64
+	Data              []byte
+	Done              bool
+	Sender            int64
+}
+
+type InstallSnapshotResponse struct {
+	Type         ResponseType
+	Ballot       Ballot
+	LastExecuted int64
+}
+
+type TimeoutNowRequest struct {
+	Ballot Ballot
+	Sender int64
+}
+
+type TimeoutNowResponse struct {
+	Type   ResponseType
+	Ballot Ballot
+}
+
+type HeartbeatRequest struct {
+	Ballot       Ballot
+	LastExecuted int64
+	Sender       int64
+}
+
+type HeartbeatResponse struct {
+	Type         ResponseType
+	Ballot       Ballot
 	LastExecuted int64
+	Sender       int64
+}
+
+type PreVoteRequest struct {
+	Ballot Ballot
+	Sender int64
+}
+
+type PreVoteResponse struct {
+	Type   ResponseType
+	Ballot Ballot
+}
+
+type CatchUpRequest struct {
+	Ballot    Ballot
+	Instances []*Instance
+	Sender    int64
+}
+
+type CatchUpResponse struct {
+	Type   ResponseType
+	Ballot Ballot
 }
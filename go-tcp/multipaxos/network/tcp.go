@@ -6,36 +6,57 @@ import (
 	"net"
 	"net/textproto"
 	"sync"
+	"time"
 )
 
+// Message carries a request to, or a response from, consensus group Group of
+// a peer. Every group a peer hosts shares its links to the other peers.
 type Message struct {
 	Type      uint8
+	Group     int64
 	ChannelId uint64
 	Msg       string
 }
 
+// ChannelMap routes responses to the requests awaiting them. Links that share
+// a map take channel ids from NextId, so that the ids are unique across them.
 type ChannelMap struct {
 	sync.Mutex
+	NextId   uint64
 	Channels map[uint64]chan string
 }
 
-func handleOutgoingRequests(stream net.Conn, requestChan chan string) {
-	for request := range requestChan {
-		request = request + "\n"
-		requestBuffer := []byte(request)
-		_, err := stream.Write(requestBuffer)
-		if err != nil {
+func handleOutgoingRequests(stream net.Conn, requestChan chan string,
+	done chan struct{}, broken chan struct{}) {
+	defer stream.Close()
+	for {
+		select {
+		case request := <-requestChan:
+			request = request + "\n"
+			requestBuffer := []byte(request)
+			_, err := stream.Write(requestBuffer)
+			if err != nil {
+				return
+			}
+		case <-done:
+			return
+		case <-broken:
 			return
 		}
 	}
 }
 
-func handleIncomingResponses(stream net.Conn, channels *ChannelMap) {
+// handleIncomingResponses closes broken when the connection fails. Requests
+// in flight on it are not answered; callers wait on their channels with a
+// deadline and send again.
+func handleIncomingResponses(stream net.Conn, channels *ChannelMap,
+	broken chan struct{}) {
+	defer close(broken)
 	reader := textproto.NewReader(bufio.NewReader(stream))
 	for {
 		line, err := reader.ReadLineBytes()
 		if err != nil {
-			break
+			return
 		}
 		var response Message
 		err = json.Unmarshal(line, &response)
@@ -45,31 +66,65 @@ func handleIncomingResponses(stream net.Conn, channels *ChannelMap) {
 		}
 		channels.Unlock()
 	}
-	channels.Lock()
-	defer channels.Unlock()
-	for key := range channels.Channels {
-		delete(channels.Channels, key)
-	}
 }
 
 type TcpLink struct {
 	requestChan chan string
+	done        chan struct{}
+	closeOnce   sync.Once
+	backoff     time.Duration
+	maxBackoff  time.Duration
 }
 
-func NewTcpLink(addr string, channels *ChannelMap) *TcpLink {
-	var stream net.Conn
+// NewTcpLink returns a link to addr that dials in the background and dials
+// again whenever the connection fails, until the link is closed. It waits
+// backoff before dialing again, doubling the wait up to maxBackoff. Requests
+// sent while the peer is unreachable are dropped.
+func NewTcpLink(addr string, channels *ChannelMap, backoff time.Duration,
+	maxBackoff time.Duration) *TcpLink {
+	link := &TcpLink{
+		requestChan: make(chan string),
+		done:        make(chan struct{}),
+		backoff:     backoff,
+		maxBackoff:  maxBackoff,
+	}
+	go link.connect(addr, channels)
+	return link
+}
+
+func (t *TcpLink) connect(addr string, channels *ChannelMap) {
+	backoff := t.backoff
 	for {
-		var err error
-		stream, err = net.Dial("tcp", addr)
+		stream, err := net.Dial("tcp", addr)
 		if err == nil {
-			break
+			backoff = t.backoff
+			broken := make(chan struct{})
+			go handleIncomingResponses(stream, channels, broken)
+			handleOutgoingRequests(stream, t.requestChan, t.done, broken)
+		}
+		if !t.drain(backoff) {
+			return
+		}
+		backoff *= 2
+		if backoff > t.maxBackoff {
+			backoff = t.maxBackoff
 		}
 	}
-	go handleIncomingResponses(stream, channels)
-	requestChan := make(chan string)
-	go handleOutgoingRequests(stream, requestChan)
-	return &TcpLink{
-		requestChan: requestChan,
+}
+
+// drain drops the requests sent while the peer is unreachable until d has
+// passed. It returns false if the link was closed meanwhile.
+func (t *TcpLink) drain(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-t.done:
+			return false
+		case <-t.requestChan:
+		case <-timer.C:
+			return true
+		}
 	}
 }
 
@@ -77,11 +132,20 @@ func (t *TcpLink) Start() {
 
 }
 
-func (t *TcpLink) SendAwaitResponse(msgType MessageType, channelId uint64, msg string) {
+func (t *TcpLink) Close() {
+	t.closeOnce.Do(func() { close(t.done) })
+}
+
+func (t *TcpLink) SendAwaitResponse(msgType MessageType, group int64,
+	channelId uint64, msg string) {
 	request, _ := json.Marshal(Message{
 		Type:      uint8(msgType),
+		Group:     group,
 		ChannelId: channelId,
 		Msg:       msg,
 	})
-	t.requestChan <- string(request)
+	select {
+	case t.requestChan <- string(request):
+	case <-t.done:
+	}
 }
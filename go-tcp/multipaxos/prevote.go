@@ -0,0 +1,100 @@
+package multipaxos
+
+import (
+	"encoding/json"
+	logger "github.com/sirupsen/logrus"
+	tcp "github.com/sosp23/replicated-store/go/multipaxos/network"
+	"sync/atomic"
+	"time"
+)
+
+// A peer whose election timer fires first asks the others whether they would
+// take part in an election, and only runs a prepare phase if a quorum agrees.
+// A peer agrees only if it has not heard from a leader within the minimum
+// election timeout itself. The probe changes no state on either side, so a
+// peer that was cut off from a healthy leader cannot force the leader out by
+// raising its ballot when it comes back.
+
+// leaderAlive reports whether this peer leads or heard from a leader within
+// the minimum election timeout.
+func (p *Multipaxos) leaderAlive() bool {
+	if IsLeader(p.Ballot(), p.id) {
+		return true
+	}
+	lastContact := atomic.LoadInt64(&p.lastContact)
+	timeout := time.Duration(p.electionTimeoutMin) * time.Millisecond
+	return lastContact != 0 && time.Since(time.Unix(0, lastContact)) < timeout
+}
+
+// runPreVotePhase reports whether a quorum would take part in a prepare phase
+// for ballot.
+func (p *Multipaxos) runPreVotePhase(ballot tcp.Ballot) bool {
+	peers := p.currentPeers()
+	numPeers := len(peers)
+	quorum := p.prepareQuorumOf(numPeers)
+	numOks := 1
+	if numOks >= quorum {
+		return true
+	}
+
+	request, _ := json.Marshal(tcp.PreVoteRequest{
+		Ballot: ballot,
+		Sender: p.id,
+	})
+	responseChan := make(chan string, numPeers)
+	for _, peer := range peers {
+		if peer.Id != p.id {
+			go func(peer *Peer) {
+				logger.Infof("%v sent prevote request to %v", p.id, peer.Id)
+				response, _ := p.call(peer, tcp.PREVOTEREQUEST, request,
+					p.rpcRetries, p.rpcTimeout)
+				responseChan <- response
+			}(peer)
+		}
+	}
+
+	// a peer that still hears from the leader says no, but the others may
+	// agree, so a rejection counts as a failure rather than ending the phase.
+	numFailures := 0
+	for {
+		response := <-responseChan
+		var preVoteResponse tcp.PreVoteResponse
+		if response != "" {
+			json.Unmarshal([]byte(response), &preVoteResponse)
+			if preVoteResponse.Type != tcp.Ok {
+				// catch up with a higher ballot, or the next probe fails too.
+				p.BecomeFollower(preVoteResponse.Ballot)
+			}
+		}
+		if response == "" || preVoteResponse.Type != tcp.Ok {
+			numFailures += 1
+			if numPeers-numFailures < quorum {
+				logger.Infof("%v lost the prevote for %v", p.id, ballot)
+				return false
+			}
+			continue
+		}
+		numOks += 1
+		if numOks >= quorum {
+			return true
+		}
+	}
+}
+
+// PreVote tells a peer whose election timer fired whether this peer would
+// take part in a prepare phase for the ballot in the request.
+func (p *Multipaxos) PreVote(request tcp.PreVoteRequest) tcp.PreVoteResponse {
+	logger.Infof("%v <--prevote-- %v", p.id, request.Sender)
+
+	if p.Ballot().Less(request.Ballot) && p.isMember(request.Sender) &&
+		!p.leaderAlive() && !p.outranks(request.Sender) {
+		return tcp.PreVoteResponse{
+			Type:   tcp.Ok,
+			Ballot: p.Ballot(),
+		}
+	}
+	return tcp.PreVoteResponse{
+		Type:   tcp.Reject,
+		Ballot: p.Ballot(),
+	}
+}
@@ -0,0 +1,57 @@
+package multipaxos
+
+import (
+	"sync/atomic"
+)
+
+// Peers with a higher priority in the configuration are preferred as leaders.
+// A peer that others outrank waits longer before it starts an election, and a
+// peer refuses a prevote to a candidate it outranks, since it runs for election
+// first itself, unless its last prepare phase found that it is too far behind
+// to lead, which would leave the group without a leader. A leader hands leadership to a peer that outranks it once that
+// peer has executed as far as the leader. Witnesses never lead for long, so
+// their priority does not count. With equal priorities, the default, nothing
+// changes.
+
+func (p *Multipaxos) priority(id int64) int64 {
+	if id < 0 || id >= int64(len(p.priorities)) {
+		return 0
+	}
+	return p.priorities[id]
+}
+
+// outranks reports whether this peer has a higher priority than peer id and
+// may be able to lead.
+func (p *Multipaxos) outranks(id int64) bool {
+	return !p.witness && p.isMember(p.id) && p.canLead() &&
+		p.priority(p.id) > p.priority(id)
+}
+
+// canLead reports whether this peer executed up to the snapshot that stopped
+// its last prepare phase, if any.
+func (p *Multipaxos) canLead() bool {
+	return p.log.LastExecuted() >= atomic.LoadInt64(&p.behindSnapshot)
+}
+
+// outranked returns how many full replicas in the configuration have a higher
+// priority than this peer.
+func (p *Multipaxos) outranked() int64 {
+	var n int64
+	for _, peer := range p.currentPeers() {
+		if !p.isWitness(peer.Id) && p.priority(peer.Id) > p.priority(p.id) {
+			n += 1
+		}
+	}
+	return n
+}
+
+// preferLeader hands leadership to peer if it outranks this leader and
+// reported executing as far as this leader.
+func (p *Multipaxos) preferLeader(peer *Peer, lastExecuted int64) {
+	if p.isWitness(peer.Id) || p.priority(peer.Id) <= p.priority(p.id) ||
+		lastExecuted < p.log.LastExecuted() ||
+		atomic.LoadInt32(&p.transferring) == 1 {
+		return
+	}
+	go p.TransferLeadership(peer.Id)
+}
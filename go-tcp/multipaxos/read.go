@@ -0,0 +1,47 @@
+package multipaxos
+
+import (
+	"github.com/sosp23/replicated-store/go/kvstore"
+	tcp "github.com/sosp23/replicated-store/go/multipaxos/network"
+)
+
+// Read answers a get without going through the log if the configured read
+// mode allows it; ok is false if the command has to be replicated instead.
+func (p *Multipaxos) Read(command *tcp.Command) (kvstore.KVResult, bool) {
+	if p.learner {
+		return p.LearnerRead(command)
+	}
+	if p.witness {
+		return kvstore.KVResult{}, false
+	}
+	switch p.readMode {
+	case ReadModeLease:
+		return p.LeaseRead(command)
+	case ReadModeReadIndex:
+		return p.ReadIndexRead(command)
+	}
+	return kvstore.KVResult{}, false
+}
+
+// ReadIndexRead records the point up to which every acknowledged write has
+// been executed, confirms leadership with a quorum, and answers the get once
+// the store has caught up with that point.
+func (p *Multipaxos) ReadIndexRead(command *tcp.Command) (kvstore.KVResult,
+	bool) {
+	ballot := p.Ballot()
+	if command.Type != tcp.Get || !IsLeader(ballot, p.id) {
+		return kvstore.KVResult{}, false
+	}
+
+	readIndex := p.log.LastExecuted()
+	p.leaseMu.Lock()
+	if p.termStartIndex > readIndex {
+		readIndex = p.termStartIndex
+	}
+	p.leaseMu.Unlock()
+
+	if !p.confirmLeadership(ballot) || !p.log.WaitExecuted(readIndex) {
+		return kvstore.KVResult{}, false
+	}
+	return p.log.Read(command), true
+}
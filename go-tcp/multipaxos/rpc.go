@@ -0,0 +1,44 @@
+package multipaxos
+
+import (
+	logger "github.com/sirupsen/logrus"
+	tcp "github.com/sosp23/replicated-store/go/multipaxos/network"
+	"time"
+)
+
+// Every request to a peer waits at most rpcTimeout for the response and is
+// sent again up to rpcRetries times, rpcBackoff after the first failure and
+// twice as long after each one after it. A phase counts a peer that never
+// answered as a failure and returns Retry once a quorum cannot be reached,
+// instead of waiting on that peer. An accept phase is then run again, since
+// its index is already in the log.
+
+// call sends request to peer and returns the response, or false if none of
+// the attempts was answered in time.
+func (p *Multipaxos) call(peer *Peer, msgType tcp.MessageType, request []byte,
+	retries int64, timeout int64) (string, bool) {
+	// one slot per attempt, so that late responses never block the reader.
+	channelId, responseChan := p.addChannel(int(retries) + 2)
+	defer p.removeChannel(channelId)
+	backoff := time.Duration(p.rpcBackoff) * time.Millisecond
+	for attempt := int64(0); ; attempt++ {
+		go peer.Stub.SendAwaitResponse(msgType, p.group, channelId,
+			string(request))
+		select {
+		case response := <-responseChan:
+			return response, true
+		case <-time.After(time.Duration(timeout) * time.Millisecond):
+		}
+		if attempt == retries {
+			logger.Infof("%v got no response from %v after %v attempts", p.id,
+				peer.Id, attempt+1)
+			return "", false
+		}
+		select {
+		case response := <-responseChan:
+			return response, true
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
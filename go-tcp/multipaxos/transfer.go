@@ -0,0 +1,172 @@
+package multipaxos
+
+import (
+	"encoding/json"
+	logger "github.com/sirupsen/logrus"
+	tcp "github.com/sosp23/replicated-store/go/multipaxos/network"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	transferTimeout      = 3 * time.Second
+	transferPollInterval = 10 * time.Millisecond
+)
+
+// TransferLeadership hands leadership to peer id. The leader stops taking new
+// commands and gives up its lease, waits for the accept phases in flight, and
+// sends commits to the target until it has executed as far as the leader.
+// Then it tells the target to start an election right away. If leadership has
+// not moved within transferTimeout, the leader resumes taking commands.
+func (p *Multipaxos) TransferLeadership(id int64) Result {
+	ballot := p.Ballot()
+	if IsSomeoneElseLeader(ballot, p.id) {
+		return Result{Type: SomeElseLeader, Leader: ExtractLeaderId(ballot)}
+	}
+	if !IsLeader(ballot, p.id) {
+		return Result{Type: Retry, Leader: -1}
+	}
+	if id == p.id {
+		return Result{Type: Ok, Leader: p.id}
+	}
+	peer := findPeer(p.currentPeers(), id)
+	if peer == nil || p.isWitness(id) ||
+		!atomic.CompareAndSwapInt32(&p.transferring, 0, 1) {
+		return Result{Type: Retry, Leader: -1}
+	}
+	defer atomic.StoreInt32(&p.transferring, 0)
+
+	logger.Infof("%v transferring leadership to %v", p.id, id)
+	p.leaseMu.Lock()
+	p.leaseExpiry = time.Time{}
+	p.leaseMu.Unlock()
+
+	deadline := time.Now().Add(transferTimeout)
+	for p.Ballot() == ballot && time.Now().Before(deadline) &&
+		!p.caughtUp(peer, ballot) {
+		time.Sleep(transferPollInterval)
+	}
+	if p.Ballot() == ballot && time.Now().Before(deadline) &&
+		p.sendTimeoutNow(peer, ballot) {
+		for p.Ballot() == ballot && time.Now().Before(deadline) {
+			time.Sleep(transferPollInterval)
+		}
+	}
+
+	if p.Ballot() == ballot {
+		logger.Infof("%v failed to transfer leadership to %v", p.id, id)
+		return Result{Type: Retry, Leader: -1}
+	}
+	return Result{Type: Ok, Leader: ExtractLeaderId(p.Ballot())}
+}
+
+// StepDown hands leadership to the first full replica that takes it if this
+// peer is the leader, so that it can shut down without clients waiting out an
+// election.
+func (p *Multipaxos) StepDown() {
+	if !IsLeader(p.Ballot(), p.id) {
+		return
+	}
+	if !p.handOff() {
+		logger.Errorf("%v is stopping as the leader", p.id)
+	}
+}
+
+// handOff tries the full replicas in order of priority.
+func (p *Multipaxos) handOff() bool {
+	peers := append([]*Peer(nil), p.currentPeers()...)
+	sort.SliceStable(peers, func(i, j int) bool {
+		return p.priority(peers[i].Id) > p.priority(peers[j].Id)
+	})
+	for _, peer := range peers {
+		if peer.Id != p.id && !p.isWitness(peer.Id) &&
+			p.TransferLeadership(peer.Id).Type == Ok {
+			return true
+		}
+	}
+	return false
+}
+
+// caughtUp reports whether every accept phase this leader started has
+// finished and peer has executed as far as this leader.
+func (p *Multipaxos) caughtUp(peer *Peer, ballot tcp.Ballot) bool {
+	lastIndex := p.log.LastIndex()
+	p.windowMu.Lock()
+	inFlight := p.windowCommitted < lastIndex
+	p.windowMu.Unlock()
+	if inFlight {
+		return false
+	}
+
+	lastExecuted := p.log.LastExecuted()
+	request, _ := json.Marshal(tcp.CommitRequest{
+		Ballot:             ballot,
+		LastExecuted:       lastExecuted,
+		GlobalLastExecuted: p.log.GlobalLastExecuted(),
+		Sender:             p.id,
+	})
+	// transfer polls caughtUp, so a lost request is simply sent again.
+	response, ok := p.call(peer, tcp.COMMITREQUEST, request, 0, p.rpcTimeout)
+	if !ok {
+		return false
+	}
+	var commitResponse tcp.CommitResponse
+	json.Unmarshal([]byte(response), &commitResponse)
+	if commitResponse.Type != tcp.Ok {
+		p.BecomeFollower(commitResponse.Ballot)
+		return false
+	}
+	p.catchUpIfBehind(peer, ballot, commitResponse.LastExecuted)
+	return commitResponse.LastExecuted >= lastExecuted
+}
+
+func (p *Multipaxos) sendTimeoutNow(peer *Peer, ballot tcp.Ballot) bool {
+	request, _ := json.Marshal(tcp.TimeoutNowRequest{
+		Ballot: ballot,
+		Sender: p.id,
+	})
+	response, ok := p.call(peer, tcp.TIMEOUTNOWREQUEST, request,
+		p.rpcRetries, p.rpcTimeout)
+	if !ok {
+		return false
+	}
+	var timeoutNowResponse tcp.TimeoutNowResponse
+	json.Unmarshal([]byte(response), &timeoutNowResponse)
+	if timeoutNowResponse.Type != tcp.Ok {
+		p.BecomeFollower(timeoutNowResponse.Ballot)
+		return false
+	}
+	logger.Infof("%v sent timeout now request to %v", p.id, peer.Id)
+	return true
+}
+
+// TimeoutNow makes this peer start an election right away on behalf of the
+// leader that sent the request.
+func (p *Multipaxos) TimeoutNow(
+	request tcp.TimeoutNowRequest) tcp.TimeoutNowResponse {
+	logger.Infof("%v <--timeoutnow-- %v", p.id, request.Sender)
+
+	if request.Ballot.Less(p.Ballot()) || !p.isMember(p.id) {
+		return tcp.TimeoutNowResponse{
+			Type:   tcp.Reject,
+			Ballot: p.Ballot(),
+		}
+	}
+	if p.Ballot().Less(request.Ballot) {
+		p.BecomeFollower(request.Ballot)
+	}
+	// a request left over from an earlier transfer makes way for this one.
+	select {
+	case <-p.electNow:
+	default:
+	}
+	select {
+	case p.electNow <- request.Ballot:
+	default:
+	}
+	return tcp.TimeoutNowResponse{
+		Type:   tcp.Ok,
+		Ballot: p.Ballot(),
+	}
+}
@@ -2,21 +2,44 @@ package multipaxos
 
 import (
 	pb "github.com/sosp23/replicated-store/go/multipaxos/network"
+	"time"
 )
 
 const (
-	IdBits               = 0xff
-	RoundIncrement       = IdBits + 1
-	MaxNumPeers    int64 = 0xf
+	MaxNumPeers               int64 = 1 << 16
+	SnapshotChunkSize               = 1 << 20
+	NoopClientId              int64 = -1
+	DefaultReplayWindow             = 64
+	DefaultAcceptWindow             = 256
+	DefaultRpcTimeout               = 1000
+	DefaultRpcBackoff               = 50
+	DefaultHeartbeatInterval        = 100
+	DefaultElectionTimeoutMin       = 300
+	DefaultCatchUpBatchSize         = 64
+	DefaultCatchUpInterval          = 10
+)
+
+const (
+	ReadModeLog       = "log"
+	ReadModeLease     = "lease"
+	ReadModeReadIndex = "read_index"
 )
 
 type Peer struct {
 	Id   int64
+	Addr string
 	Stub *pb.TcpLink
 }
 
-func MakePeer(addr string, channels *pb.ChannelMap) *pb.TcpLink {
-	return pb.NewTcpLink(addr, channels)
+// MakePeer returns a link to addr. A leader gives up after an election timeout
+// without a quorum, so the link dials again after rpcBackoff and backs off no
+// further than heartbeatInterval, both in milliseconds, to reach a peer that
+// was down in time once it is back.
+func MakePeer(addr string, channels *pb.ChannelMap, rpcBackoff int64,
+	heartbeatInterval int64) *pb.TcpLink {
+	return pb.NewTcpLink(addr, channels,
+		time.Duration(rpcBackoff)*time.Millisecond,
+		time.Duration(heartbeatInterval)*time.Millisecond)
 }
 
 type ResultType int
@@ -32,14 +55,20 @@ type Result struct {
 	Leader int64
 }
 
-func ExtractLeaderId(ballot int64) int64 {
-	return ballot & IdBits
+type batchEntry struct {
+	command  *pb.Command
+	clientId int64
+	result   chan Result
+}
+
+func ExtractLeaderId(ballot pb.Ballot) int64 {
+	return ballot.Id
 }
 
-func IsLeader(ballot int64, id int64) bool {
+func IsLeader(ballot pb.Ballot, id int64) bool {
 	return ExtractLeaderId(ballot) == id
 }
 
-func IsSomeoneElseLeader(ballot int64, id int64) bool {
-	return !IsLeader(ballot, id) && ExtractLeaderId(ballot) < MaxNumPeers
+func IsSomeoneElseLeader(ballot pb.Ballot, id int64) bool {
+	return !IsLeader(ballot, id) && ExtractLeaderId(ballot) != pb.NoLeader
 }
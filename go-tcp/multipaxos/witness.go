@@ -0,0 +1,39 @@
+package multipaxos
+
+import (
+	tcp "github.com/sosp23/replicated-store/go/multipaxos/network"
+	"sync/atomic"
+	"time"
+)
+
+// A witness votes in prepare and accept phases and keeps the log, but its log
+// never applies commands to the store, so it cannot serve clients. A witness
+// that wins an election replays the log and then hands leadership to a full
+// replica. Leaders never hand leadership to a witness. A witness also has no
+// snapshot to send, so it never trims instances on its own, and one that leads
+// gives way to a full replica when a peer needs a snapshot.
+
+func (p *Multipaxos) IsWitness() bool {
+	return p.witness
+}
+
+func (p *Multipaxos) isWitness(id int64) bool {
+	for _, witness := range p.witnesses {
+		if witness == id {
+			return true
+		}
+	}
+	return false
+}
+
+// handOffFromWitness keeps trying to hand leadership to a full replica for as
+// long as this witness leads with ballot.
+func (p *Multipaxos) handOffFromWitness(ballot tcp.Ballot) {
+	for p.Ballot() == ballot &&
+		atomic.LoadInt32(&p.prepareThreadRunning) == 1 {
+		if p.handOff() {
+			return
+		}
+		time.Sleep(time.Duration(p.heartbeatInterval) * time.Millisecond)
+	}
+}
@@ -3,9 +3,11 @@ package replicant
 import (
 	"bufio"
 	"encoding/json"
+	"github.com/sosp23/replicated-store/go/kvstore"
 	"github.com/sosp23/replicated-store/go/multipaxos"
 	pb "github.com/sosp23/replicated-store/go/multipaxos/network"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -17,6 +19,10 @@ func parse(request string) *pb.Command {
 	}
 	commandType := substrings[0]
 	key := substrings[1]
+	if kvstore.IsReserved(key) {
+		// clients cannot name the keys the store keeps for itself.
+		return nil
+	}
 
 	command := &pb.Command{Key: key}
 
@@ -30,6 +36,34 @@ func parse(request string) *pb.Command {
 		}
 		command.Type = pb.Put
 		command.Value = substrings[2]
+	} else if commandType == "addpeer" {
+		if len(substrings) != 3 || !isPeerId(key) {
+			return nil
+		}
+		command.Type = pb.AddPeer
+		command.Value = substrings[2]
+	} else if commandType == "removepeer" {
+		if len(substrings) != 2 || !isPeerId(key) {
+			return nil
+		}
+		command.Type = pb.RemovePeer
+	} else if commandType == "setshards" {
+		if len(substrings) != 2 {
+			return nil
+		}
+		command.Type = pb.SetShards
+		command.Key = ""
+		command.Value = key
+	} else if commandType == "reshard" {
+		command.Type = pb.Reshard
+		command.Key = ""
+		command.Value = key
+		if len(substrings) == 3 {
+			command.Commands = parseKeys(substrings[2])
+			if command.Commands == nil {
+				return nil
+			}
+		}
 	} else {
 		return nil
 	}
@@ -41,27 +75,40 @@ type Client struct {
 	reader       *bufio.Reader
 	writer       *bufio.Writer
 	socket       net.Conn
-	multipaxos   *multipaxos.Multipaxos
+	groups       *Groups
 	manager      *ClientManager
 	isFromClient bool
 	writerLock   sync.Mutex
+	pending      chan *pendingRequest
+	done         chan struct{}
+
+	upstreamMu      sync.Mutex
+	upstream        net.Conn
+	upstreamReader  *bufio.Reader
+	upstreamLeader  int64
+	upstreamStopped bool
 }
 
-func NewClient(id int64, conn net.Conn, mp *multipaxos.Multipaxos,
+func NewClient(id int64, conn net.Conn, groups *Groups,
 	manger *ClientManager, isFromClient bool) *Client {
 	client := &Client{
 		id:           id,
 		reader:       bufio.NewReader(conn),
 		writer:       bufio.NewWriter(conn),
 		socket:       conn,
-		multipaxos:   mp,
+		groups:       groups,
 		manager:      manger,
 		isFromClient: isFromClient,
+		pending:      make(chan *pendingRequest, maxPendingRequests),
+		done:         make(chan struct{}),
 	}
 	return client
 }
 
 func (c *Client) Start() {
+	if c.isFromClient {
+		go c.replyTask()
+	}
 	for {
 		request, err := c.reader.ReadString('\n')
 		if err != nil {
@@ -74,6 +121,11 @@ func (c *Client) Start() {
 
 func (c *Client) Stop() {
 	c.socket.Close()
+	close(c.done)
+	c.upstreamMu.Lock()
+	c.upstreamStopped = true
+	c.closeUpstream()
+	c.upstreamMu.Unlock()
 }
 
 func (c *Client) handleRequest(request string) {
@@ -85,23 +137,120 @@ func (c *Client) handleRequest(request string) {
 }
 
 func (c *Client) handleClientRequest(line string) {
-	command := parse(line)
+	forwarded := strings.HasPrefix(line, forwardPrefix)
+	line = strings.TrimPrefix(line, forwardPrefix)
+	group, request, ok := parseGroup(line)
+	mp, found := c.groups.Get(group)
+	if !ok || !found {
+		c.respond("bad command")
+		return
+	}
+	if id, ok := parseTransfer(request); ok {
+		r := c.newRequest(mp, line, forwarded)
+		c.await(r, c.transfer(mp, id, r.id))
+		return
+	}
+	if strings.TrimSpace(request) == "shards" {
+		// the directory is read through group 0 like any other get.
+		mp, _ = c.groups.Get(0)
+		command := &pb.Command{Type: pb.Get, Key: kvstore.DirectoryKey}
+		if result, ok := mp.Read(command); ok {
+			c.respond(result.Value)
+			return
+		}
+		r := c.newRequest(mp, line, forwarded)
+		c.await(r, mp.ReplicateAsync(command, r.id))
+		return
+	}
+	if change, ok := parseReshard(request); ok {
+		r := c.newRequest(mp, line, forwarded)
+		c.await(r, c.reshard(change, r.id))
+		return
+	}
+	command := parse(request)
 	if command != nil {
-		result := c.multipaxos.Replicate(command, c.id)
-		if result.Type == multipaxos.Ok {
+		if command.Type == pb.AddPeer || command.Type == pb.RemovePeer {
+			r := c.newRequest(mp, line, forwarded)
+			c.await(r, c.reconfigure(mp, command, r.id))
 			return
 		}
-		if result.Type == multipaxos.Retry {
-			c.Write("retry")
-		} else {
-			if result.Type != multipaxos.SomeElseLeader {
-				panic("Result is not someone_else_leader")
-			}
-			c.Write("leader is ...")
+		if command.Type == pb.SetShards || command.Type == pb.Reshard {
+			r := c.newRequest(mp, line, forwarded)
+			c.await(r, mp.ReplicateAsync(command, r.id))
+			return
 		}
+		if request != line {
+			// the key picks the group of a get, put or delete.
+			c.respond("bad command")
+			return
+		}
+		mp = c.groups.ForKey(command.Key)
+		if result, ok := mp.Read(command); ok {
+			c.respond(result.Value)
+			return
+		}
+		// blocks while the accept window is full, which stops reading from
+		// this client until earlier commands finish.
+		r := c.newRequest(mp, line, forwarded)
+		c.await(r, mp.ReplicateAsync(command, r.id))
 	} else {
-		c.Write("bad command")
+		c.respond("bad command")
+	}
+}
+
+// reconfigure runs an addpeer or removepeer command, which is replicated
+// through the log but waits for the change to take effect.
+func (c *Client) reconfigure(mp *multipaxos.Multipaxos, command *pb.Command,
+	requestId int64) <-chan multipaxos.Result {
+	result := make(chan multipaxos.Result, 1)
+	id, _ := strconv.ParseInt(command.Key, 10, 64)
+	go func() {
+		if command.Type == pb.AddPeer {
+			result <- mp.AddPeer(id, command.Value, requestId)
+		} else {
+			result <- mp.RemovePeer(id, requestId)
+		}
+	}()
+	return result
+}
+
+// transfer runs a transfer command, which moves leadership to peer id. It does
+// not go through the log, so it is answered here rather than by the executor.
+func (c *Client) transfer(mp *multipaxos.Multipaxos, id int64,
+	requestId int64) <-chan multipaxos.Result {
+	result := make(chan multipaxos.Result, 1)
+	go func() {
+		r := mp.TransferLeadership(id)
+		if r.Type == multipaxos.Ok {
+			c.manager.Respond(requestId, "")
+		}
+		result <- r
+	}()
+	return result
+}
+
+func parseTransfer(request string) (int64, bool) {
+	substrings := strings.Fields(request)
+	if len(substrings) != 2 || substrings[0] != "transfer" ||
+		!isPeerId(substrings[1]) {
+		return 0, false
 	}
+	id, _ := strconv.ParseInt(substrings[1], 10, 64)
+	return id, true
+}
+
+func (c *Client) leaderClientAddr(mp *multipaxos.Multipaxos,
+	leader int64) (string, bool) {
+	addr, ok := mp.Members()[leader]
+	if !ok {
+		return "", false
+	}
+	return clientAddr(addr), true
+}
+
+func isPeerId(key string) bool {
+	id, err := strconv.ParseInt(key, 10, 64)
+	return err == nil && id >= 0 && id < multipaxos.MaxNumPeers
 }
 
 func (c *Client) handlePeerRequest(line string) {
@@ -111,13 +260,18 @@ func (c *Client) handlePeerRequest(line string) {
 		return
 	}
 
+	mp, ok := c.groups.Get(request.Group)
+	if !ok {
+		return
+	}
+
 	msg := []byte(request.Msg)
 	go func() {
 		switch pb.MessageType(request.Type) {
 		case pb.PREPAREREQUEST:
 			var prepareRequest pb.PrepareRequest
 			json.Unmarshal(msg, &prepareRequest)
-			prepareResponse := c.multipaxos.Prepare(prepareRequest)
+			prepareResponse := mp.Prepare(prepareRequest)
 			responseJson, _ := json.Marshal(prepareResponse)
 			tcpMessage, _ := json.Marshal(pb.Message{
 				Type:      uint8(pb.PREPARERESPONSE),
@@ -128,7 +282,7 @@ func (c *Client) handlePeerRequest(line string) {
 		case pb.ACCEPTREQUEST:
 			var acceptRequest pb.AcceptRequest
 			json.Unmarshal(msg, &acceptRequest)
-			acceptResponse := c.multipaxos.Accept(acceptRequest)
+			acceptResponse := mp.Accept(acceptRequest)
 			responseJson, _ := json.Marshal(acceptResponse)
 			tcpMessage, _ := json.Marshal(pb.Message{
 				Type:      uint8(pb.ACCEPTRESPONSE),
@@ -139,7 +293,7 @@ func (c *Client) handlePeerRequest(line string) {
 		case pb.COMMITREQUEST:
 			var commitRequest pb.CommitRequest
 			json.Unmarshal(msg, &commitRequest)
-			commitResponse := c.multipaxos.Commit(commitRequest)
+			commitResponse := mp.Commit(commitRequest)
 			responseJson, _ := json.Marshal(commitResponse)
 			tcpMessage, _ := json.Marshal(pb.Message{
 				Type:      uint8(pb.COMMITRESPONSE),
@@ -147,6 +301,62 @@ func (c *Client) handlePeerRequest(line string) {
 				Msg:       string(responseJson),
 			})
 			c.Write(string(tcpMessage))
+		case pb.INSTALLSNAPSHOTREQUEST:
+			var installSnapshotRequest pb.InstallSnapshotRequest
+			json.Unmarshal(msg, &installSnapshotRequest)
+			installSnapshotResponse := mp.InstallSnapshot(
+				installSnapshotRequest)
+			responseJson, _ := json.Marshal(installSnapshotResponse)
+			tcpMessage, _ := json.Marshal(pb.Message{
+				Type:      uint8(pb.INSTALLSNAPSHOTRESPONSE),
+				ChannelId: request.ChannelId,
+				Msg:       string(responseJson),
+			})
+			c.Write(string(tcpMessage))
+		case pb.TIMEOUTNOWREQUEST:
+			var timeoutNowRequest pb.TimeoutNowRequest
+			json.Unmarshal(msg, &timeoutNowRequest)
+			timeoutNowResponse := mp.TimeoutNow(timeoutNowRequest)
+			responseJson, _ := json.Marshal(timeoutNowResponse)
+			tcpMessage, _ := json.Marshal(pb.Message{
+				Type:      uint8(pb.TIMEOUTNOWRESPONSE),
+				ChannelId: request.ChannelId,
+				Msg:       string(responseJson),
+			})
+			c.Write(string(tcpMessage))
+		case pb.HEARTBEATREQUEST:
+			var heartbeatRequest pb.HeartbeatRequest
+			json.Unmarshal(msg, &heartbeatRequest)
+			heartbeatResponse := mp.Heartbeat(heartbeatRequest)
+			responseJson, _ := json.Marshal(heartbeatResponse)
+			tcpMessage, _ := json.Marshal(pb.Message{
+				Type:      uint8(pb.HEARTBEATRESPONSE),
+				ChannelId: request.ChannelId,
+				Msg:       string(responseJson),
+			})
+			c.Write(string(tcpMessage))
+		case pb.PREVOTEREQUEST:
+			var preVoteRequest pb.PreVoteRequest
+			json.Unmarshal(msg, &preVoteRequest)
+			preVoteResponse := mp.PreVote(preVoteRequest)
+			responseJson, _ := json.Marshal(preVoteResponse)
+			tcpMessage, _ := json.Marshal(pb.Message{
+				Type:      uint8(pb.PREVOTERESPONSE),
+				ChannelId: request.ChannelId,
+				Msg:       string(responseJson),
+			})
+			c.Write(string(tcpMessage))
+		case pb.CATCHUPREQUEST:
+			var catchUpRequest pb.CatchUpRequest
+			json.Unmarshal(msg, &catchUpRequest)
+			catchUpResponse := mp.CatchUp(catchUpRequest)
+			responseJson, _ := json.Marshal(catchUpResponse)
+			tcpMessage, _ := json.Marshal(pb.Message{
+				Type:      uint8(pb.CATCHUPRESPONSE),
+				ChannelId: request.ChannelId,
+				Msg:       string(responseJson),
+			})
+			c.Write(string(tcpMessage))
 		}
 	}()
 }
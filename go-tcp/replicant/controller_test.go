@@ -0,0 +1,142 @@
+package replicant
+
+import (
+	"bufio"
+	"github.com/sosp23/replicated-store/go/config"
+	"github.com/sosp23/replicated-store/go/kvstore"
+	"github.com/sosp23/replicated-store/go/log"
+	"github.com/sosp23/replicated-store/go/multipaxos"
+	pb "github.com/sosp23/replicated-store/go/multipaxos/network"
+	"github.com/sosp23/replicated-store/go/shard"
+	"github.com/sosp23/replicated-store/go/util"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// scanStore records the ranges that are scanned in it.
+type scanStore struct {
+	*kvstore.MemKVStore
+	mu    sync.Mutex
+	scans [][2]string
+}
+
+func (s *scanStore) Scan(start string, end string) (map[string]string,
+	error) {
+	s.mu.Lock()
+	s.scans = append(s.scans, [2]string{start, end})
+	s.mu.Unlock()
+	return s.MemKVStore.Scan(start, end)
+}
+
+func (s *scanStore) takeScans() [][2]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scans := s.scans
+	s.scans = nil
+	return scans
+}
+
+func run(l *log.Log, command *pb.Command) *kvstore.KVResult {
+	instance := util.MakeInstanceWithState(pb.Ballot{Round: 1},
+		l.LastIndex()+1, pb.Committed)
+	instance.Command = command
+	l.Append(instance)
+	_, result := l.Execute()
+	return result
+}
+
+// serveGroups answers the requests of controllers on listener the way the
+// leaders of the groups would, by running them on logs.
+func serveGroups(listener net.Listener, logs []*log.Log) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				break
+			}
+			group, request, _ := parseGroup(line)
+			command := parse(request)
+			if strings.TrimSpace(request) == "shards" {
+				command = &pb.Command{Type: pb.Get, Key: kvstore.DirectoryKey}
+			}
+			conn.Write([]byte(run(logs[group], command).Value + "\n"))
+		}
+		conn.Close()
+	}
+}
+
+func TestReshardMovesOnlyItsRange(t *testing.T) {
+	c := config.DefaultConfig(0, 3)
+	c.Groups = 3
+	c.Sharding = shard.ShardingRange
+	c.SplitKeys = []string{"h", "p"}
+	initial := shard.NewMap(c)
+
+	stores := make([]*scanStore, c.Groups)
+	logs := make([]*log.Log, c.Groups)
+	for i := range logs {
+		stores[i] = &scanStore{MemKVStore: kvstore.NewMemKVStore()}
+		logs[i] = log.NewLog(stores[i], nil)
+		logs[i].SetShards(int64(i), initial)
+	}
+	for key, group := range map[string]int{"a": 0, "c": 0, "d": 0, "i": 1,
+		"q": 2} {
+		run(logs[group], &pb.Command{Type: pb.Put, Key: key, Value: key})
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	groups := &Groups{shards: initial, logs: logs,
+		addr: listener.Addr().String()}
+	manager := NewClientManager(0, 3, groups, true)
+	conn, _ := net.Pipe()
+	client := NewClient(0, conn, groups, manager, true)
+	go serveGroups(listener, logs)
+	reshard := func(request string) {
+		change, ok := parseReshard(request)
+		assert.True(t, ok)
+		reply := make(chan string, 1)
+		result := <-client.reshard(change, manager.NewRequest(reply))
+		assert.Equal(t, multipaxos.Ok, result.Type)
+		assert.Equal(t, "", <-reply)
+	}
+	get := func(l *log.Log, key string) *kvstore.KVResult {
+		return run(l, &pb.Command{Type: pb.Get, Key: key})
+	}
+	movedOnly := func(group int) {
+		scans := stores[group].takeScans()
+		assert.NotEmpty(t, scans)
+		for _, scan := range scans {
+			assert.Equal(t, [2]string{"c", "h"}, scan)
+		}
+	}
+
+	// group 2 takes c and d over, and no other group is scanned.
+	reshard("split c 2")
+	movedOnly(0)
+	movedOnly(2)
+	assert.Empty(t, stores[1].takeScans())
+	assert.Equal(t, "c", get(logs[2], "c").Value)
+	assert.Equal(t, "d", get(logs[2], "d").Value)
+	assert.Nil(t, stores[2].Get("a"))
+	assert.False(t, get(logs[0], "c").Ok)
+	assert.True(t, get(logs[0], "a").Ok)
+
+	// and hands them back when the range is merged.
+	reshard("merge c")
+	movedOnly(0)
+	movedOnly(2)
+	assert.Empty(t, stores[1].takeScans())
+	assert.Equal(t, "c", get(logs[0], "c").Value)
+	assert.False(t, get(logs[2], "c").Ok)
+	assert.EqualValues(t, 2, logs[0].Directory().Version)
+}
@@ -0,0 +1,112 @@
+package replicant
+
+import (
+	"bufio"
+	"github.com/sosp23/replicated-store/go/multipaxos"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// forwardPrefix marks a request relayed by a follower so that the
+	// receiving peer answers it instead of forwarding it again.
+	forwardPrefix      = "fwd "
+	maxForwardAttempts = 5
+	forwardBackoff     = 100 * time.Millisecond
+	forwardTimeout     = 10 * time.Second
+)
+
+// forward relays line to the current leader of group mp and returns the
+// leader's reply. If the leader changes or cannot be reached, the request is
+// re-routed to whichever peer the ballot names as the leader next. Only
+// replyTask forwards, so requests reach the leader in the order they were sent.
+func (c *Client) forward(mp *multipaxos.Multipaxos, line string) string {
+	request := forwardPrefix + strings.TrimRight(line, "\n") + "\n"
+	for attempt := 0; attempt < maxForwardAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(forwardBackoff)
+		}
+		ballot := mp.Ballot()
+		if !multipaxos.IsSomeoneElseLeader(ballot, mp.Id()) {
+			continue
+		}
+		leader := multipaxos.ExtractLeaderId(ballot)
+		addr, ok := c.leaderClientAddr(mp, leader)
+		if !ok {
+			continue
+		}
+		response, err := c.sendUpstream(leader, addr, request)
+		if err != nil || response == "retry" ||
+			strings.HasPrefix(response, "leader ") {
+			continue
+		}
+		return response
+	}
+	return "retry"
+}
+
+func (c *Client) sendUpstream(leader int64, addr string,
+	request string) (string, error) {
+	conn, reader, err := c.upstreamConn(leader, addr)
+	if err != nil {
+		return "", err
+	}
+
+	conn.SetDeadline(time.Now().Add(forwardTimeout))
+	if _, err := conn.Write([]byte(request)); err != nil {
+		c.dropUpstream(conn)
+		return "", err
+	}
+	response, err := reader.ReadString('\n')
+	if err != nil {
+		c.dropUpstream(conn)
+		return "", err
+	}
+	return strings.TrimRight(response, "\n"), nil
+}
+
+// upstreamConn returns the connection to leader, dialing it if the one open is
+// to another peer. upstreamMu only guards the connection and is not held while
+// a request is forwarded on it, so that Stop can close it at any time.
+func (c *Client) upstreamConn(leader int64,
+	addr string) (net.Conn, *bufio.Reader, error) {
+	c.upstreamMu.Lock()
+	if c.upstream != nil && c.upstreamLeader == leader {
+		defer c.upstreamMu.Unlock()
+		return c.upstream, c.upstreamReader, nil
+	}
+	c.closeUpstream()
+	c.upstreamMu.Unlock()
+
+	conn, err := net.DialTimeout("tcp", addr, forwardTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.upstreamMu.Lock()
+	defer c.upstreamMu.Unlock()
+	if c.upstreamStopped {
+		conn.Close()
+		return nil, nil, net.ErrClosed
+	}
+	c.upstream = conn
+	c.upstreamReader = bufio.NewReader(conn)
+	c.upstreamLeader = leader
+	return c.upstream, c.upstreamReader, nil
+}
+
+func (c *Client) dropUpstream(conn net.Conn) {
+	c.upstreamMu.Lock()
+	defer c.upstreamMu.Unlock()
+	if c.upstream == conn {
+		c.closeUpstream()
+	}
+}
+
+func (c *Client) closeUpstream() {
+	if c.upstream != nil {
+		c.upstream.Close()
+		c.upstream = nil
+		c.upstreamReader = nil
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/sosp23/replicated-store/go/kvstore"
 	consensusLog "github.com/sosp23/replicated-store/go/log"
 	"github.com/sosp23/replicated-store/go/multipaxos"
+	"github.com/sosp23/replicated-store/go/shard"
 	logger "github.com/sirupsen/logrus"
 	"net"
 	"strconv"
@@ -13,9 +14,8 @@ import (
 
 type Replicant struct {
 	id            int64
-	log           *consensusLog.Log
 	ipPort        string
-	multipaxos    *multipaxos.Multipaxos
+	groups        *Groups
 	clientManager *ClientManager
 	peerManager   *ClientManager
 	peerListener  net.Listener
@@ -25,27 +25,40 @@ type Replicant struct {
 func NewReplicant(config config.Config) *Replicant {
 	r := &Replicant{}
 	r.id = config.Id
-	r.ipPort = config.Peers[config.Id]
-	r.log = consensusLog.NewLog(kvstore.CreateStore(config))
+	r.ipPort = config.Addr(config.Id)
+	r.groups = &Groups{
+		shards: shard.NewMap(config),
+		addr:   clientAddr(r.ipPort),
+	}
 	r.peerListener, _ = net.Listen("tcp", r.ipPort)
-	r.multipaxos = multipaxos.NewMultipaxos(r.log, config)
-	numPeers := int64(len(config.Peers))
-	r.clientManager = NewClientManager(r.id, numPeers, r.multipaxos, true)
-	r.peerManager = NewClientManager(r.id, numPeers, r.multipaxos, false)
+	mux := multipaxos.NewMux()
+	for group := int64(0); group < r.groups.shards.NumGroups(); group++ {
+		groupConfig := config.ForGroup(group)
+		log := consensusLog.NewLog(kvstore.CreateStore(groupConfig),
+			consensusLog.CreateWAL(groupConfig))
+		log.SetSnapshotInterval(config.SnapshotInterval)
+		log.SetWitness(config.IsWitness(config.Id))
+		log.SetShards(group, r.groups.shards)
+		r.groups.logs = append(r.groups.logs, log)
+		r.groups.multipaxos = append(r.groups.multipaxos,
+			multipaxos.NewGroupMultipaxos(log, groupConfig, group, mux))
+	}
+	// peers may join later, so stride client ids by the largest possible
+	// number of peers to keep them unique across the cluster.
+	numPeers := multipaxos.MaxNumPeers
+	r.clientManager = NewClientManager(r.id, numPeers, r.groups, true)
+	r.peerManager = NewClientManager(r.id, numPeers, r.groups, false)
 	go r.StartPeerServer()
 	return r
 }
 
-func (r *Replicant) executorTask() {
+func (r *Replicant) executorTask(log *consensusLog.Log) {
 	for {
-		id, result := r.log.Execute()
+		id, result := log.Execute()
 		if result == nil {
 			break
 		}
-		client := r.clientManager.Get(id)
-		if client != nil {
-			client.Write(result.Value)
-		}
+		r.clientManager.Respond(id, result.Value)
 	}
 }
 
@@ -73,29 +86,28 @@ func (r *Replicant) peerServerTask() {
 }
 
 func (r *Replicant) Start() {
-	r.multipaxos.Start()
+	for _, mp := range r.groups.multipaxos {
+		mp.Start()
+	}
 	r.StartExecutorTask()
 	r.StartServerTask()
 }
 
 func (r *Replicant) Stop() {
+	// hand leadership off while this peer can still serve and replicate.
+	for _, mp := range r.groups.multipaxos {
+		mp.StepDown()
+	}
 	r.StopServer()
 	r.StopExecutorThread()
 	r.StopPeerServer()
-	r.multipaxos.Stop()
+	for _, mp := range r.groups.multipaxos {
+		mp.Stop()
+	}
 }
 
 func (r *Replicant) StartServerTask() {
-	pos := strings.Index(r.ipPort, ":")
-	if pos == -1 {
-		panic("no separator : in the acceptor port")
-	}
-	pos += 1
-	port, err := strconv.Atoi(r.ipPort[pos:])
-	if err != nil {
-		panic("parsing acceptor port failed")
-	}
-	port += 1
+	port := clientPort(r.ipPort)
 
 	acceptor, err := net.Listen("tcp", ":"+strconv.Itoa(port))
 	if err != nil {
@@ -122,10 +134,34 @@ func (r *Replicant) StopPeerServer() {
 
 func (r *Replicant) StartExecutorTask() {
 	logger.Infof("%v starting executor thread\n", r.id)
-	go r.executorTask()
+	for _, log := range r.groups.logs {
+		go r.executorTask(log)
+	}
 }
 
 func (r *Replicant) StopExecutorThread() {
 	logger.Infof("%v stopping executor thread\n", r.id)
-	r.log.Stop()
+	for _, log := range r.groups.logs {
+		log.Stop()
+	}
+}
+
+// clientPort returns the port on which the peer listening at ipPort serves
+// clients, which is the peer port plus one.
+func clientPort(ipPort string) int {
+	pos := strings.Index(ipPort, ":")
+	if pos == -1 {
+		panic("no separator : in the acceptor port")
+	}
+	pos += 1
+	port, err := strconv.Atoi(ipPort[pos:])
+	if err != nil {
+		panic("parsing acceptor port failed")
+	}
+	return port + 1
+}
+
+func clientAddr(ipPort string) string {
+	return ipPort[:strings.Index(ipPort, ":")+1] +
+		strconv.Itoa(clientPort(ipPort))
 }
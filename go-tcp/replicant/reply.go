@@ -0,0 +1,134 @@
+package replicant
+
+import (
+	"fmt"
+	"github.com/sosp23/replicated-store/go/multipaxos"
+)
+
+// maxPendingRequests bounds the requests of a client that wait to be answered,
+// past which reading from the client stops until earlier ones are answered.
+const maxPendingRequests = 1024
+
+// A client is answered in the order it sent its requests, even though their
+// results come in out of order: from the executor of whichever group ran them,
+// from a leader they were forwarded to, or from a transfer or a reshard. Each
+// request is queued as it is read, and replyTask answers the queue in order,
+// one request at a time. This also keeps the requests that a follower forwards
+// to the leader in order, since replyTask forwards them one at a time.
+
+type pendingRequest struct {
+	id        int64
+	mp        *multipaxos.Multipaxos
+	line      string
+	forwarded bool
+	result    <-chan multipaxos.Result
+	reply     chan string
+}
+
+// newRequest registers a request that runs on group mp, whose result is sent
+// to its reply by whatever runs it, through the id it is given.
+func (c *Client) newRequest(mp *multipaxos.Multipaxos, line string,
+	forwarded bool) *pendingRequest {
+	reply := make(chan string, 1)
+	return &pendingRequest{
+		id:        c.manager.NewRequest(reply),
+		mp:        mp,
+		line:      line,
+		forwarded: forwarded,
+		reply:     reply,
+	}
+}
+
+// await queues r to be answered once result is in.
+func (c *Client) await(r *pendingRequest, result <-chan multipaxos.Result) {
+	r.result = result
+	c.queue(r)
+}
+
+// respond queues a request that is answered with response right away.
+func (c *Client) respond(response string) {
+	result := make(chan multipaxos.Result, 1)
+	result <- multipaxos.Result{Type: multipaxos.Ok}
+	reply := make(chan string, 1)
+	reply <- response
+	c.queue(&pendingRequest{id: -1, result: result, reply: reply})
+}
+
+func (c *Client) queue(r *pendingRequest) {
+	select {
+	case c.pending <- r:
+	case <-c.done:
+		c.manager.Forget(r.id)
+	}
+}
+
+func (c *Client) replyTask() {
+	for {
+		select {
+		case r := <-c.pending:
+			if !c.reply(r) {
+				c.manager.Forget(r.id)
+				c.forgetPending()
+				return
+			}
+		case <-c.done:
+			c.forgetPending()
+			return
+		}
+	}
+}
+
+// forgetPending drops the requests of a client that stopped, which are not
+// answered anymore.
+func (c *Client) forgetPending() {
+	for {
+		select {
+		case r := <-c.pending:
+			c.manager.Forget(r.id)
+		default:
+			return
+		}
+	}
+}
+
+// reply waits for the result of r and writes its reply, and returns false if
+// the client stopped in the meantime.
+func (c *Client) reply(r *pendingRequest) bool {
+	select {
+	case result := <-r.result:
+		if result.Type != multipaxos.Ok {
+			c.manager.Respond(r.id, c.redirect(r, result))
+		}
+	case <-c.done:
+		return false
+	}
+	select {
+	case response := <-r.reply:
+		c.Write(response)
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// redirect returns the reply to a request that this peer could not run, which
+// is the reply of the leader if the request is forwarded to it.
+func (c *Client) redirect(r *pendingRequest,
+	result multipaxos.Result) string {
+	if result.Type == multipaxos.Retry {
+		return "retry"
+	}
+	if result.Type != multipaxos.SomeElseLeader {
+		panic("Result is not someone_else_leader")
+	}
+	if !r.forwarded {
+		return c.forward(r.mp, r.line)
+	}
+	addr, ok := c.leaderClientAddr(r.mp, result.Leader)
+	if !ok {
+		// leadership was lost but the new leader is not known yet.
+		return "retry"
+	}
+	// clients parse this to redirect: "leader <id> <client address>".
+	return fmt.Sprintf("leader %v %v", result.Leader, addr)
+}
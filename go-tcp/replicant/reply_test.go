@@ -0,0 +1,92 @@
+package replicant
+
+import (
+	"bufio"
+	"github.com/sosp23/replicated-store/go/config"
+	"github.com/sosp23/replicated-store/go/kvstore"
+	"github.com/sosp23/replicated-store/go/log"
+	"github.com/sosp23/replicated-store/go/multipaxos"
+	tcp "github.com/sosp23/replicated-store/go/multipaxos/network"
+	"github.com/sosp23/replicated-store/go/shard"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testConfig returns the config of peer 0 of three, on ports that the
+// multipaxos tests do not use.
+func testConfig() config.Config {
+	c := config.DefaultConfig(0, 3)
+	for i := range c.Peers {
+		c.Peers[i] = "127.0.0.1:" + strconv.Itoa(20000+i*1000)
+	}
+	return c
+}
+
+// newTestGroups returns the groups of peer 0, which follows peer 1.
+func newTestGroups(c config.Config) *Groups {
+	l := log.NewLog(kvstore.NewMemKVStore(), nil)
+	l.SetShards(0, shard.NewMap(c))
+	mp := multipaxos.NewMultipaxos(l, c)
+	mp.BecomeFollower(tcp.Ballot{Round: 1, Id: 1})
+	return &Groups{
+		shards:     shard.NewMap(c),
+		multipaxos: []*multipaxos.Multipaxos{mp},
+		logs:       []*log.Log{l},
+	}
+}
+
+// newTestClient starts client 0 of groups and returns the other end of its
+// connection, on which requests are sent and replies read.
+func newTestClient(groups *Groups) (*ClientManager, *bufio.Reader, net.Conn) {
+	conn, other := net.Pipe()
+	manager := NewClientManager(0, 3, groups, true)
+	manager.Start(conn)
+	return manager, bufio.NewReader(other), other
+}
+
+func readReply(t *testing.T, reader *bufio.Reader, conn net.Conn) string {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := reader.ReadString('\n')
+	assert.Nil(t, err)
+	return reply
+}
+
+func TestRedirectForwardedRequest(t *testing.T) {
+	c := testConfig()
+	_, reader, conn := newTestClient(newTestGroups(c))
+	defer conn.Close()
+
+	// a follower answers a forwarded request with the leader instead of
+	// forwarding it again.
+	conn.Write([]byte(forwardPrefix + "put foo bar\n"))
+	assert.Equal(t, "leader 1 "+clientAddr(c.Peers[1])+"\n",
+		readReply(t, reader, conn))
+}
+
+func TestRepliesInOrder(t *testing.T) {
+	manager, reader, conn := newTestClient(newTestGroups(testConfig()))
+	defer conn.Close()
+	client := manager.Get(0)
+
+	r1 := client.newRequest(nil, "get foo\n", false)
+	result1 := make(chan multipaxos.Result, 1)
+	client.await(r1, result1)
+	r2 := client.newRequest(nil, "get bar\n", false)
+	result2 := make(chan multipaxos.Result, 1)
+	client.await(r2, result2)
+
+	// the second request finishes first, but is answered after the first.
+	client.manager.Respond(r2.id, "2")
+	result2 <- multipaxos.Result{Type: multipaxos.Ok}
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := reader.ReadString('\n')
+	assert.NotNil(t, err)
+
+	client.manager.Respond(r1.id, "1")
+	result1 <- multipaxos.Result{Type: multipaxos.Ok}
+	assert.Equal(t, "1\n", readReply(t, reader, conn))
+	assert.Equal(t, "2\n", readReply(t, reader, conn))
+}
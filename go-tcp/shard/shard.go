@@ -0,0 +1,188 @@
+package shard
+
+import (
+	"encoding/json"
+	"errors"
+	logger "github.com/sirupsen/logrus"
+	"github.com/sosp23/replicated-store/go/config"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	ShardingHash  = "hash"
+	ShardingRange = "range"
+)
+
+// Map assigns every key to one of the consensus groups that share the
+// keyspace. Hash sharding spreads keys evenly across the groups. Range
+// sharding splits the keyspace into ranges, each owned by one group, which
+// start at the split keys in the config and can later be split and merged.
+// Every change makes a new version of the map, which records the keys that
+// changed hands in it.
+type Map struct {
+	Version  int64   `json:"version"`
+	Sharding string  `json:"sharding"`
+	Groups   int64   `json:"groups"`
+	Ranges   []Range `json:"ranges,omitempty"`
+	Moves    []Move  `json:"moves,omitempty"`
+}
+
+// Range holds the keys from Start up to the start of the next range.
+type Range struct {
+	Start string `json:"start"`
+	Group int64  `json:"group"`
+}
+
+// Move hands the keys from Start up to, but not including, End from group
+// From to group To. An empty End stands for the end of the keyspace.
+type Move struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	From  int64  `json:"from"`
+	To    int64  `json:"to"`
+}
+
+func NewMap(config config.Config) *Map {
+	m := &Map{
+		Sharding: config.Sharding,
+		Groups:   config.NumGroups(),
+	}
+	if m.Sharding == "" {
+		m.Sharding = ShardingHash
+	}
+	if m.Sharding == ShardingRange {
+		if int64(len(config.SplitKeys)) != m.Groups-1 ||
+			!sort.StringsAreSorted(config.SplitKeys) {
+			logger.Panic("range sharding needs one sorted split key less " +
+				"than there are groups")
+		}
+		for _, key := range config.SplitKeys {
+			if !isSplitKey(key) {
+				logger.Panicf("bad split key %q", key)
+			}
+		}
+		m.Ranges = append(m.Ranges, Range{Start: "", Group: 0})
+		for i, key := range config.SplitKeys {
+			m.Ranges = append(m.Ranges, Range{Start: key, Group: int64(i + 1)})
+		}
+	} else if m.Sharding != ShardingHash {
+		logger.Panic("no match sharding")
+	}
+	return m
+}
+
+func (m *Map) NumGroups() int64 {
+	return m.Groups
+}
+
+// Group returns the consensus group that owns key.
+func (m *Map) Group(key string) int64 {
+	if m.Sharding == ShardingRange {
+		return m.Ranges[m.find(key)].Group
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int64(h.Sum64() % uint64(m.Groups))
+}
+
+// find returns the index of the range that holds key.
+func (m *Map) find(key string) int {
+	return sort.Search(len(m.Ranges), func(i int) bool {
+		return m.Ranges[i].Start > key
+	}) - 1
+}
+
+// end returns where range i ends.
+func (m *Map) end(i int) string {
+	if i+1 < len(m.Ranges) {
+		return m.Ranges[i+1].Start
+	}
+	return ""
+}
+
+func (m *Map) next() *Map {
+	return &Map{
+		Version:  m.Version + 1,
+		Sharding: m.Sharding,
+		Groups:   m.Groups,
+		Ranges:   append([]Range(nil), m.Ranges...),
+	}
+}
+
+// Split starts a new range at key and hands it to group. It reports false if
+// the map is not sharded by range or key already starts a range, and for a key
+// with white space, which the split and merge requests cannot carry.
+func (m *Map) Split(key string, group int64) (*Map, bool) {
+	if m.Sharding != ShardingRange || !isSplitKey(key) || group < 0 ||
+		group >= m.Groups {
+		return nil, false
+	}
+	i := m.find(key)
+	if m.Ranges[i].Start == key {
+		return nil, false
+	}
+	next := m.next()
+	next.Ranges = append(next.Ranges[:i+1], append([]Range{{key, group}},
+		next.Ranges[i+1:]...)...)
+	if m.Ranges[i].Group != group {
+		next.Moves = []Move{{key, m.end(i), m.Ranges[i].Group, group}}
+	}
+	return next, true
+}
+
+// isSplitKey reports whether a range can start at key, which rules out the
+// empty key that the first range starts at and keys with white space.
+func isSplitKey(key string) bool {
+	return key != "" && strings.IndexFunc(key, unicode.IsSpace) < 0
+}
+
+// Merge joins the range that starts at key to the one before it, whose group
+// takes over its keys. It reports false if no range other than the first
+// starts at key.
+func (m *Map) Merge(key string) (*Map, bool) {
+	if m.Sharding != ShardingRange || key == "" {
+		return nil, false
+	}
+	i := m.find(key)
+	if m.Ranges[i].Start != key {
+		return nil, false
+	}
+	next := m.next()
+	next.Ranges = append(next.Ranges[:i], next.Ranges[i+1:]...)
+	if m.Ranges[i].Group != m.Ranges[i-1].Group {
+		next.Moves = []Move{{key, m.end(i), m.Ranges[i].Group,
+			m.Ranges[i-1].Group}}
+	}
+	return next, true
+}
+
+// Contains reports whether key is one of the keys the move hands over.
+func (move Move) Contains(key string) bool {
+	return key >= move.Start && (move.End == "" || key < move.End)
+}
+
+func (m *Map) Encode() string {
+	data, _ := json.Marshal(m)
+	return string(data)
+}
+
+func Decode(value string) (*Map, error) {
+	m := &Map{}
+	if err := json.Unmarshal([]byte(value), m); err != nil {
+		return nil, err
+	}
+	if m.Groups <= 0 || m.Sharding == ShardingRange && (len(m.Ranges) == 0 ||
+		m.Ranges[0].Start != "") {
+		return nil, errors.New("invalid shard map")
+	}
+	for i, r := range m.Ranges {
+		if r.Group < 0 || r.Group >= m.Groups ||
+			i > 0 && r.Start <= m.Ranges[i-1].Start {
+			return nil, errors.New("invalid shard map")
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,101 @@
+package shard
+
+import (
+	"github.com/sosp23/replicated-store/go/config"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+)
+
+func TestHashSharding(t *testing.T) {
+	c := config.DefaultConfig(0, 3)
+	assert.EqualValues(t, 0, NewMap(c).Group("foo"))
+
+	c.Groups = 4
+	m := NewMap(c)
+	assert.EqualValues(t, 4, m.NumGroups())
+	seen := make(map[int64]bool)
+	for i := 0; i < 100; i++ {
+		key := "key" + strconv.Itoa(i)
+		group := m.Group(key)
+		assert.True(t, group >= 0 && group < 4)
+		assert.Equal(t, group, m.Group(key))
+		seen[group] = true
+	}
+	assert.Len(t, seen, 4)
+}
+
+func TestRangeSharding(t *testing.T) {
+	c := config.DefaultConfig(0, 3)
+	c.Groups = 3
+	c.Sharding = ShardingRange
+	c.SplitKeys = []string{"g", "p"}
+	m := NewMap(c)
+	assert.EqualValues(t, 0, m.Group(""))
+	assert.EqualValues(t, 0, m.Group("apple"))
+	assert.EqualValues(t, 1, m.Group("g"))
+	assert.EqualValues(t, 1, m.Group("orange"))
+	assert.EqualValues(t, 2, m.Group("p"))
+	assert.EqualValues(t, 2, m.Group("zebra"))
+
+	c.SplitKeys = []string{"p", "g"}
+	assert.Panics(t, func() { NewMap(c) })
+	c.SplitKeys = []string{"g"}
+	assert.Panics(t, func() { NewMap(c) })
+	c.SplitKeys = []string{"", "p"}
+	assert.Panics(t, func() { NewMap(c) })
+	c.SplitKeys = []string{"g", "p q"}
+	assert.Panics(t, func() { NewMap(c) })
+}
+
+func TestSplitAndMerge(t *testing.T) {
+	c := config.DefaultConfig(0, 3)
+	c.Groups = 2
+	c.Sharding = ShardingRange
+	c.SplitKeys = []string{"m"}
+	m := NewMap(c)
+
+	next, ok := m.Split("g", 1)
+	assert.True(t, ok)
+	assert.EqualValues(t, 1, next.Version)
+	assert.EqualValues(t, 0, next.Group("f"))
+	assert.EqualValues(t, 1, next.Group("g"))
+	assert.EqualValues(t, 1, next.Group("k"))
+	assert.EqualValues(t, 1, next.Group("m"))
+	assert.Equal(t, []Move{{"g", "m", 0, 1}}, next.Moves)
+	// the old version is left as it was.
+	assert.EqualValues(t, 0, m.Group("g"))
+
+	_, ok = next.Split("g", 0)
+	assert.False(t, ok)
+	_, ok = next.Split("h", 2)
+	assert.False(t, ok)
+	_, ok = next.Split("h i", 1)
+	assert.False(t, ok)
+	same, ok := next.Split("h", 1)
+	assert.True(t, ok)
+	assert.Empty(t, same.Moves)
+
+	merged, ok := next.Merge("g")
+	assert.True(t, ok)
+	assert.EqualValues(t, 2, merged.Version)
+	assert.EqualValues(t, 0, merged.Group("k"))
+	assert.EqualValues(t, 1, merged.Group("m"))
+	assert.Equal(t, []Move{{"g", "m", 1, 0}}, merged.Moves)
+	assert.True(t, merged.Moves[0].Contains("g"))
+	assert.False(t, merged.Moves[0].Contains("m"))
+	_, ok = merged.Merge("g")
+	assert.False(t, ok)
+	_, ok = merged.Merge("")
+	assert.False(t, ok)
+
+	decoded, err := Decode(merged.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, merged, decoded)
+	_, err = Decode(`{"version":1,"sharding":"range","groups":2}`)
+	assert.NotNil(t, err)
+
+	c.Sharding = ShardingHash
+	_, ok = NewMap(c).Split("g", 1)
+	assert.False(t, ok)
+}